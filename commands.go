@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+)
+
+// checkTimeout bounds the time spent trying to reach each output
+const checkTimeout = 5 * time.Second
+
+// runCommand runs a subcommand and returns the exit code
+func runCommand(args []string, configPath string, strict bool, w io.Writer) int {
+	switch strings.Join(args, " ") {
+	case "plugins list":
+		listPlugins(w)
+		return 0
+	case "config check":
+		if !checkConfig(configPath, strict, w) {
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(w, "Unknown command: %s\n", strings.Join(args, " "))
+	printCommands(w)
+	return 2
+}
+
+// printCommands prints the list of the available subcommands
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  config check   validate the config file and try to reach the outputs")
+	fmt.Fprintln(w, "  plugins list   print the available plugins and their options")
+}
+
+// listPlugins prints the compiled-in plugins along with their options
+func listPlugins(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, r := range plugins.Registered() {
+		fmt.Fprintln(tw, r.Name)
+		printOptions(tw, r.Options)
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintln(tw, "Options accepted by every plugin")
+	printOptions(tw, plugins.CommonOptions)
+	tw.Flush()
+}
+
+func printOptions(w io.Writer, options []plugins.Option) {
+	for _, o := range options {
+		def := ""
+		if o.Default != nil {
+			def = fmt.Sprintf("%v", o.Default)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", o.Name, o.Type, def, o.Description)
+	}
+}
+
+// report prints the outcome of each check and keeps track of the failures
+type report struct {
+	w      io.Writer
+	failed bool
+}
+
+func (r *report) pass(format string, a ...interface{}) {
+	fmt.Fprintf(r.w, "PASS  "+format+"\n", a...)
+}
+
+func (r *report) warn(format string, a ...interface{}) {
+	fmt.Fprintf(r.w, "WARN  "+format+"\n", a...)
+}
+
+func (r *report) fail(format string, a ...interface{}) {
+	fmt.Fprintf(r.w, "FAIL  "+format+"\n", a...)
+	r.failed = true
+}
+
+// checkConfig loads the config file, validates it and tries to reach the
+// configured outputs, printing a report. It returns false if any check failed,
+// in strict mode warnings are failures too.
+func checkConfig(configPath string, strict bool, w io.Writer) bool {
+	r := &report{w: w}
+	defer func() {
+		if r.failed {
+			fmt.Fprintln(w, "\nConfiguration check failed")
+		} else {
+			fmt.Fprintln(w, "\nConfiguration check passed")
+		}
+	}()
+
+	if err := initConfig(configPath); err != nil {
+		r.fail("config file: %s", err)
+		return false
+	}
+	r.pass("config file: %s", viper.ConfigFileUsed())
+
+	if _, err := intake.LoadSettings(viper.GetViper()); err != nil {
+		r.fail("settings: %s", err)
+	} else {
+		r.pass("settings")
+	}
+
+	if _, err := processors.FromConfig(viper.GetViper(), "processors"); err != nil {
+		r.fail("processors: %s", err)
+	} else {
+		r.pass("processors")
+	}
+
+	instances, err := plugins.GetInstances(viper.GetViper())
+	if err != nil {
+		r.fail("plugins: %s", err)
+		return false
+	}
+	for _, p := range plugins.Validate(instances) {
+		if p.Fatal || strict {
+			r.fail("%s", p)
+		} else {
+			r.warn("%s", p)
+		}
+	}
+	if err := checkProcessorNames(viper.GetViper(), instances); err != nil {
+		r.fail("processors: %s", err)
+	}
+
+	for _, inst := range instances {
+		p, err := plugins.NewInstance(inst)
+		if err != nil {
+			// already reported by the validation
+			continue
+		}
+		name := fmt.Sprintf("plugin %s (%s)", inst.Name, inst.Type)
+
+		errs := []error{}
+		if _, err := plugins.GetSubscriptionOptions(inst.Config); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := plugins.GetMetricsFilter(inst.Config); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := processors.FromConfig(inst.Config, "processors"); err != nil {
+			errs = append(errs, err)
+		}
+		if c, ok := p.(plugins.Checker); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			if err := c.Check(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("can't reach the output: %w", err))
+			}
+			cancel()
+		}
+
+		if len(errs) == 0 {
+			r.pass("%s", name)
+		}
+		for _, err := range errs {
+			r.fail("%s: %s", name, err)
+		}
+	}
+
+	return !r.failed
+}
@@ -0,0 +1,94 @@
+package intake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/masci/threadle/output"
+	"github.com/spf13/viper"
+)
+
+// APIKey maps an API key accepted by Threadle to the tenant owning it
+type APIKey struct {
+	Key    string
+	Tenant string
+}
+
+// tenantKey is used to store the tenant in the request context
+type tenantKey struct{}
+
+// parseAPIKeys reads the list of accepted API keys from the config. When the
+// list is empty, any API key is accepted and messages have no tenant.
+func parseAPIKeys(cfg *viper.Viper) (map[string]string, error) {
+	keys := []APIKey{}
+	if err := cfg.UnmarshalKey("api_keys", &keys); err != nil {
+		return nil, fmt.Errorf("invalid api_keys: %w", err)
+	}
+
+	var m map[string]string
+	if len(keys) > 0 {
+		m = make(map[string]string, len(keys))
+		for _, k := range keys {
+			if k.Key == "" {
+				return nil, fmt.Errorf("invalid api_keys: empty key for tenant '%s'", k.Tenant)
+			}
+			m[k.Key] = k.Tenant
+		}
+	}
+	return m, nil
+}
+
+// lookupTenant returns the tenant owning the API key and whether the
+// key is accepted
+func lookupTenant(key string) (string, bool) {
+	apiKeys := getSettings().APIKeys
+	if apiKeys == nil {
+		return "", true
+	}
+	tenant, found := apiKeys[key]
+	return tenant, found
+}
+
+// getAPIKey returns the API key used by the Datadog Agent, either passed
+// as an header or as a query parameter depending on the endpoint
+func getAPIKey(r *http.Request) string {
+	if key := r.Header.Get("DD-API-KEY"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authMiddleware rejects requests using an unknown API key and stores
+// the tenant in the request context
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// the health endpoint is left open for probes, the status one
+		// requires an API key like the Datadog API
+		if r.URL.Path == HealthEndpoint {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		tenant, ok := lookupTenant(getAPIKey(r))
+		if !ok {
+			output.DEBUG.Printf("Rejecting request to %s: invalid API key", r.URL.Path)
+			http.Error(rw, `{"errors": ["Forbidden"]}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// getTenant returns the tenant stored in the request context
+func getTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// validateHandler serves the /api/v1/validate endpoint, invalid API keys
+// were already rejected at this point
+func validateHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, `{"valid": true}`)
+}
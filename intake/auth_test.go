@@ -0,0 +1,101 @@
+package intake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// setAPIKeys sets the settings read from a config accepting the given API keys
+func setAPIKeys(t *testing.T, keys []map[string]string) {
+	cfg := viper.New()
+	cfg.Set("api_keys", keys)
+	s, err := LoadSettings(cfg)
+	require.Nil(t, err)
+	SetSettings(s)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	defer SetSettings(nil)
+
+	var gotTenant string
+	handler := authMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotTenant = getTenant(r)
+	}))
+	request := func(header, query string) int {
+		r := httptest.NewRequest("POST", SeriesEndpointV1+query, nil)
+		if header != "" {
+			r.Header.Set("DD-API-KEY", header)
+		}
+		rw := httptest.NewRecorder()
+		gotTenant = ""
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	// no keys configured, everything is accepted
+	setAPIKeys(t, nil)
+	require.Equal(t, http.StatusOK, request("whatever", ""))
+	require.Equal(t, "", gotTenant)
+
+	setAPIKeys(t, []map[string]string{
+		{"key": "abc", "tenant": "prod"},
+		{"key": "def", "tenant": "staging"},
+	})
+
+	require.Equal(t, http.StatusOK, request("abc", ""))
+	require.Equal(t, "prod", gotTenant)
+	require.Equal(t, http.StatusOK, request("", "?api_key=def"))
+	require.Equal(t, "staging", gotTenant)
+	require.Equal(t, http.StatusForbidden, request("xyz", ""))
+	require.Equal(t, http.StatusForbidden, request("", ""))
+}
+
+func TestParseAPIKeysInvalid(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("api_keys", []map[string]string{{"tenant": "prod"}})
+	_, err := parseAPIKeys(cfg)
+	require.NotNil(t, err)
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	defer SetSettings(nil)
+	setAPIKeys(t, []map[string]string{{"key": "abc", "tenant": "prod"}})
+
+	r := httptest.NewRequest("GET", ValidateEndpointV1, nil)
+	r.Header.Set("DD-API-KEY", "abc")
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.JSONEq(t, `{"valid": true}`, rw.Body.String())
+
+	r = httptest.NewRequest("GET", ValidateEndpointV1, nil)
+	r.Header.Set("DD-API-KEY", "nope")
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+	require.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestThreadleEndpointsAuth(t *testing.T) {
+	defer SetSettings(nil)
+	setAPIKeys(t, []map[string]string{{"key": "abc", "tenant": "prod"}})
+
+	request := func(path, key string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			r.Header.Set("DD-API-KEY", key)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	// the status requires an API key, the health is open to probes
+	require.Equal(t, http.StatusForbidden, request(StatusEndpoint, ""))
+	require.Equal(t, http.StatusForbidden, request(StatusEndpoint, "nope"))
+	require.Equal(t, http.StatusOK, request(StatusEndpoint, "abc"))
+	require.Equal(t, http.StatusOK, request(HealthEndpoint, ""))
+}
@@ -0,0 +1,20 @@
+package intake
+
+import "encoding/json"
+
+// CheckRun represents the result of a service check
+type CheckRun struct {
+	Check     string
+	HostName  string `json:"host_name"`
+	Timestamp int64
+	Status    int
+	Message   string
+	Tags      []string
+}
+
+// DecodeCheckRuns decodes a payload and returns a slice of CheckRun
+func DecodeCheckRuns(payload []byte) ([]CheckRun, error) {
+	checkRuns := []CheckRun{}
+	err := json.Unmarshal(payload, &checkRuns)
+	return checkRuns, err
+}
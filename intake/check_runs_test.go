@@ -0,0 +1,30 @@
+package intake
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCheckRuns(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/check_runs.json")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+
+	got, err := DecodeCheckRuns(content)
+	require.Nil(t, err)
+	require.Len(t, got, 8)
+	require.Equal(t, CheckRun{
+		Check:     "datadog.agent.check_status",
+		HostName:  "MacLastic2.local",
+		Timestamp: 1612613793,
+		Status:    0,
+		Message:   "",
+		Tags:      []string{"check:uptime"},
+	}, got[0])
+	// tags can be null
+	require.Equal(t, "datadog.agent.up", got[7].Check)
+	require.Nil(t, got[7].Tags)
+}
@@ -0,0 +1,77 @@
+package intake
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Event represents a Datadog event, like a deployment or an alert
+type Event struct {
+	Title          string   `json:"msg_title"`
+	Text           string   `json:"msg_text"`
+	Timestamp      int64    `json:"timestamp"`
+	Priority       string   `json:"priority"`
+	Host           string   `json:"host"`
+	Tags           []string `json:"tags"`
+	AlertType      string   `json:"alert_type"`
+	AggregationKey string   `json:"aggregation_key"`
+	SourceTypeName string   `json:"source_type_name"`
+}
+
+// events are grouped by source type, both in the /intake/ and in the
+// /api/v2/events payloads
+type events struct {
+	Events map[string][]Event `json:"events"`
+}
+
+// DecodeEvents decodes a payload and returns a slice of Event
+func DecodeEvents(payload []byte) ([]Event, error) {
+	e := events{}
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return []Event{}, err
+	}
+	return flattenEvents(e.Events), nil
+}
+
+// GetEvents returns the events embedded in the metadata payload
+func (hm *HostMeta) GetEvents() []Event {
+	return flattenEvents(hm.Events)
+}
+
+// flattenEvents turns the events grouped by source type into a slice,
+// filling the source type of each event when missing
+func flattenEvents(bySource map[string][]Event) []Event {
+	// sort the source types so that the order of the events is stable
+	sources := make([]string, 0, len(bySource))
+	for source := range bySource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	ret := []Event{}
+	for _, source := range sources {
+		for _, e := range bySource[source] {
+			if e.SourceTypeName == "" {
+				e.SourceTypeName = source
+			}
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// extractEvents returns a payload containing only the events embedded in an
+// /intake/ payload, ready to be decoded by DecodeEvents. If there are no
+// events, nil is returned.
+func extractEvents(payload []byte) ([]byte, error) {
+	raw := struct {
+		Events map[string]json.RawMessage `json:"events"`
+	}{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw.Events) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(raw)
+}
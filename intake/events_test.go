@@ -0,0 +1,68 @@
+package intake
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEvents(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/events.json")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+
+	expected := []Event{
+		{
+			Title:          "Disk almost full",
+			Text:           "/dev/disk1s1 is 95% full",
+			Timestamp:      1612906510,
+			Priority:       "low",
+			Host:           "MacLastic2.local",
+			AlertType:      "warning",
+			SourceTypeName: "System",
+		},
+		{
+			Title:          "Deployed threadle v0.3.0",
+			Text:           "Deployment completed successfully",
+			Timestamp:      1612906502,
+			Priority:       "normal",
+			Host:           "MacLastic2.local",
+			Tags:           []string{"env:prod", "service:threadle"},
+			AlertType:      "info",
+			AggregationKey: "deploy-threadle",
+			SourceTypeName: "deployments",
+		},
+	}
+
+	got, err := DecodeEvents(content)
+	require.Nil(t, err)
+	require.Equal(t, expected, got)
+
+	// the same events are available from the host metadata
+	hostMeta, err := DecodeHostMeta(content)
+	require.Nil(t, err)
+	require.Equal(t, expected, hostMeta.GetEvents())
+}
+
+func TestExtractEvents(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/events.json")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+	payload, err := extractEvents(content)
+	require.Nil(t, err)
+	events, err := DecodeEvents(payload)
+	require.Nil(t, err)
+	require.Len(t, events, 2)
+
+	// no events in the host metadata
+	content, err = ioutil.ReadFile("testdata/host_meta.json")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+	payload, err = extractEvents(content)
+	require.Nil(t, err)
+	require.Nil(t, payload)
+}
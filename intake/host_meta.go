@@ -40,6 +40,7 @@ type HostMeta struct {
 		IPV6 string `json:"ipaddressv6"`
 		Mac  string `json:"macaddress"`
 	}
+	Events    map[string][]Event
 	Logs      struct{ Transport string }
 	Resources struct {
 		Processes struct {
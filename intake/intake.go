@@ -2,10 +2,10 @@ package intake
 
 import (
 	"context"
+	"encoding/json"
 	fmt "fmt"
 	"net/http"
-	"os"
-	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -32,7 +32,12 @@ const (
 	HostMetadataEndpointV2  = "/api/v2/host_metadata"
 	MetadataEndpointV2      = "/api/v2/metadata"
 
+	// Threadle's own endpoints
+	StatusEndpoint = "/threadle/status"
+	HealthEndpoint = "/threadle/health"
+
 	v1PathPrefix = "/api/v1"
+	v2PathPrefix = "/api/v2"
 )
 
 var (
@@ -40,6 +45,14 @@ var (
 	MsgBroker *PubSub
 	// router is the API router
 	router *mux.Router
+
+	// healthChecks are run by the health endpoint
+	healthChecks   = map[string]func() error{}
+	healthChecksMu sync.RWMutex
+
+	// statusProviders add their own sections to the status endpoint
+	statusProviders   = map[string]func() interface{}{}
+	statusProvidersMu sync.RWMutex
 )
 
 // Init the message broker and the API router
@@ -47,16 +60,116 @@ func init() {
 	MsgBroker = NewPubsub()
 
 	router = mux.NewRouter()
-	// always validate the api key
-	router.HandleFunc(ValidateEndpointV1, func(rw http.ResponseWriter, r *http.Request) {})
+	// reject unknown api keys on every endpoint
+	router.Use(authMiddleware)
+	router.HandleFunc(ValidateEndpointV1, validateHandler)
+	// report the state of the message broker
+	router.HandleFunc(StatusEndpoint, statusHandler)
+	// report the health of the plugins
+	router.HandleFunc(HealthEndpoint, healthHandler)
+	// sketches, both v1 and beta endpoints carry the same payload
+	router.HandleFunc(SketchSeriesEndpointV1, sketchesHandler)
+	router.HandleFunc(SketchSeriesEndpointV2, sketchesHandler)
 	// API v1, multiple endpoints
 	router.PathPrefix(v1PathPrefix).HandlerFunc(v1Handler)
+	// API v2, multiple endpoints
+	router.PathPrefix(v2PathPrefix).HandlerFunc(v2Handler)
 	// intake, single endpoint
 	router.HandleFunc(IntakeEndpointV1, intakeHandler)
 	// catch-all route, for debug and unsupported endpoints
 	router.PathPrefix("/").HandlerFunc(defaultHandler)
 }
 
+// This handler serves the status of Threadle as JSON
+func statusHandler(rw http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"topics":        MsgBroker.Topics(),
+		"subscriptions": MsgBroker.Stats(),
+	}
+	// providers run without the lock, they might register other providers
+	statusProvidersMu.RLock()
+	providers := make(map[string]func() interface{}, len(statusProviders))
+	for name, provider := range statusProviders {
+		providers[name] = provider
+	}
+	statusProvidersMu.RUnlock()
+	for name, provider := range providers {
+		status[name] = provider()
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		output.ERROR.Println("statusHandler: error encoding status:", err)
+	}
+}
+
+// RegisterHealthCheck adds a check to be run by the health endpoint, a check
+// registered with the same name is replaced. Passing a nil check removes it.
+func RegisterHealthCheck(name string, check func() error) {
+	healthChecksMu.Lock()
+	defer healthChecksMu.Unlock()
+
+	if check == nil {
+		delete(healthChecks, name)
+		return
+	}
+	healthChecks[name] = check
+}
+
+// RegisterStatus adds a section to the status endpoint, filled with the value
+// returned by provider. Passing a nil provider removes the section.
+func RegisterStatus(name string, provider func() interface{}) {
+	statusProvidersMu.Lock()
+	defer statusProvidersMu.Unlock()
+
+	if provider == nil {
+		delete(statusProviders, name)
+		return
+	}
+	statusProviders[name] = provider
+}
+
+// This handler runs the health checks and reports the result as JSON, the
+// status code is 503 when any of the checks fail
+func healthHandler(rw http.ResponseWriter, r *http.Request) {
+	// checks run without the lock, they might take locks held by callers
+	// of RegisterHealthCheck, like the plugins manager
+	healthChecksMu.RLock()
+	registered := make(map[string]func() error, len(healthChecks))
+	for name, check := range healthChecks {
+		registered[name] = check
+	}
+	healthChecksMu.RUnlock()
+
+	healthy := true
+	checks := map[string]string{}
+	for name, check := range registered {
+		checks[name] = "ok"
+		if err := check(); err != nil {
+			checks[name] = err.Error()
+			healthy = false
+		}
+	}
+
+	status := map[string]interface{}{
+		"healthy": healthy,
+		"checks":  checks,
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		output.ERROR.Println("healthHandler: error encoding status:", err)
+	}
+}
+
+// Handler returns the handler serving the Datadog Agent and Threadle
+// endpoints, as used by Serve
+func Handler() http.Handler {
+	return router
+}
+
 func defaultHandler(rw http.ResponseWriter, r *http.Request) {
 	output.DEBUG.Printf("Unhandled path requested: %s", r.URL)
 }
@@ -69,7 +182,17 @@ func intakeHandler(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "", http.StatusBadRequest)
 		return
 	}
-	MsgBroker.Publish(r.URL.Path, body)
+	MsgBroker.Publish(r.URL.Path, newMessage(r, r.URL.Path, body))
+
+	// events can be embedded in the payload, publish them on their own topic
+	events, err := extractEvents(body)
+	if err != nil {
+		output.ERROR.Println("intakeHandler: error extracting events:", err)
+		return
+	}
+	if events != nil {
+		MsgBroker.Publish(EventsEndpointV2, newMessage(r, EventsEndpointV2, events))
+	}
 }
 
 // This handler serves the api/v1/* endpoints, deflates the request body
@@ -82,7 +205,78 @@ func v1Handler(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "", http.StatusBadRequest)
 		return
 	}
-	MsgBroker.Publish(r.URL.Path, body)
+	MsgBroker.Publish(r.URL.Path, newMessage(r, r.URL.Path, body))
+}
+
+// This handler serves the api/v2/* endpoints. Series are sent by the Datadog
+// Agent as protobuf, they're normalized and published to the v1 series topic
+// so plugins can consume them transparently. Any other payload is sent to the
+// message broker using the URL path as the topic name, this includes events
+// that are published on the EventsEndpointV2 topic together with the events
+// embedded in the /intake/ payloads.
+func v2Handler(rw http.ResponseWriter, r *http.Request) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		output.ERROR.Println("v2Handler: error reading request body:", err)
+		http.Error(rw, "", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case SeriesEndpointV2:
+		metrics, err := DecodeV2Metrics(body)
+		if err != nil {
+			output.ERROR.Println("v2Handler: error decoding series:", err)
+			http.Error(rw, "", http.StatusBadRequest)
+			return
+		}
+		payload, err := json.Marshal(series{metrics})
+		if err != nil {
+			output.ERROR.Println("v2Handler: error encoding series:", err)
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		// plugins can get the series without decoding the payload again
+		msg := newMessage(r, SeriesEndpointV1, payload)
+		msg.setV1Metrics(metrics)
+		MsgBroker.Publish(SeriesEndpointV1, msg)
+	default:
+		MsgBroker.Publish(r.URL.Path, newMessage(r, r.URL.Path, body))
+	}
+}
+
+// This handler serves the sketches endpoints. Distributions are summarized
+// and published to the v1 series topic as derived metrics, see
+// Sketch.ToV1Metrics.
+func sketchesHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		output.ERROR.Println("sketchesHandler: error reading request body:", err)
+		http.Error(rw, "", http.StatusBadRequest)
+		return
+	}
+
+	sketches, err := DecodeSketches(body)
+	if err != nil {
+		output.ERROR.Println("sketchesHandler: error decoding sketches:", err)
+		http.Error(rw, "", http.StatusBadRequest)
+		return
+	}
+
+	metrics := []V1Metric{}
+	percentiles := getSettings().Percentiles
+	for i := range sketches {
+		metrics = append(metrics, sketches[i].ToV1Metrics(percentiles)...)
+	}
+	payload, err := json.Marshal(series{metrics})
+	if err != nil {
+		output.ERROR.Println("sketchesHandler: error encoding series:", err)
+		http.Error(rw, "", http.StatusInternalServerError)
+		return
+	}
+	msg := newMessage(r, SeriesEndpointV1, payload)
+	msg.setV1Metrics(metrics)
+	MsgBroker.Publish(SeriesEndpointV1, msg)
 }
 
 // GetV1Endpoints returns a slice containing all the v1 endpoints
@@ -98,8 +292,14 @@ func GetV1Endpoints() []string {
 	}
 }
 
-// Serve starts the HTTP server and blocks
-func Serve() {
+// Serve starts the HTTP server and blocks until the context is done or the
+// server fails. On return the server is shut down and the message broker is
+// closed, so that subscribers can drain the messages still buffered.
+//
+// The whole shutdown must complete within timeout: Serve returns the deadline
+// it used for the HTTP server, so that the caller can stop the subscribers
+// within the same deadline.
+func Serve(ctx context.Context, timeout time.Duration) (time.Time, error) {
 	// Start the HTTP server
 	srv := &http.Server{
 		Addr: fmt.Sprintf("0.0.0.0:%s", viper.GetString("port")),
@@ -111,27 +311,36 @@ func Serve() {
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
+	errc := make(chan error, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			output.FATAL.Println(err)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errc <- err
 		}
 	}()
 
 	output.INFO.Println("Threadle running at", srv.Addr)
 
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// Block until we're asked to stop or the server fails.
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
 
-	// Block until we receive our signal.
-	<-c
+	output.INFO.Println("shutting down")
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), 10)
+	deadline := time.Now().Add(timeout)
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	srv.Shutdown(ctx)
-	output.INFO.Println("shutting down")
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+		output.ERROR.Println("error shutting down the HTTP server:", shutdownErr)
+	}
+
+	// No more messages will be published
+	MsgBroker.Close()
+
+	return deadline, err
 }
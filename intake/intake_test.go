@@ -0,0 +1,94 @@
+package intake
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/output"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log errors, the output must be configured
+	output.Init(0)
+	os.Exit(m.Run())
+}
+
+func TestHealthHandler(t *testing.T) {
+	defer RegisterHealthCheck("good", nil)
+	defer RegisterHealthCheck("bad", nil)
+
+	RegisterHealthCheck("good", func() error { return nil })
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", HealthEndpoint, nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.JSONEq(t, `{"healthy": true, "checks": {"good": "ok"}}`, rw.Body.String())
+
+	RegisterHealthCheck("bad", func() error { return errors.New("boom") })
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", HealthEndpoint, nil))
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	require.JSONEq(t, `{"healthy": false, "checks": {"good": "ok", "bad": "boom"}}`, rw.Body.String())
+}
+
+func TestHealthHandlerRegister(t *testing.T) {
+	defer RegisterHealthCheck("locking", nil)
+	defer RegisterHealthCheck("other", nil)
+
+	// the check takes a lock held while registering another check
+	var mu sync.Mutex
+	inCheck := make(chan struct{})
+	RegisterHealthCheck("locking", func() error {
+		close(inCheck)
+		mu.Lock()
+		defer mu.Unlock()
+		return nil
+	})
+
+	mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", HealthEndpoint, nil))
+	}()
+	<-inCheck
+	registered := make(chan struct{})
+	go func() {
+		RegisterHealthCheck("other", func() error { return nil })
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		mu.Unlock()
+		t.Fatal("RegisterHealthCheck blocked by a running check")
+	}
+	mu.Unlock()
+	<-done
+}
+
+func TestStatusHandler(t *testing.T) {
+	defer RegisterStatus("custom", nil)
+
+	RegisterStatus("custom", func() interface{} { return map[string]int{"foo": 1} })
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", StatusEndpoint, nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	status := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &status))
+	require.Contains(t, status, "topics")
+	require.Contains(t, status, "subscriptions")
+	require.Equal(t, map[string]interface{}{"foo": float64(1)}, status["custom"])
+
+	RegisterStatus("custom", nil)
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", StatusEndpoint, nil))
+	require.NotContains(t, rw.Body.String(), "custom")
+}
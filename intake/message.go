@@ -0,0 +1,134 @@
+package intake
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is the envelope of the data sent through the broker, carrying the
+// payload along with the context of the request that produced it.
+//
+// The same Message is delivered to every subscriber of a topic, so payloads
+// are decoded only once no matter how many plugins need them. The decoded
+// data is shared and must be treated as read-only.
+type Message struct {
+	// Body is the payload sent by the Datadog Agent, decompressed
+	Body []byte
+	// Tenant owns the API key used to send the payload, empty when
+	// API keys are not configured
+	Tenant string
+	// APIKey is the API key used by the Datadog Agent
+	APIKey string
+	// RemoteAddr is the IP address of the Datadog Agent
+	RemoteAddr string
+	// Header contains the headers of the request
+	Header http.Header
+	// Topic the message is published to. PubSub.Publish never modifies
+	// the message, the topic is set when the message is created.
+	Topic string
+	// Endpoint is the path requested by the Datadog Agent, it might differ
+	// from the topic when a payload is normalized, for example v2 series
+	Endpoint string
+	// Version of the API used by the Datadog Agent, like "v1" or "v2"
+	Version string
+	// ReceivedAt is when the request was received
+	ReceivedAt time.Time
+
+	metricsOnce sync.Once
+	metrics     []V1Metric
+	metricsErr  error
+
+	checkRunsOnce sync.Once
+	checkRuns     []CheckRun
+	checkRunsErr  error
+
+	eventsOnce sync.Once
+	events     []Event
+	eventsErr  error
+
+	hostMetaOnce sync.Once
+	hostMeta     *HostMeta
+	hostMetaErr  error
+}
+
+// newMessage creates a Message to be published to topic out of the body of a request
+func newMessage(r *http.Request, topic string, body []byte) *Message {
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	return &Message{
+		Body:       body,
+		Tenant:     getTenant(r),
+		APIKey:     getAPIKey(r),
+		RemoteAddr: remoteAddr,
+		Header:     r.Header.Clone(),
+		Topic:      topic,
+		Endpoint:   r.URL.Path,
+		Version:    getAPIVersion(r.URL.Path),
+		ReceivedAt: time.Now(),
+	}
+}
+
+// getAPIVersion returns the version of the API given the endpoint path
+func getAPIVersion(path string) string {
+	switch {
+	case path == IntakeEndpointV1:
+		return "v1"
+	case strings.HasPrefix(path, "/api/"):
+		toks := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 2)
+		return toks[0]
+	}
+	return ""
+}
+
+// V1Metrics returns the series contained in the message, decoding the body
+// and applying the metrics processor the first time it's called
+func (m *Message) V1Metrics() ([]V1Metric, error) {
+	m.metricsOnce.Do(func() {
+		m.metrics, m.metricsErr = DecodeV1Metrics(m.Body)
+		if m.metricsErr == nil {
+			m.metrics = processMetrics(m.metrics)
+		}
+	})
+	return m.metrics, m.metricsErr
+}
+
+// setV1Metrics stores series already decoded, so that V1Metrics won't
+// decode the body
+func (m *Message) setV1Metrics(metrics []V1Metric) {
+	m.metricsOnce.Do(func() {
+		m.metrics = processMetrics(metrics)
+	})
+}
+
+// CheckRuns returns the service checks contained in the message, decoding
+// the body the first time it's called
+func (m *Message) CheckRuns() ([]CheckRun, error) {
+	m.checkRunsOnce.Do(func() {
+		m.checkRuns, m.checkRunsErr = DecodeCheckRuns(m.Body)
+	})
+	return m.checkRuns, m.checkRunsErr
+}
+
+// Events returns the events contained in the message, decoding the body
+// the first time it's called
+func (m *Message) Events() ([]Event, error) {
+	m.eventsOnce.Do(func() {
+		m.events, m.eventsErr = DecodeEvents(m.Body)
+	})
+	return m.events, m.eventsErr
+}
+
+// HostMeta returns the host metadata contained in the message, decoding the
+// body the first time it's called
+func (m *Message) HostMeta() (*HostMeta, error) {
+	m.hostMetaOnce.Do(func() {
+		m.hostMeta, m.hostMetaErr = DecodeHostMeta(m.Body)
+	})
+	return m.hostMeta, m.hostMetaErr
+}
@@ -0,0 +1,91 @@
+package intake
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMessage(t *testing.T) {
+	r := httptest.NewRequest("POST", SeriesEndpointV2+"?api_key=abc", nil)
+	r.RemoteAddr = "10.0.0.1:54321"
+	r.Header.Set("Content-Encoding", "deflate")
+
+	msg := newMessage(r, SeriesEndpointV1, []byte("{}"))
+	require.Equal(t, []byte("{}"), msg.Body)
+	require.Equal(t, "abc", msg.APIKey)
+	require.Equal(t, "10.0.0.1", msg.RemoteAddr)
+	require.Equal(t, SeriesEndpointV1, msg.Topic)
+	require.Equal(t, SeriesEndpointV2, msg.Endpoint)
+	require.Equal(t, "v2", msg.Version)
+	require.Equal(t, "deflate", msg.Header.Get("Content-Encoding"))
+	require.False(t, msg.ReceivedAt.IsZero())
+}
+
+func TestGetAPIVersion(t *testing.T) {
+	require.Equal(t, "v1", getAPIVersion(IntakeEndpointV1))
+	require.Equal(t, "v1", getAPIVersion(SeriesEndpointV1))
+	require.Equal(t, "v2", getAPIVersion(SeriesEndpointV2))
+	require.Equal(t, "beta", getAPIVersion(SketchSeriesEndpointV2))
+	require.Equal(t, "", getAPIVersion("/foo"))
+}
+
+func TestMessageV1Metrics(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/metrics.json")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+
+	msg := &Message{Body: content}
+	first, err := msg.V1Metrics()
+	require.Nil(t, err)
+	require.Len(t, first, 1)
+
+	// the payload is decoded only once, subscribers share the same data
+	second, err := msg.V1Metrics()
+	require.Nil(t, err)
+	require.Equal(t, &first[0], &second[0])
+
+	// decoding errors are cached as well
+	msg = &Message{Body: []byte("not json")}
+	_, err = msg.V1Metrics()
+	require.NotNil(t, err)
+	_, err = msg.V1Metrics()
+	require.NotNil(t, err)
+}
+
+func TestMessageSetV1Metrics(t *testing.T) {
+	metrics := []V1Metric{{Metric: "system.cpu.system"}}
+	msg := &Message{Body: []byte("not json")}
+	msg.setV1Metrics(metrics)
+
+	got, err := msg.V1Metrics()
+	require.Nil(t, err)
+	require.Equal(t, metrics, got)
+}
+
+func TestMessageMetricsProcessor(t *testing.T) {
+	calls := 0
+	SetSettings(&Settings{Processor: func(metrics []V1Metric) []V1Metric {
+		calls++
+		return metrics[:0:0]
+	}})
+	defer SetSettings(nil)
+
+	msg := &Message{Body: []byte(`{"series": [{"metric": "system.cpu.system"}]}`)}
+	for i := 0; i < 2; i++ {
+		got, err := msg.V1Metrics()
+		require.Nil(t, err)
+		require.Empty(t, got)
+	}
+	require.Equal(t, 1, calls)
+
+	msg = &Message{}
+	msg.setV1Metrics([]V1Metric{{Metric: "system.cpu.system"}})
+	got, err := msg.V1Metrics()
+	require.Nil(t, err)
+	require.Empty(t, got)
+	require.Equal(t, 2, calls)
+}
@@ -15,6 +15,7 @@ type V1Metric struct {
 	Type           string
 	Interval       int
 	SourceTypeName string `json:"source_type_name"`
+	Unit           string `json:"unit,omitempty"`
 }
 
 type series struct {
@@ -27,3 +28,17 @@ func DecodeV1Metrics(payload []byte) ([]V1Metric, error) {
 
 	return s.Series, json.Unmarshal(payload, &s)
 }
+
+// MetricsProcessor transforms the metrics decoded from a message before they're
+// delivered to the subscribers. The input is owned by the message and must not
+// be modified, processors return a new slice instead.
+type MetricsProcessor func([]V1Metric) []V1Metric
+
+// processMetrics applies the metrics processor, if any
+func processMetrics(metrics []V1Metric) []V1Metric {
+	process := getSettings().Processor
+	if process == nil {
+		return metrics
+	}
+	return process(metrics)
+}
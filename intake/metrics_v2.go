@@ -0,0 +1,144 @@
+package intake
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/masci/threadle/internal/protowalk"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Metric types as defined in the MetricPayload protobuf message
+var v2MetricTypes = map[uint64]string{
+	0: "",
+	1: "count",
+	2: "rate",
+	3: "gauge",
+}
+
+// DecodeV2Metrics decodes a protobuf encoded MetricPayload and normalizes the
+// series into V1Metric, so that plugins don't need to know which version of
+// the API the Datadog Agent used.
+//
+// The payload is defined in https://github.com/DataDog/agent-payload in the
+// form:
+//
+//	MetricPayload { repeated MetricSeries series = 1; }
+func DecodeV2Metrics(payload []byte) ([]V1Metric, error) {
+	metrics := []V1Metric{}
+	err := protowalk.Range(payload, func(f *protowalk.Field) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		m, err := decodeV2Series(f.Bytes)
+		if err != nil {
+			return err
+		}
+		// a series without points carries nothing the plugins can store
+		if len(m.Points) > 0 {
+			metrics = append(metrics, *m)
+		}
+		return nil
+	})
+	return metrics, err
+}
+
+// decodeV2Series decodes a single MetricSeries message:
+//
+//	MetricSeries {
+//	  repeated Resource resources = 1;
+//	  string metric = 2;
+//	  repeated string tags = 3;
+//	  repeated MetricPoint points = 4;
+//	  MetricType type = 5;
+//	  string unit = 6;
+//	  string source_type_name = 7;
+//	  int64 interval = 8;
+//	}
+func decodeV2Series(b []byte) (*V1Metric, error) {
+	m := V1Metric{
+		Points: []Point{},
+		Tags:   []string{},
+	}
+	err := protowalk.Range(b, func(f *protowalk.Field) error {
+		switch f.Num {
+		case 1:
+			rType, rName, err := decodeV2Resource(f.Bytes)
+			if err != nil {
+				return err
+			}
+			// host and device are first class citizens in V1Metric, any other
+			// resource is turned into a tag
+			switch rType {
+			case "host":
+				m.Host = rName
+			case "device":
+				m.Device = rName
+			default:
+				m.Tags = append(m.Tags, fmt.Sprintf("%s:%s", rType, rName))
+			}
+		case 2:
+			m.Metric = string(f.Bytes)
+		case 3:
+			m.Tags = append(m.Tags, string(f.Bytes))
+		case 4:
+			p, err := decodeV2Point(f.Bytes)
+			if err != nil {
+				return err
+			}
+			m.Points = append(m.Points, p)
+		case 5:
+			t, found := v2MetricTypes[f.Scalar]
+			if !found {
+				return fmt.Errorf("unknown metric type: %d", f.Scalar)
+			}
+			m.Type = t
+		case 6:
+			m.Unit = string(f.Bytes)
+		case 7:
+			m.SourceTypeName = string(f.Bytes)
+		case 8:
+			m.Interval = int(int64(f.Scalar))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error decoding series: %w", err)
+	}
+
+	return &m, nil
+}
+
+// decodeV2Resource decodes a Resource message:
+//
+//	Resource { string type = 1; string name = 2; }
+func decodeV2Resource(b []byte) (rType, rName string, err error) {
+	err = protowalk.Range(b, func(f *protowalk.Field) error {
+		switch f.Num {
+		case 1:
+			rType = string(f.Bytes)
+		case 2:
+			rName = string(f.Bytes)
+		}
+		return nil
+	})
+	return
+}
+
+// decodeV2Point decodes a MetricPoint message into a V1 Point:
+//
+//	MetricPoint { double value = 1; int64 timestamp = 2; }
+func decodeV2Point(b []byte) (Point, error) {
+	var value float64
+	var timestamp int64
+	err := protowalk.Range(b, func(f *protowalk.Field) error {
+		switch f.Num {
+		case 1:
+			value = math.Float64frombits(f.Scalar)
+		case 2:
+			timestamp = int64(f.Scalar)
+		}
+		return nil
+	})
+	return Point{float64(timestamp), value}, err
+}
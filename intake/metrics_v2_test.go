@@ -0,0 +1,71 @@
+package intake
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecodeV2Metrics(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/series_v2.pb")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+
+	expected := []V1Metric{
+		{
+			Metric: "system.cpu.system",
+			Points: []Point{
+				{1612906502, 3.0419201600117516},
+			},
+			Tags:           []string{},
+			Host:           "MacLastic2.local",
+			Type:           "gauge",
+			SourceTypeName: "System",
+			Unit:           "percent",
+		},
+		{
+			Metric: "datadog.dogstatsd.client.metrics",
+			Points: []Point{
+				{1612906490, 10},
+				{1612906500, 12.5},
+			},
+			Tags:     []string{"database_instance:db1", "client:go", "version:7.42.0"},
+			Host:     "MacLastic2.local",
+			Device:   "/dev/disk1s1",
+			Type:     "rate",
+			Interval: 10,
+		},
+	}
+
+	got, err := DecodeV2Metrics(content)
+	require.Nil(t, err)
+	require.Equal(t, expected, got)
+}
+
+func TestDecodeV2MetricsEmpty(t *testing.T) {
+	got, err := DecodeV2Metrics([]byte{})
+	require.Nil(t, err)
+	require.Equal(t, []V1Metric{}, got)
+}
+
+func TestDecodeV2MetricsNoPoints(t *testing.T) {
+	// MetricPayload { MetricSeries series = 1 { metric = "system.load.1" } }
+	var series []byte
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendString(series, "system.load.1")
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, series)
+
+	got, err := DecodeV2Metrics(payload)
+	require.Nil(t, err)
+	require.Equal(t, []V1Metric{}, got)
+}
+
+func TestDecodeV2MetricsInvalid(t *testing.T) {
+	_, err := DecodeV2Metrics([]byte{0x0a, 0xff})
+	require.NotNil(t, err)
+}
@@ -1,59 +1,406 @@
 package intake
 
-import "sync"
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
 
-// PubSub is a ridicoulously simple message broker
+// OverflowPolicy defines what happens to a message when a subscriber
+// has no room left in its buffer
+type OverflowPolicy string
+
+// Overflow policies
+const (
+	// OverflowBlock waits for the subscriber to make room, slowing down the publisher
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest discards the message being published
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest message in the buffer
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowSpill writes the message to disk, it will be delivered once
+	// the subscriber catches up
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// ParseOverflowPolicy returns the OverflowPolicy with the given name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(name); p {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowSpill:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy: %s", name)
+}
+
+// SubscriptionOptions configures how messages are delivered to a subscriber
+type SubscriptionOptions struct {
+	// BufferSize is the number of messages that can be queued before
+	// the overflow policy kicks in
+	BufferSize int
+	// Overflow is the policy applied when the buffer is full
+	Overflow OverflowPolicy
+	// SpillDir is where messages are written with the OverflowSpill policy,
+	// the system temp dir is used when empty
+	SpillDir string
+}
+
+// DefaultSubscriptionOptions are used by Subscribe. A slow subscriber loses
+// its oldest messages rather than slowing down the publisher, blocking must
+// be asked for explicitly.
+var DefaultSubscriptionOptions = SubscriptionOptions{
+	BufferSize: 100,
+	Overflow:   OverflowDropOldest,
+}
+
+// SubscriptionStats reports the state of a subscription
+type SubscriptionStats struct {
+	Topic      string         `json:"topic"`
+	Overflow   OverflowPolicy `json:"overflow"`
+	BufferSize int            `json:"buffer_size"`
+	Buffered   int            `json:"buffered"`
+	Spilled    int            `json:"spilled"`
+	Dropped    uint64         `json:"dropped"`
+}
+
+// subscription delivers the messages published on a topic to a subscriber,
+// according to its options
+type subscription struct {
+	topic string
+	opts  SubscriptionOptions
+	ch    chan *Message
+	spill *spillQueue
+
+	// mu serializes deliveries and the closing of the subscription
+	mu        sync.Mutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+
+	dropped uint64
+}
+
+func newSubscription(topic string, opts SubscriptionOptions) *subscription {
+	if opts.BufferSize < 1 {
+		opts.BufferSize = 1
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = DefaultSubscriptionOptions.Overflow
+	}
+
+	s := &subscription{
+		topic: topic,
+		opts:  opts,
+		ch:    make(chan *Message, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+	if opts.Overflow == OverflowSpill {
+		s.spill = newSpillQueue(opts.SpillDir, &s.dropped)
+		go s.pump()
+	}
+
+	return s
+}
+
+// deliver sends a message to the subscriber, applying the overflow policy
+// when the buffer is full
+func (s *subscription) deliver(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.opts.Overflow {
+	case OverflowDropNewest:
+		select {
+		case s.ch <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				return
+			default:
+			}
+			// make room, the subscriber might have read in the meantime
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case OverflowSpill:
+		// go straight to the buffer only when nothing is waiting on disk,
+		// to preserve the order of the messages
+		if s.spill.empty() {
+			select {
+			case s.ch <- msg:
+				return
+			default:
+			}
+		}
+		if err := s.spill.push(msg); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	default:
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+		}
+	}
+}
+
+// pump moves the spilled messages to the subscriber buffer, when the
+// subscription is closed it delivers what's left before closing the channel
+func (s *subscription) pump() {
+	for {
+		if msg, ok := s.spill.pop(); ok {
+			s.ch <- msg
+			s.spill.delivered()
+			continue
+		}
+
+		select {
+		case <-s.spill.notify:
+		case <-s.spill.closing:
+			if s.spill.empty() {
+				s.spill.remove()
+				close(s.ch)
+				return
+			}
+		}
+	}
+}
+
+// close stops the deliveries and closes the channel, messages already
+// buffered can still be read by the subscriber
+func (s *subscription) close() {
+	s.closeOnce.Do(func() {
+		// unblock any pending delivery first
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		if s.spill != nil {
+			// the pump closes the channel once the spilled messages are delivered
+			close(s.spill.closing)
+		} else {
+			close(s.ch)
+		}
+	})
+}
+
+func (s *subscription) stats() SubscriptionStats {
+	st := SubscriptionStats{
+		Topic:      s.topic,
+		Overflow:   s.opts.Overflow,
+		BufferSize: s.opts.BufferSize,
+		Buffered:   len(s.ch),
+		Dropped:    atomic.LoadUint64(&s.dropped),
+	}
+	if s.spill != nil {
+		st.Spilled = s.spill.len()
+	}
+	return st
+}
+
+// PubSub is a ridicoulously simple message broker.
+//
+// Clients can subscribe to a topic or to a pattern, where a `*` segment
+// matches exactly one level of the topic path and a `**` segment matches
+// any number of levels: for example `/api/v1/*` matches `/api/v1/series`
+// while `/api/**` matches any topic starting with `/api/`.
 type PubSub struct {
 	sync.RWMutex
 
-	subscribers map[string][]chan []byte
+	// exact topics and patterns are kept separate so that publishing
+	// doesn't have to match every topic
+	subscribers map[string][]*subscription
+	patterns    map[string][]*subscription
 	closed      bool
 }
 
 // NewPubsub creates an instance of the broker
 func NewPubsub() *PubSub {
 	ps := &PubSub{}
-	ps.subscribers = make(map[string][]chan []byte)
+	ps.subscribers = make(map[string][]*subscription)
+	ps.patterns = make(map[string][]*subscription)
 	return ps
 }
 
-// Subscribe lets clients subscribe to a topic
-func (ps *PubSub) Subscribe(topic string) <-chan []byte {
+// isPattern returns true when topic contains wildcards
+func isPattern(topic string) bool {
+	return strings.Contains(topic, "*")
+}
+
+// matchTopic returns true when the topic matches the pattern
+func matchTopic(pattern, topic string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(topic, "/"))
+}
+
+func matchSegments(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to match the rest of the pattern at every level
+			for i := 0; i <= len(topic); i++ {
+				if matchSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(topic) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], topic[0]); err != nil || !ok {
+			return false
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
+
+// Subscribe lets clients subscribe to a topic or a pattern using the default options
+func (ps *PubSub) Subscribe(topic string) <-chan *Message {
+	return ps.SubscribeWithOptions(topic, DefaultSubscriptionOptions)
+}
+
+// SubscribeWithOptions lets clients subscribe to a topic or a pattern, configuring
+// the buffer size and what to do when the buffer is full. Subscribers must read
+// from the channel until it's closed.
+func (ps *PubSub) SubscribeWithOptions(topic string, opts SubscriptionOptions) <-chan *Message {
 	ps.Lock()
 	defer ps.Unlock()
 
-	ch := make(chan []byte, 1)
-	ps.subscribers[topic] = append(ps.subscribers[topic], ch)
-	return ch
+	s := newSubscription(topic, opts)
+	if ps.closed {
+		s.close()
+		return s.ch
+	}
+	if isPattern(topic) {
+		ps.patterns[topic] = append(ps.patterns[topic], s)
+	} else {
+		ps.subscribers[topic] = append(ps.subscribers[topic], s)
+	}
+	return s.ch
 }
 
-// Publish sends a message to a topic
-func (ps *PubSub) Publish(topic string, msg []byte) {
-	ps.RLock()
-	defer ps.RUnlock()
+// Unsubscribe removes the subscription owning the channel, which is closed once
+// the messages already buffered are delivered. It returns false if the channel
+// doesn't belong to any subscription.
+func (ps *PubSub) Unsubscribe(ch <-chan *Message) bool {
+	ps.Lock()
+	var found *subscription
+	for _, m := range []map[string][]*subscription{ps.subscribers, ps.patterns} {
+		for topic, subs := range m {
+			for i, s := range subs {
+				if s.ch != ch {
+					continue
+				}
+				found = s
+				// never modify the slice in place, Publish might be using it
+				remaining := make([]*subscription, 0, len(subs)-1)
+				remaining = append(remaining, subs[:i]...)
+				remaining = append(remaining, subs[i+1:]...)
+				if len(remaining) == 0 {
+					delete(m, topic)
+				} else {
+					m[topic] = remaining
+				}
+				break
+			}
+		}
+	}
+	ps.Unlock()
 
+	if found == nil {
+		return false
+	}
+	found.close()
+	return true
+}
+
+// Publish sends a message to a topic. Each subscriber is served according to
+// its overflow policy, so only subscribers with the OverflowBlock policy can
+// slow down the publisher. The message is shared by all the subscribers and
+// is never modified, its Topic is expected to be set by the publisher.
+func (ps *PubSub) Publish(topic string, msg *Message) {
+	ps.RLock()
 	if ps.closed {
+		ps.RUnlock()
 		return
 	}
+	// slices are never modified in place, it's safe to use them
+	// after releasing the lock
+	subs := ps.subscribers[topic]
+	for pattern, patternSubs := range ps.patterns {
+		if matchTopic(pattern, topic) {
+			subs = append(subs[:len(subs):len(subs)], patternSubs...)
+		}
+	}
+	ps.RUnlock()
+
+	for _, s := range subs {
+		s.deliver(msg)
+	}
+}
+
+// Topics returns the topics and the patterns with at least one subscriber,
+// along with the number of subscribers
+func (ps *PubSub) Topics() map[string]int {
+	ps.RLock()
+	defer ps.RUnlock()
 
-	for _, ch := range ps.subscribers[topic] {
-		ch <- msg
+	ret := map[string]int{}
+	for _, m := range []map[string][]*subscription{ps.subscribers, ps.patterns} {
+		for topic, subs := range m {
+			ret[topic] = len(subs)
+		}
 	}
+	return ret
+}
+
+// Stats returns the state of every subscription
+func (ps *PubSub) Stats() []SubscriptionStats {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	ret := []SubscriptionStats{}
+	for _, m := range []map[string][]*subscription{ps.subscribers, ps.patterns} {
+		for _, subs := range m {
+			for _, s := range subs {
+				ret = append(ret, s.stats())
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Topic < ret[j].Topic })
+	return ret
 }
 
 // Close shuts down the broker and cleans up the channels
 func (ps *PubSub) Close() {
 	ps.Lock()
-	defer ps.Unlock()
-
 	if ps.closed {
+		ps.Unlock()
 		return
 	}
-
 	ps.closed = true
-	for _, subs := range ps.subscribers {
-		for _, ch := range subs {
-			close(ch)
+	all := []map[string][]*subscription{ps.subscribers, ps.patterns}
+	ps.Unlock()
+
+	for _, m := range all {
+		for _, subs := range m {
+			for _, s := range subs {
+				s.close()
+			}
 		}
 	}
 }
@@ -0,0 +1,263 @@
+package intake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMessage(i int) *Message {
+	return &Message{Body: []byte(fmt.Sprint(i))}
+}
+
+// drain reads all the messages until the channel is closed
+func drain(ch <-chan *Message) []string {
+	ret := []string{}
+	for msg := range ch {
+		ret = append(ret, string(msg.Body))
+	}
+	return ret
+}
+
+func TestPubSubBlock(t *testing.T) {
+	ps := NewPubsub()
+	ch := ps.Subscribe("foo")
+	other := ps.Subscribe("bar")
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			ps.Publish("foo", newTestMessage(i))
+		}
+		ps.Close()
+	}()
+
+	require.Equal(t, []string{"0", "1", "2"}, drain(ch))
+	require.Equal(t, []string{}, drain(other))
+}
+
+func TestPubSubCloseUnblocksPublisher(t *testing.T) {
+	ps := NewPubsub()
+	ps.Subscribe("foo")
+	ps.Publish("foo", newTestMessage(0))
+
+	done := make(chan struct{})
+	go func() {
+		// the buffer is full, this blocks until the broker is closed
+		ps.Publish("foo", newTestMessage(1))
+		close(done)
+	}()
+
+	ps.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish didn't return after Close")
+	}
+}
+
+func TestPubSubDropNewest(t *testing.T) {
+	ps := NewPubsub()
+	ch := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 2, Overflow: OverflowDropNewest})
+	for i := 0; i < 5; i++ {
+		ps.Publish("foo", newTestMessage(i))
+	}
+
+	stats := ps.Stats()
+	require.Len(t, stats, 1)
+	require.Equal(t, uint64(3), stats[0].Dropped)
+	require.Equal(t, 2, stats[0].Buffered)
+
+	ps.Close()
+	require.Equal(t, []string{"0", "1"}, drain(ch))
+}
+
+func TestPubSubDropOldest(t *testing.T) {
+	ps := NewPubsub()
+	ch := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 2, Overflow: OverflowDropOldest})
+	for i := 0; i < 5; i++ {
+		ps.Publish("foo", newTestMessage(i))
+	}
+	require.Equal(t, uint64(3), ps.Stats()[0].Dropped)
+
+	ps.Close()
+	require.Equal(t, []string{"3", "4"}, drain(ch))
+}
+
+func TestPubSubSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "threadle-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ps := NewPubsub()
+	ch := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 2, Overflow: OverflowSpill, SpillDir: dir})
+
+	// nobody is reading, messages past the buffer size go to disk
+	expected := []string{}
+	for i := 0; i < 10; i++ {
+		ps.Publish("foo", newTestMessage(i))
+		expected = append(expected, fmt.Sprint(i))
+	}
+	stats := ps.Stats()[0]
+	require.Equal(t, uint64(0), stats.Dropped)
+	require.Equal(t, 10, stats.Buffered+stats.Spilled)
+
+	// read half of the messages, then publish some more
+	got := []string{}
+	for i := 0; i < 5; i++ {
+		got = append(got, string((<-ch).Body))
+	}
+	for i := 10; i < 15; i++ {
+		ps.Publish("foo", newTestMessage(i))
+		expected = append(expected, fmt.Sprint(i))
+	}
+
+	// closing the broker delivers the spilled messages
+	ps.Close()
+	got = append(got, drain(ch)...)
+	require.Equal(t, expected, got)
+
+	// the spill file is removed
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 0)
+}
+
+func TestPubSubSpillSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "threadle-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ps := NewPubsub()
+	ch := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 1, Overflow: OverflowSpill, SpillDir: dir})
+	for i := 0; i < 2; i++ {
+		msg := newTestMessage(i)
+		msg.Tenant = "prod"
+		msg.APIKey = "secret-key"
+		msg.Header = http.Header{"Dd-Api-Key": []string{"secret-key"}}
+		ps.Publish("foo", msg)
+	}
+
+	// the API key is never written to disk
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "prod")
+	require.NotContains(t, string(data), "secret-key")
+
+	ps.Close()
+	msgs := []*Message{}
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	require.Len(t, msgs, 2)
+	require.Equal(t, "1", string(msgs[1].Body))
+	require.Equal(t, "prod", msgs[1].Tenant)
+	require.Empty(t, msgs[1].APIKey)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("drop_oldest")
+	require.Nil(t, err)
+	require.Equal(t, OverflowDropOldest, p)
+
+	_, err = ParseOverflowPolicy("whatever")
+	require.NotNil(t, err)
+}
+
+func TestMatchTopic(t *testing.T) {
+	testcases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"/api/v1/*", SeriesEndpointV1, true},
+		{"/api/v1/*", SeriesEndpointV2, false},
+		{"/api/v1/*", "/api/v1/foo/bar", false},
+		{"/api/v1/s*", SeriesEndpointV1, true},
+		{"/api/v1/s*", CheckRunsEndpointV1, false},
+		{"/api/*/series", SeriesEndpointV2, true},
+		{"/api/**", SeriesEndpointV1, true},
+		{"/api/**", SketchSeriesEndpointV2, true},
+		{"/api/**", IntakeEndpointV1, false},
+		{"/**", IntakeEndpointV1, true},
+		{"/**/series", SeriesEndpointV2, true},
+		{"/**/series", EventsEndpointV2, false},
+		{"/api/v1/series", SeriesEndpointV1, true},
+	}
+
+	for _, tc := range testcases {
+		require.Equal(t, tc.match, matchTopic(tc.pattern, tc.topic), "%s %s", tc.pattern, tc.topic)
+	}
+}
+
+func TestPubSubPatterns(t *testing.T) {
+	ps := NewPubsub()
+	v1 := ps.Subscribe("/api/v1/*")
+	all := ps.Subscribe("/**")
+	series := ps.Subscribe(SeriesEndpointV1)
+
+	go func() {
+		for i, topic := range []string{SeriesEndpointV1, IntakeEndpointV1, CheckRunsEndpointV1} {
+			msg := newTestMessage(i)
+			msg.Topic = topic
+			ps.Publish(topic, msg)
+		}
+		ps.Close()
+	}()
+
+	// subscribers must be read concurrently, the publisher blocks otherwise
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	got := map[string][]string{}
+	topics := map[string][]string{}
+	for name, ch := range map[string]<-chan *Message{"v1": v1, "all": all, "series": series} {
+		wg.Add(1)
+		go func(name string, ch <-chan *Message) {
+			defer wg.Done()
+			for msg := range ch {
+				mu.Lock()
+				got[name] = append(got[name], string(msg.Body))
+				topics[name] = append(topics[name], msg.Topic)
+				mu.Unlock()
+			}
+		}(name, ch)
+	}
+	wg.Wait()
+
+	require.Equal(t, []string{"0", "2"}, got["v1"])
+	require.Equal(t, []string{SeriesEndpointV1, CheckRunsEndpointV1}, topics["v1"])
+	require.Equal(t, []string{"0", "1", "2"}, got["all"])
+	require.Equal(t, []string{"0"}, got["series"])
+}
+
+func TestPubSubUnsubscribe(t *testing.T) {
+	ps := NewPubsub()
+	ch := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 10})
+	other := ps.SubscribeWithOptions("foo", SubscriptionOptions{BufferSize: 10})
+	pattern := ps.Subscribe("/api/**")
+	require.Equal(t, map[string]int{"foo": 2, "/api/**": 1}, ps.Topics())
+
+	ps.Publish("foo", newTestMessage(0))
+	require.True(t, ps.Unsubscribe(ch))
+	ps.Publish("foo", newTestMessage(1))
+
+	// messages buffered before unsubscribing are still delivered
+	require.Equal(t, []string{"0"}, drain(ch))
+	require.Equal(t, map[string]int{"foo": 1, "/api/**": 1}, ps.Topics())
+
+	require.False(t, ps.Unsubscribe(ch))
+	require.True(t, ps.Unsubscribe(pattern))
+	require.Equal(t, map[string]int{"foo": 1}, ps.Topics())
+
+	ps.Close()
+	require.Equal(t, []string{"0", "1"}, drain(other))
+}
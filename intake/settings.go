@@ -0,0 +1,76 @@
+package intake
+
+import (
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// Settings are the parts of the config used while serving requests. They're
+// derived from the config once it's validated and replaced as a whole when
+// the config is reloaded, so that handlers never read the config itself.
+type Settings struct {
+	// APIKeys maps the accepted API keys to the tenant owning them, nil
+	// when any API key should be accepted
+	APIKeys map[string]string
+	// MaxBodySize is the maximum size in bytes of a decompressed request body
+	MaxBodySize int64
+	// Percentiles are computed out of every sketch
+	Percentiles []float64
+	// Processor is applied once to the metrics of every message, before
+	// they're seen by any plugin. Nil disables it.
+	Processor MetricsProcessor
+}
+
+// settings holds the current *Settings
+var settings atomic.Value
+
+// LoadSettings reads the settings from cfg, returning an error when any of
+// them is invalid. The metrics processor is left to the caller.
+func LoadSettings(cfg *viper.Viper) (*Settings, error) {
+	keys, err := parseAPIKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	percentiles, err := parsePercentiles(cfg.GetStringSlice("sketches.percentiles"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := cfg.GetInt64("max_body_size")
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+
+	return &Settings{
+		APIKeys:     keys,
+		MaxBodySize: maxSize,
+		Percentiles: percentiles,
+	}, nil
+}
+
+// SetSettings replaces the settings used to serve requests, nil restores
+// the defaults
+func SetSettings(s *Settings) {
+	if s == nil {
+		s = defaultSettings()
+	}
+	settings.Store(s)
+}
+
+// getSettings returns the current settings, they must not be modified
+func getSettings() *Settings {
+	if s, ok := settings.Load().(*Settings); ok {
+		return s
+	}
+	return defaultSettings()
+}
+
+func defaultSettings() *Settings {
+	percentiles, _ := parsePercentiles(DefaultPercentiles)
+	return &Settings{
+		MaxBodySize: DefaultMaxBodySize,
+		Percentiles: percentiles,
+	}
+}
@@ -0,0 +1,47 @@
+package intake
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSettings(t *testing.T) {
+	s, err := LoadSettings(viper.New())
+	require.Nil(t, err)
+	require.Nil(t, s.APIKeys)
+	require.Equal(t, int64(DefaultMaxBodySize), s.MaxBodySize)
+	require.Empty(t, s.Percentiles)
+
+	cfg := viper.New()
+	cfg.Set("api_keys", []map[string]string{{"key": "abc", "tenant": "prod"}})
+	cfg.Set("max_body_size", 1024)
+	cfg.Set("sketches.percentiles", []string{"50", "p99.9"})
+	s, err = LoadSettings(cfg)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"abc": "prod"}, s.APIKeys)
+	require.Equal(t, int64(1024), s.MaxBodySize)
+	require.Equal(t, []float64{50, 99.9}, s.Percentiles)
+}
+
+func TestLoadSettingsInvalid(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("api_keys", []map[string]string{{"tenant": "prod"}})
+	_, err := LoadSettings(cfg)
+	require.EqualError(t, err, "invalid api_keys: empty key for tenant 'prod'")
+
+	cfg = viper.New()
+	cfg.Set("sketches.percentiles", []string{"50", "p101"})
+	_, err = LoadSettings(cfg)
+	require.EqualError(t, err, `invalid sketches.percentiles: "p101" is not a percentile`)
+}
+
+func TestDefaultSettings(t *testing.T) {
+	SetSettings(&Settings{MaxBodySize: 1})
+	require.Equal(t, int64(1), getSettings().MaxBodySize)
+
+	SetSettings(nil)
+	require.Equal(t, int64(DefaultMaxBodySize), getSettings().MaxBodySize)
+	require.Equal(t, []float64{50, 95, 99}, getSettings().Percentiles)
+}
@@ -0,0 +1,278 @@
+package intake
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/masci/threadle/internal/protowalk"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DDSketch parameters used by the Datadog Agent, see pkg/quantile in the
+// datadog-agent repository. Values are mapped to the bin with key
+// round(log_gamma(v)) + bias, where bias ensures the smallest value tracked
+// gets key 1 so that key 0 can be reserved to values close to zero.
+var (
+	sketchGamma   = 1 + 2.0/128
+	sketchGammaLn = math.Log1p(2.0 / 128)
+	sketchBias    = -int(math.Floor(math.Log(1e-9)/sketchGammaLn)) + 1
+)
+
+// DefaultPercentiles are computed out of every sketch when not configured
+var DefaultPercentiles = []string{"50", "95", "99"}
+
+// Sketch represents a distribution metric as aggregated by the Datadog Agent
+type Sketch struct {
+	Metric string
+	Host   string
+	Tags   []string
+	Points []SketchPoint
+}
+
+// SketchPoint represents the summary of a distribution over a flush interval,
+// Keys and Counts hold the DDSketch bins
+type SketchPoint struct {
+	Timestamp int64
+	Count     int64
+	Min       float64
+	Max       float64
+	Avg       float64
+	Sum       float64
+	Keys      []int32
+	Counts    []uint32
+}
+
+// DecodeSketches decodes a protobuf encoded SketchPayload as defined in
+// https://github.com/DataDog/agent-payload in the form:
+//
+//	SketchPayload { repeated Sketch sketches = 1; }
+func DecodeSketches(payload []byte) ([]Sketch, error) {
+	sketches := []Sketch{}
+	err := protowalk.Range(payload, func(f *protowalk.Field) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		s, err := decodeSketch(f.Bytes)
+		if err != nil {
+			return err
+		}
+		// a sketch without dogsketches has no values to derive metrics from
+		if len(s.Points) > 0 {
+			sketches = append(sketches, *s)
+		}
+		return nil
+	})
+	return sketches, err
+}
+
+// decodeSketch decodes a single Sketch message, legacy distributions are
+// ignored as the Agent only sends dogsketches:
+//
+//	Sketch {
+//	  string metric = 1;
+//	  string host = 2;
+//	  repeated string tags = 4;
+//	  repeated Dogsketch dogsketches = 7;
+//	}
+func decodeSketch(b []byte) (*Sketch, error) {
+	s := Sketch{
+		Tags:   []string{},
+		Points: []SketchPoint{},
+	}
+	err := protowalk.Range(b, func(f *protowalk.Field) error {
+		switch f.Num {
+		case 1:
+			s.Metric = string(f.Bytes)
+		case 2:
+			s.Host = string(f.Bytes)
+		case 4:
+			s.Tags = append(s.Tags, string(f.Bytes))
+		case 7:
+			p, err := decodeDogsketch(f.Bytes)
+			if err != nil {
+				return err
+			}
+			s.Points = append(s.Points, *p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error decoding sketch: %w", err)
+	}
+
+	return &s, nil
+}
+
+// decodeDogsketch decodes a Dogsketch message:
+//
+//	Dogsketch {
+//	  int64 ts = 1;
+//	  int64 cnt = 2;
+//	  double min = 3;
+//	  double max = 4;
+//	  double avg = 5;
+//	  double sum = 6;
+//	  repeated sint32 k = 7;
+//	  repeated uint32 n = 8;
+//	}
+func decodeDogsketch(b []byte) (*SketchPoint, error) {
+	p := SketchPoint{}
+	err := protowalk.Range(b, func(f *protowalk.Field) error {
+		switch f.Num {
+		case 1:
+			p.Timestamp = int64(f.Scalar)
+		case 2:
+			p.Count = int64(f.Scalar)
+		case 3:
+			p.Min = math.Float64frombits(f.Scalar)
+		case 4:
+			p.Max = math.Float64frombits(f.Scalar)
+		case 5:
+			p.Avg = math.Float64frombits(f.Scalar)
+		case 6:
+			p.Sum = math.Float64frombits(f.Scalar)
+		case 7:
+			values, err := f.Varints()
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				p.Keys = append(p.Keys, int32(protowire.DecodeZigZag(v)))
+			}
+		case 8:
+			values, err := f.Varints()
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				p.Counts = append(p.Counts, uint32(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Keys) != len(p.Counts) {
+		return nil, fmt.Errorf("sketch has %d keys but %d counts", len(p.Keys), len(p.Counts))
+	}
+
+	return &p, nil
+}
+
+// sketchBinBounds returns the range of values stored in the bin with key k
+func sketchBinBounds(k int32) (low, high float64) {
+	switch {
+	case k == 0:
+		return 0, 0
+	case k < 0:
+		low, high = sketchBinBounds(-k)
+		return -high, -low
+	}
+	e := float64(int(k) - sketchBias)
+	return math.Pow(sketchGamma, e-0.5), math.Pow(sketchGamma, e+0.5)
+}
+
+// Quantile returns an estimate of the value at quantile q, with 0 <= q <= 1
+func (p *SketchPoint) Quantile(q float64) float64 {
+	if p.Count == 0 {
+		return 0
+	}
+	if len(p.Keys) == 0 {
+		return p.Avg
+	}
+	if q <= 0 {
+		return p.Min
+	}
+	if q >= 1 {
+		return p.Max
+	}
+
+	// sort the bins by key, the Agent already does it but it costs nothing
+	// to be sure
+	idx := make([]int, len(p.Keys))
+	var total float64
+	for i := range idx {
+		idx[i] = i
+		total += float64(p.Counts[i])
+	}
+	sort.Slice(idx, func(i, j int) bool { return p.Keys[idx[i]] < p.Keys[idx[j]] })
+
+	// the rank of the value we're looking for
+	rank := math.RoundToEven(q * (total - 1))
+	var n float64
+	for _, i := range idx {
+		count := float64(p.Counts[i])
+		n += count
+		if n <= rank {
+			continue
+		}
+		// interpolate within the bin
+		low, high := sketchBinBounds(p.Keys[i])
+		weight := (n - rank) / count
+		v := low*weight + high*(1-weight)
+		return math.Max(p.Min, math.Min(p.Max, v))
+	}
+
+	return p.Max
+}
+
+// ToV1Metrics derives count, sum, min, max, avg and the requested percentiles
+// from a sketch, returning one V1Metric for each of them. Percentiles are
+// expressed in the 0-100 range. Nothing is returned for a sketch without
+// points.
+func (s *Sketch) ToV1Metrics(percentiles []float64) []V1Metric {
+	metrics := []V1Metric{}
+	if len(s.Points) == 0 {
+		return metrics
+	}
+	add := func(suffix, metricType string, get func(p *SketchPoint) float64) {
+		m := V1Metric{
+			Metric: s.Metric + "." + suffix,
+			Points: []Point{},
+			Tags:   s.Tags,
+			Host:   s.Host,
+			Type:   metricType,
+		}
+		for i := range s.Points {
+			m.Points = append(m.Points, Point{float64(s.Points[i].Timestamp), get(&s.Points[i])})
+		}
+		metrics = append(metrics, m)
+	}
+
+	add("count", "count", func(p *SketchPoint) float64 { return float64(p.Count) })
+	add("sum", "count", func(p *SketchPoint) float64 { return p.Sum })
+	add("min", "gauge", func(p *SketchPoint) float64 { return p.Min })
+	add("max", "gauge", func(p *SketchPoint) float64 { return p.Max })
+	add("avg", "gauge", func(p *SketchPoint) float64 { return p.Avg })
+	for _, pct := range percentiles {
+		q := pct / 100
+		add(percentileSuffix(pct), "gauge", func(p *SketchPoint) float64 { return p.Quantile(q) })
+	}
+
+	return metrics
+}
+
+// percentileSuffix builds the name suffix for a percentile, dots are replaced
+// so that for example p99.9 doesn't clash with p99 in storages supporting
+// nested fields
+func percentileSuffix(pct float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", -1)
+}
+
+// parsePercentiles parses the percentiles to compute out of sketches,
+// accepting both the `95` and the `p95` forms
+func parsePercentiles(values []string) ([]float64, error) {
+	percentiles := []float64{}
+	for _, s := range values {
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(s, "p"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid sketches.percentiles: %q is not a percentile", s)
+		}
+		percentiles = append(percentiles, pct)
+	}
+	return percentiles, nil
+}
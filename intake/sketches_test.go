@@ -0,0 +1,121 @@
+package intake
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testdata/sketches.pb was not captured from a Datadog Agent but encoded by
+// hand, holding the values from 1 to 100. The bins are checked against keys
+// worked out from the parameters of the Agent's DDSketch (relative accuracy
+// 1/128, min value 1e-9) rather than from sketchBinBounds, so that decoding
+// is not tested against the same mapping used to produce the payload. It
+// should be replaced by a payload captured from a real Agent.
+func TestDecodeSketches(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/sketches.pb")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+
+	got, err := DecodeSketches(content)
+	require.Nil(t, err)
+	require.Len(t, got, 1)
+
+	s := got[0]
+	require.Equal(t, "request.latency", s.Metric)
+	require.Equal(t, "MacLastic2.local", s.Host)
+	require.Equal(t, []string{"env:prod"}, s.Tags)
+	require.Len(t, s.Points, 1)
+
+	p := s.Points[0]
+	require.Equal(t, int64(1612906500), p.Timestamp)
+	require.Equal(t, int64(100), p.Count)
+	require.Equal(t, 1.0, p.Min)
+	require.Equal(t, 100.0, p.Max)
+	require.Equal(t, 50.5, p.Avg)
+	require.Equal(t, 5050.0, p.Sum)
+	require.Len(t, p.Keys, 93)
+	require.Len(t, p.Counts, 93)
+	// 1 maps to the bias of the Agent's mapping, ln(1e-9)/ln(1+2/128) rounded
+	// down and negated plus one, 2 and 100 to bias + round(log_gamma(v))
+	require.Equal(t, []int32{1338, 1383, 1409}, p.Keys[:3])
+	require.Equal(t, int32(1635), p.Keys[92])
+	var total uint32
+	for _, c := range p.Counts {
+		total += c
+	}
+	require.Equal(t, uint32(100), total)
+}
+
+func TestDecodeSketchesEmpty(t *testing.T) {
+	// SketchPayload { Sketch sketches = 1 { metric = "request.latency" } }
+	var sketch []byte
+	sketch = protowire.AppendTag(sketch, 1, protowire.BytesType)
+	sketch = protowire.AppendString(sketch, "request.latency")
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, sketch)
+
+	got, err := DecodeSketches(payload)
+	require.Nil(t, err)
+	require.Empty(t, got)
+
+	s := Sketch{Metric: "request.latency", Points: []SketchPoint{}}
+	require.Empty(t, s.ToV1Metrics([]float64{50}))
+}
+
+func TestSketchQuantile(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/sketches.pb")
+	if err != nil {
+		t.Fatalf("Error loading golden file: %s", err)
+	}
+	sketches, err := DecodeSketches(content)
+	require.Nil(t, err)
+	p := sketches[0].Points[0]
+
+	// the sketch holds the values from 1 to 100, estimates must be within
+	// the relative accuracy of the sketch
+	require.Equal(t, 1.0, p.Quantile(0))
+	require.InEpsilon(t, 50.0, p.Quantile(0.5), 0.02)
+	require.InEpsilon(t, 95.0, p.Quantile(0.95), 0.02)
+	require.InEpsilon(t, 99.0, p.Quantile(0.99), 0.02)
+	require.Equal(t, 100.0, p.Quantile(1))
+
+	empty := SketchPoint{}
+	require.Equal(t, 0.0, empty.Quantile(0.5))
+}
+
+func TestSketchToV1Metrics(t *testing.T) {
+	s := Sketch{
+		Metric: "request.latency",
+		Host:   "MacLastic2.local",
+		Tags:   []string{"env:prod"},
+		Points: []SketchPoint{
+			{Timestamp: 1612906500, Count: 1, Min: 3, Max: 3, Avg: 3, Sum: 3},
+		},
+	}
+
+	metrics := s.ToV1Metrics([]float64{50, 99.9})
+	names := []string{}
+	for _, m := range metrics {
+		names = append(names, m.Metric)
+		require.Equal(t, "MacLastic2.local", m.Host)
+		require.Equal(t, []string{"env:prod"}, m.Tags)
+		require.Len(t, m.Points, 1)
+	}
+	require.Equal(t, []string{
+		"request.latency.count",
+		"request.latency.sum",
+		"request.latency.min",
+		"request.latency.max",
+		"request.latency.avg",
+		"request.latency.p50",
+		"request.latency.p99_9",
+	}, names)
+	require.Equal(t, "count", metrics[0].Type)
+	require.Equal(t, Point{1612906500, 1}, metrics[0].Points[0])
+	require.Equal(t, "gauge", metrics[4].Type)
+}
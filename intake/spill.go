@@ -0,0 +1,197 @@
+package intake
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/masci/threadle/output"
+)
+
+// spillQueue is a FIFO queue of messages stored on disk, used by subscriptions
+// with the OverflowSpill policy. Messages are appended to a file as JSON lines,
+// the file is truncated every time the queue is emptied.
+type spillQueue struct {
+	dir     string
+	dropped *uint64
+
+	mu      sync.Mutex
+	file    *os.File
+	reader  *bufio.Reader
+	rfile   *os.File
+	pending int
+	// inflight is true while a message popped from the queue is being
+	// delivered to the subscriber
+	inflight bool
+
+	// notify is signaled when a message is pushed
+	notify chan struct{}
+	// closing is closed when the subscription is closed
+	closing chan struct{}
+}
+
+func newSpillQueue(dir string, dropped *uint64) *spillQueue {
+	return &spillQueue{
+		dir:     dir,
+		dropped: dropped,
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+}
+
+// open creates the file backing the queue, the caller must hold the lock
+func (q *spillQueue) open() (err error) {
+	if q.file, err = ioutil.TempFile(q.dir, "threadle-spill-"); err != nil {
+		return
+	}
+	if q.rfile, err = os.Open(q.file.Name()); err != nil {
+		q.file.Close()
+		os.Remove(q.file.Name())
+		q.file = nil
+		return
+	}
+	q.reader = bufio.NewReader(q.rfile)
+	output.DEBUG.Println("Spilling messages to", q.file.Name())
+	return
+}
+
+// spilledMessage holds the fields of a Message written to disk, the API key
+// and the request headers are left out so that no secret ends up on disk
+type spilledMessage struct {
+	Body       []byte
+	Tenant     string
+	RemoteAddr string
+	Topic      string
+	Endpoint   string
+	Version    string
+	ReceivedAt time.Time
+}
+
+// push appends a message to the queue
+func (q *spillQueue) push(msg *Message) error {
+	data, err := json.Marshal(spilledMessage{
+		Body:       msg.Body,
+		Tenant:     msg.Tenant,
+		RemoteAddr: msg.RemoteAddr,
+		Topic:      msg.Topic,
+		Endpoint:   msg.Endpoint,
+		Version:    msg.Version,
+		ReceivedAt: msg.ReceivedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		if err := q.open(); err != nil {
+			output.ERROR.Println("Error creating the spill file:", err)
+			return err
+		}
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		output.ERROR.Println("Error writing to the spill file:", err)
+		return err
+	}
+	q.pending++
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop removes the oldest message from the queue, the caller must call
+// delivered once the message was sent to the subscriber
+func (q *spillQueue) pop() (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.pending > 0 {
+		line, err := q.reader.ReadBytes('\n')
+		q.pending--
+		if q.pending == 0 {
+			q.reset()
+		}
+		if err != nil {
+			output.ERROR.Println("Error reading from the spill file:", err)
+			atomic.AddUint64(q.dropped, 1)
+			continue
+		}
+
+		var spilled spilledMessage
+		if err := json.Unmarshal(line, &spilled); err != nil {
+			output.ERROR.Println("Error decoding spilled message:", err)
+			atomic.AddUint64(q.dropped, 1)
+			continue
+		}
+		q.inflight = true
+		return &Message{
+			Body:       spilled.Body,
+			Tenant:     spilled.Tenant,
+			RemoteAddr: spilled.RemoteAddr,
+			Topic:      spilled.Topic,
+			Endpoint:   spilled.Endpoint,
+			Version:    spilled.Version,
+			ReceivedAt: spilled.ReceivedAt,
+		}, true
+	}
+
+	return nil, false
+}
+
+// delivered marks the last message popped as delivered
+func (q *spillQueue) delivered() {
+	q.mu.Lock()
+	q.inflight = false
+	q.mu.Unlock()
+}
+
+// reset truncates the file once all the messages were read, the caller
+// must hold the lock
+func (q *spillQueue) reset() {
+	if err := q.file.Truncate(0); err != nil {
+		output.ERROR.Println("Error truncating the spill file:", err)
+	}
+	q.file.Seek(0, 0)
+	q.rfile.Seek(0, 0)
+	q.reader.Reset(q.rfile)
+}
+
+// empty returns true when there are no messages waiting to be delivered
+func (q *spillQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending == 0 && !q.inflight
+}
+
+// len returns the number of messages waiting to be delivered
+func (q *spillQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight {
+		return q.pending + 1
+	}
+	return q.pending
+}
+
+// remove deletes the file backing the queue
+func (q *spillQueue) remove() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		return
+	}
+	q.rfile.Close()
+	q.file.Close()
+	os.Remove(q.file.Name())
+	q.file = nil
+}
@@ -1,26 +1,69 @@
 package intake
 
 import (
-	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-func inflate(in []byte) ([]byte, error) {
-	r, err := zlib.NewReader(bytes.NewReader(in))
+// DefaultMaxBodySize is the maximum size in bytes of a decompressed request
+// body, used when not configured
+const DefaultMaxBodySize = 64 * 1024 * 1024
+
+// errBodyTooLarge is returned when a request body exceeds the maximum size
+// once decompressed, most likely a zip bomb
+var errBodyTooLarge = errors.New("request body too large")
+
+// newDecoder returns a reader decompressing in according to the value of
+// a Content-Encoding header
+func newDecoder(encoding string, in io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(in), nil
+	case "deflate":
+		// despite the name, HTTP deflate is the zlib format
+		return zlib.NewReader(in)
+	case "gzip", "x-gzip":
+		return gzip.NewReader(in)
+	case "zstd":
+		d, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// decodeBody decompresses the body according to encoding, returning
+// errBodyTooLarge when more than maxSize bytes would be read
+func decodeBody(encoding string, body io.Reader, maxSize int64) ([]byte, error) {
+	r, err := newDecoder(encoding, body)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 
-	return ioutil.ReadAll(r)
-}
-
-func readRequestBody(r *http.Request) (body []byte, err error) {
-	if body, err = ioutil.ReadAll(r.Body); err != nil {
-		return
+	// read one more byte than allowed so we know when the limit is exceeded
+	out, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
 	}
+	if int64(len(out)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+
+	return out, nil
+}
 
-	return inflate(body)
+func readRequestBody(r *http.Request) ([]byte, error) {
+	return decodeBody(r.Header.Get("Content-Encoding"), r.Body, getSettings().MaxBodySize)
 }
@@ -0,0 +1,74 @@
+package intake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch strings.ToLower(encoding) {
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatalf("Error creating zstd writer: %s", err)
+		}
+	default:
+		return data
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Error compressing data: %s", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := []byte(`{"series": []}`)
+
+	for _, encoding := range []string{"", "identity", "deflate", "gzip", "zstd", "GZIP"} {
+		body := compress(t, encoding, payload)
+		got, err := decodeBody(encoding, bytes.NewReader(body), DefaultMaxBodySize)
+		require.Nil(t, err, encoding)
+		require.Equal(t, payload, got, encoding)
+	}
+}
+
+func TestDecodeBodyErrors(t *testing.T) {
+	payload := []byte(`{"series": []}`)
+
+	// unknown encoding
+	_, err := decodeBody("br", bytes.NewReader(payload), DefaultMaxBodySize)
+	require.NotNil(t, err)
+
+	// encoding doesn't match the body
+	_, err = decodeBody("deflate", bytes.NewReader(payload), DefaultMaxBodySize)
+	require.NotNil(t, err)
+}
+
+func TestDecodeBodyTooLarge(t *testing.T) {
+	// 1MB of zeroes compresses to a few bytes
+	payload := make([]byte, 1024*1024)
+
+	for _, encoding := range []string{"identity", "deflate", "gzip", "zstd"} {
+		body := compress(t, encoding, payload)
+		_, err := decodeBody(encoding, bytes.NewReader(body), 1024)
+		require.Equal(t, errBodyTooLarge, err, encoding)
+
+		got, err := decodeBody(encoding, bytes.NewReader(body), int64(len(payload)))
+		require.Nil(t, err, encoding)
+		require.Len(t, got, len(payload))
+	}
+}
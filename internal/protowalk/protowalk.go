@@ -0,0 +1,79 @@
+// Package protowalk reads protobuf encoded messages one field at a time. We
+// only need to read and write a handful of messages, from the Datadog Agent
+// and the backends, so we avoid generating Go code for their definitions.
+package protowalk
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field holds a single field read from a protobuf encoded message.
+// Depending on the wire type, the value is either stored in Bytes (length
+// delimited fields) or in Scalar (varint, fixed32 and fixed64 fields).
+type Field struct {
+	Num    protowire.Number
+	Type   protowire.Type
+	Bytes  []byte
+	Scalar uint64
+}
+
+// Range decodes a protobuf message one field at a time, calling fn for each
+// of them. It stops at the first malformed field or error returned by fn.
+func Range(b []byte, fn func(f *Field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := Field{Num: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.Scalar, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.Scalar = uint64(v)
+		case protowire.Fixed64Type:
+			f.Scalar, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Varints returns the values of a repeated varint field, packed or not
+func (f *Field) Varints() ([]uint64, error) {
+	if f.Type == protowire.VarintType {
+		return []uint64{f.Scalar}, nil
+	}
+	if f.Type != protowire.BytesType {
+		return nil, fmt.Errorf("field %d: unexpected wire type %d", f.Num, f.Type)
+	}
+
+	values := []uint64{}
+	b := f.Bytes
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, fmt.Errorf("field %d: %w", f.Num, protowire.ParseError(n))
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
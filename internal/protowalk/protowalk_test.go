@@ -0,0 +1,54 @@
+package protowalk
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRange(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "system.load.1")
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 3)
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(0.5))
+	b = protowire.AppendTag(b, 4, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+
+	fields := []Field{}
+	err := Range(b, func(f *Field) error {
+		fields = append(fields, *f)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []Field{
+		{Num: 1, Type: protowire.BytesType, Bytes: []byte("system.load.1")},
+		{Num: 2, Type: protowire.VarintType, Scalar: 3},
+		{Num: 3, Type: protowire.Fixed64Type, Scalar: math.Float64bits(0.5)},
+		{Num: 4, Type: protowire.Fixed32Type, Scalar: 7},
+	}, fields)
+
+	// malformed fields are reported
+	require.Error(t, Range([]byte{0x0a, 0xff}, func(f *Field) error { return nil }))
+}
+
+func TestVarints(t *testing.T) {
+	var packed []byte
+	packed = protowire.AppendVarint(packed, 1)
+	packed = protowire.AppendVarint(packed, 300)
+
+	values, err := (&Field{Num: 1, Type: protowire.BytesType, Bytes: packed}).Varints()
+	require.Nil(t, err)
+	require.Equal(t, []uint64{1, 300}, values)
+
+	values, err = (&Field{Num: 1, Type: protowire.VarintType, Scalar: 2}).Varints()
+	require.Nil(t, err)
+	require.Equal(t, []uint64{2}, values)
+
+	_, err = (&Field{Num: 1, Type: protowire.Fixed64Type}).Varints()
+	require.EqualError(t, err, "field 1: unexpected wire type 1")
+}
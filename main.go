@@ -1,28 +1,42 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/masci/threadle/intake"
 	"github.com/masci/threadle/output"
 	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/processors"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
-	// output plugins
-	"github.com/masci/threadle/plugins/elasticsearch"
-	"github.com/masci/threadle/plugins/logger"
+	// output plugins, they register themselves when imported
+	_ "github.com/masci/threadle/plugins/elasticsearch"
+	_ "github.com/masci/threadle/plugins/graphite"
+	_ "github.com/masci/threadle/plugins/influxdb"
+	_ "github.com/masci/threadle/plugins/logger"
+	_ "github.com/masci/threadle/plugins/otlp"
+	_ "github.com/masci/threadle/plugins/prometheus"
+	_ "github.com/masci/threadle/plugins/remotewrite"
 )
 
 func main() {
 	// Define and parse command args
 	verbosity := pflag.IntP("verbose", "v", 1, "set verbosity level: 0 silent, 1 normal, 2 debug")
 	configPath := pflag.StringP("config", "c", "", "path to config file")
+	strict := pflag.Bool("strict", false, "fail on any configuration problem, not only on fatal ones")
 	help := pflag.BoolP("help", "h", false, "print args help")
 	pflag.Parse()
 
 	// Print the help message and exit if --help is passed
 	if *help == true {
+		fmt.Println("Usage: threadle [flags] [command]")
+		printCommands(os.Stdout)
+		fmt.Println("Flags:")
 		pflag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -30,46 +44,147 @@ func main() {
 	// Configure cmdline output facilities
 	output.Init(*verbosity)
 
+	// Run the subcommand and exit, if any
+	if pflag.NArg() > 0 {
+		os.Exit(runCommand(pflag.Args(), *configPath, *strict, os.Stdout))
+	}
+
 	// Bootstrap config, this has to be called first
-	initConfig(configPath)
+	if err := initConfig(*configPath); err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
+	}
 
-	// Define the available output plugins
-	plugins := map[string]plugins.Plugin{
-		"logger":        &logger.Plugin{},
-		"elasticsearch": &elasticsearch.Plugin{},
+	// Load the accepted API keys, the limits and the processors applied to
+	// the metrics before reaching the plugins
+	settings, err := loadSettings(viper.GetViper())
+	if err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
 	}
+	intake.SetSettings(settings)
 
 	// Load the configured output plugins
-	for k := range viper.GetStringMap("plugins") {
-		if p, found := plugins[k]; found {
-			output.INFO.Println("Initializing plugin:", k)
-			p.Start(intake.MsgBroker)
-		}
+	instances, err := plugins.GetInstances(viper.GetViper())
+	if err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
+	}
+	if !checkPlugins(instances, *strict) {
+		output.FATAL.Fatalf("Fatal error: invalid plugins configuration")
+	}
+	if err := checkProcessorNames(viper.GetViper(), instances); err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
 	}
+	manager := plugins.NewManager(intake.MsgBroker)
+	manager.StopTimeout = viper.GetDuration("shutdown_timeout")
+	manager.Apply(instances)
+	if err := manager.Health(); err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
+	}
+	intake.RegisterHealthCheck("plugins", manager.Health)
+
+	// Shutdown gracefully on SIGINT (Ctrl+C) and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload the config on SIGHUP and when the config file changes
+	go watchConfig(ctx, manager, *strict)
 
 	// Start the HTTP server, block until shutdown
-	intake.Serve()
+	deadline, err := intake.Serve(ctx, viper.GetDuration("shutdown_timeout"))
+
+	// Wait for a reload in progress, the later ones are ignored as ctx is
+	// done, then let the plugins process the messages still buffered.
+	// shutdown_timeout bounds the whole shutdown, HTTP server included.
+	reloadMu.Lock()
+	stopCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	manager.Stop(stopCtx)
+	cancel()
+
+	if err != nil {
+		output.FATAL.Fatalf("Fatal error: %s", err)
+	}
 	os.Exit(0)
 }
 
-func initConfig(configPath *string) {
-	// Defaults
-	viper.SetDefault("port", "3060")
+// loadSettings reads the settings used while serving requests from cfg,
+// including the chain of processors applied to the metrics of every message
+// before they're delivered to the plugins
+func loadSettings(cfg *viper.Viper) (*intake.Settings, error) {
+	settings, err := intake.LoadSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := processors.FromConfig(cfg, "processors")
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) > 0 {
+		settings.Processor = chain.Process
+	}
+	return settings, nil
+}
 
-	// Automatically bind all the config options to env vars
-	viper.SetEnvPrefix("threadle")
-	viper.AutomaticEnv()
+// checkPlugins logs the problems found in the plugins configuration and returns
+// false when Threadle shouldn't start, in strict mode any problem is fatal
+func checkPlugins(instances []plugins.Instance, strict bool) bool {
+	ok := true
+	for _, p := range plugins.Validate(instances) {
+		if p.Fatal || strict {
+			output.ERROR.Println(p)
+			ok = false
+		} else {
+			output.WARN.Println(p)
+		}
+	}
+	return ok
+}
+
+// checkProcessorNames returns an error when processors keeping their state
+// by name share the same name, either among the global processors or those
+// of any plugin. Chains that can't be built are reported when used.
+func checkProcessorNames(cfg *viper.Viper, instances []plugins.Instance) error {
+	configs := []*viper.Viper{cfg}
+	for _, inst := range instances {
+		configs = append(configs, inst.Config)
+	}
+
+	chains := []processors.Chain{}
+	for _, v := range configs {
+		if chain, err := processors.FromConfig(v, "processors"); err == nil {
+			chains = append(chains, chain)
+		}
+	}
+	return processors.CheckNames(chains...)
+}
+
+// initConfig reads the config file, looking for it in the current directory
+// and in configPath
+func initConfig(configPath string) error {
+	setupConfig(viper.GetViper())
 
 	// Setup the config lookup
 	viper.SetConfigName("threadle.yaml")
-	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
-	if *configPath != "" {
-		viper.AddConfigPath(*configPath)
+	if configPath != "" {
+		viper.AddConfigPath(configPath)
 	}
-	err := viper.ReadInConfig()
-	if err != nil {
-		output.FATAL.Fatalf("Fatal error: %s", err)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
 	}
 	output.DEBUG.Println("Config file found at", viper.ConfigFileUsed())
+	return nil
+}
+
+// setupConfig sets the defaults and the env vars binding of cfg
+func setupConfig(cfg *viper.Viper) {
+	// Defaults
+	cfg.SetDefault("port", "3060")
+	cfg.SetDefault("shutdown_timeout", "30s")
+	cfg.SetDefault("watch_config", true)
+	cfg.SetDefault("max_body_size", intake.DefaultMaxBodySize)
+	cfg.SetDefault("sketches.percentiles", intake.DefaultPercentiles)
+
+	// Automatically bind all the config options to env vars
+	cfg.SetEnvPrefix("threadle")
+	cfg.AutomaticEnv()
+	cfg.SetConfigType("yaml")
 }
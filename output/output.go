@@ -11,6 +11,7 @@ import (
 var (
 	DEBUG *log.Logger
 	INFO  *log.Logger
+	WARN  *log.Logger
 	ERROR *log.Logger
 	FATAL *log.Logger
 
@@ -32,6 +33,7 @@ func Init(verbosity int) {
 	np = jww.NewNotepad(threshold, threshold, os.Stdout, ioutil.Discard, "", 0)
 	DEBUG = np.DEBUG
 	INFO = np.INFO
+	WARN = np.WARN
 	ERROR = np.ERROR
 	FATAL = np.FATAL
 }
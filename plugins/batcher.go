@@ -0,0 +1,216 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+)
+
+// FlushFunc sends the data buffered by an output plugin, ctx is canceled when
+// the plugin gives up stopping cleanly. It returns false when there was
+// nothing to send, along with the error that prevented the data from being
+// sent.
+type FlushFunc func(ctx context.Context) (bool, error)
+
+// Batcher runs the goroutines of an output plugin buffering the metrics and
+// sending them periodically: it processes the messages of the subscriptions,
+// flushes every interval and once more when stopped, and keeps track of the
+// outcome of the last flush.
+//
+// Every Start creates a new run with its own subscriptions, channels and
+// context. A run that didn't stop in time keeps going until its last flush is
+// over, and the Batcher can't be started again meanwhile, so that two runs
+// never send the same buffered data.
+type Batcher struct {
+	// flushMu serializes the flushes
+	flushMu sync.Mutex
+
+	runMu sync.Mutex
+	run   *batchRun
+
+	// lastErr is the error occurred during the last flush
+	lastErr  error
+	healthMu sync.Mutex
+}
+
+// batchRun holds the state of a single Start
+type batchRun struct {
+	broker *intake.PubSub
+	subs   []<-chan *intake.Message
+	wg     sync.WaitGroup
+	flush  FlushFunc
+
+	// ctx is canceled when the run is stopped, to abort pending requests
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	failures chan error
+	stop     chan struct{}
+	stopOnce sync.Once
+	// exited is closed once the last flush is over
+	exited chan struct{}
+}
+
+// Start begins a new run calling flush every interval, it fails when the
+// previous run is still flushing. Subscriptions are added with Subscribe.
+func (b *Batcher) Start(broker *intake.PubSub, interval time.Duration, flush FlushFunc) error {
+	if prev := b.current(); prev != nil {
+		select {
+		case <-prev.exited:
+		default:
+			return errors.New("the previous run is still flushing")
+		}
+	}
+	if interval <= 0 {
+		return errors.New("invalid configuration: flush_interval must be positive")
+	}
+
+	r := &batchRun{
+		broker:   broker,
+		flush:    flush,
+		failures: make(chan error, 1),
+		stop:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	b.runMu.Lock()
+	b.run = r
+	b.runMu.Unlock()
+
+	go b.flushLoop(r, interval)
+	return nil
+}
+
+// Subscribe processes the messages of a topic in a goroutine of the current
+// run, until the run is stopped. When process returns true the data is
+// flushed right away, holding the next messages meanwhile. It must be called
+// after Start, by the Start method of the plugin.
+func (b *Batcher) Subscribe(topic string, opts intake.SubscriptionOptions, process func(*intake.Message) bool) {
+	r := b.current()
+	ch := r.broker.SubscribeWithOptions(topic, opts)
+	r.subs = append(r.subs, ch)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for msg := range ch {
+			if process(msg) {
+				b.flush(r)
+			}
+		}
+	}()
+}
+
+// Stop unsubscribes from the broker and waits for the last flush. When ctx
+// expires first the pending requests are aborted, the run exits shortly
+// after dropping the data not sent yet.
+func (b *Batcher) Stop(ctx context.Context) error {
+	r := b.current()
+	if r == nil {
+		// never started
+		return nil
+	}
+	for _, ch := range r.subs {
+		r.broker.Unsubscribe(ch)
+	}
+	err := Wait(ctx, &r.wg)
+	r.stopOnce.Do(func() { close(r.stop) })
+
+	select {
+	case <-r.exited:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		r.cancel()
+	}
+	return err
+}
+
+// Health returns the error occurred during the last flush, if any
+func (b *Batcher) Health() error {
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+	return b.lastErr
+}
+
+// Failures returns the errors that prevented data from being sent, it's
+// replaced at every Start
+func (b *Batcher) Failures() <-chan error {
+	if r := b.current(); r != nil {
+		return r.failures
+	}
+	return nil
+}
+
+// current returns the state of the last run, nil if never started
+func (b *Batcher) current() *batchRun {
+	b.runMu.Lock()
+	defer b.runMu.Unlock()
+	return b.run
+}
+
+// flushLoop flushes every interval until r is stopped, then flushes once the
+// messages already received are processed
+func (b *Batcher) flushLoop(r *batchRun, interval time.Duration) {
+	defer close(r.exited)
+	defer r.cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush(r)
+		case <-r.stop:
+			r.wg.Wait()
+			b.flush(r)
+			return
+		}
+	}
+}
+
+// flush calls the flush function of r, recording its outcome
+func (b *Batcher) flush(r *batchRun) {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	flushed, err := r.flush(r.ctx)
+	if !flushed {
+		return
+	}
+	b.healthMu.Lock()
+	b.lastErr = err
+	b.healthMu.Unlock()
+
+	if err != nil {
+		// one pending failure is enough to trigger a restart
+		select {
+		case r.failures <- err:
+		default:
+		}
+	}
+}
+
+// Retry calls send until it succeeds or returns false, at most retries more
+// times, waiting backoff before the first retry and doubling it at each one.
+// It returns the last error, as soon as ctx is done.
+func Retry(ctx context.Context, retries int, backoff time.Duration, send func() (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := send()
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+		output.WARN.Printf("Error sending data, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
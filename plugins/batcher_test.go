@@ -0,0 +1,150 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatcher(t *testing.T) {
+	output.Init(0)
+	broker := intake.NewPubsub()
+
+	var mu sync.Mutex
+	pending, flushed := []string{}, [][]string{}
+	flush := func(ctx context.Context) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(pending) == 0 {
+			return false, nil
+		}
+		flushed = append(flushed, pending)
+		pending = []string{}
+		return true, nil
+	}
+
+	b := &Batcher{}
+	require.Nil(t, b.Start(broker, time.Hour, flush))
+	b.Subscribe("foo", intake.DefaultSubscriptionOptions, func(msg *intake.Message) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		pending = append(pending, string(msg.Body))
+		// flush every two messages
+		return len(pending) == 2
+	})
+	for _, body := range []string{"a", "b", "c"} {
+		broker.Publish("foo", &intake.Message{Body: []byte(body)})
+	}
+
+	// the last message is flushed when stopping
+	require.Nil(t, b.Stop(context.Background()))
+	require.Equal(t, [][]string{{"a", "b"}, {"c"}}, flushed)
+	require.Nil(t, b.Health())
+	require.Empty(t, broker.Topics())
+}
+
+func TestBatcherFailure(t *testing.T) {
+	output.Init(0)
+	b := &Batcher{}
+	require.Nil(t, b.Failures())
+	require.Nil(t, b.Stop(context.Background()))
+
+	fail := true
+	require.Nil(t, b.Start(intake.NewPubsub(), time.Hour, func(ctx context.Context) (bool, error) {
+		if fail {
+			return true, errors.New("boom")
+		}
+		return false, nil
+	}))
+	require.Nil(t, b.Stop(context.Background()))
+	require.EqualError(t, b.Health(), "boom")
+	require.EqualError(t, <-b.Failures(), "boom")
+
+	// nothing was sent, the health is unchanged
+	fail = false
+	require.Nil(t, b.Start(intake.NewPubsub(), time.Hour, func(ctx context.Context) (bool, error) {
+		return false, nil
+	}))
+	require.Nil(t, b.Stop(context.Background()))
+	require.EqualError(t, b.Health(), "boom")
+}
+
+func TestBatcherStopTimeout(t *testing.T) {
+	output.Init(0)
+	b := &Batcher{}
+
+	// the flush blocks until the run is canceled
+	canceled := make(chan struct{})
+	require.Nil(t, b.Start(intake.NewPubsub(), time.Hour, func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		close(canceled)
+		// give Start the chance to see the run still flushing
+		time.Sleep(50 * time.Millisecond)
+		return true, ctx.Err()
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, b.Stop(ctx))
+
+	// the run is aborted, it can't be started again until it exits
+	<-canceled
+	noop := func(ctx context.Context) (bool, error) { return false, nil }
+	require.EqualError(t, b.Start(intake.NewPubsub(), time.Hour, noop), "the previous run is still flushing")
+	require.Eventually(t, func() bool {
+		return b.Start(intake.NewPubsub(), time.Hour, noop) == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, b.Stop(context.Background()))
+}
+
+func TestRetry(t *testing.T) {
+	output.Init(0)
+	ctx := context.Background()
+
+	// retried until it succeeds
+	calls := 0
+	err := Retry(ctx, 3, time.Millisecond, func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return true, errors.New("unavailable")
+		}
+		return false, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, calls)
+
+	// up to retries times
+	calls = 0
+	err = Retry(ctx, 2, time.Millisecond, func() (bool, error) {
+		calls++
+		return true, errors.New("unavailable")
+	})
+	require.EqualError(t, err, "unavailable")
+	require.Equal(t, 3, calls)
+
+	// only when it can be retried
+	calls = 0
+	err = Retry(ctx, 2, time.Millisecond, func() (bool, error) {
+		calls++
+		return false, errors.New("bad request")
+	})
+	require.EqualError(t, err, "bad request")
+	require.Equal(t, 1, calls)
+
+	// not after ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	calls = 0
+	err = Retry(ctx, 2, time.Hour, func() (bool, error) {
+		calls++
+		return true, errors.New("unavailable")
+	})
+	require.EqualError(t, err, "unavailable")
+	require.Equal(t, 1, calls)
+}
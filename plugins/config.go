@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Instance is a configured instance of a plugin
+type Instance struct {
+	// Type is the name of the plugin
+	Type string
+	// Name identifies the instance, it defaults to Type
+	Name string
+	// Config holds the settings of the instance
+	Config *viper.Viper
+}
+
+// GetInstances reads the plugin instances from cfg. Plugins can be
+// configured with a map keyed by the plugin type, when a single instance of
+// each plugin is needed:
+//
+//	plugins:
+//	  elasticsearch:
+//	    index: datadog-agent
+//
+// or with a list of instances, each with its own name:
+//
+//	plugins:
+//	  - type: elasticsearch
+//	    name: prod
+//	    index: datadog-agent
+//	  - type: elasticsearch
+//	    name: archive
+//	    index: datadog-agent-archive
+//
+// Both forms can also be passed as JSON with the THREADLE_PLUGINS env var.
+func GetInstances(cfg *viper.Viper) ([]Instance, error) {
+	raw := cfg.Get("plugins")
+
+	// settings from env vars are not parsed by viper
+	if s, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, fmt.Errorf("invalid plugins: %w", err)
+		}
+	}
+
+	instances := []Instance{}
+	switch v := raw.(type) {
+	case nil:
+	case []interface{}:
+		for i, item := range v {
+			settings, err := cast.ToStringMapE(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid plugins: entry %d is not a map", i)
+			}
+			pluginType := cast.ToString(settings["type"])
+			if pluginType == "" {
+				return nil, fmt.Errorf("invalid plugins: entry %d has no type", i)
+			}
+			name := cast.ToString(settings["name"])
+			if name == "" {
+				name = pluginType
+			}
+			delete(settings, "type")
+			delete(settings, "name")
+			instances = append(instances, newInstance(pluginType, name, settings))
+		}
+	default:
+		m, err := cast.ToStringMapE(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plugins: expected a map or a list")
+		}
+		// sort the plugins so that they're always started in the same order
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			settings, err := cast.ToStringMapE(m[k])
+			if err != nil && m[k] != nil {
+				return nil, fmt.Errorf("invalid plugins: settings of '%s' are not a map", k)
+			}
+			instances = append(instances, newInstance(k, k, settings))
+		}
+	}
+
+	// names are used to tell instances apart, they must be unique
+	seen := map[string]bool{}
+	for _, inst := range instances {
+		if seen[inst.Name] {
+			return nil, fmt.Errorf("invalid plugins: more than one instance named '%s'", inst.Name)
+		}
+		seen[inst.Name] = true
+	}
+
+	return instances, nil
+}
+
+func newInstance(pluginType, name string, settings map[string]interface{}) Instance {
+	cfg := viper.New()
+	if settings != nil {
+		// MergeConfigMap only fails when reading from an io.Reader
+		_ = cfg.MergeConfigMap(settings)
+	}
+	return Instance{
+		Type:   pluginType,
+		Name:   name,
+		Config: cfg,
+	}
+}
@@ -0,0 +1,95 @@
+package plugins
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func readConfig(t *testing.T, yaml string) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	require.Nil(t, viper.ReadConfig(strings.NewReader(yaml)))
+}
+
+func TestGetInstancesMap(t *testing.T) {
+	defer viper.Reset()
+	readConfig(t, `
+plugins:
+  logger:
+  elasticsearch:
+    index: datadog-agent
+`)
+
+	instances, err := GetInstances(viper.GetViper())
+	require.Nil(t, err)
+	require.Len(t, instances, 2)
+	require.Equal(t, "elasticsearch", instances[0].Type)
+	require.Equal(t, "elasticsearch", instances[0].Name)
+	require.Equal(t, "datadog-agent", instances[0].Config.GetString("index"))
+	require.Equal(t, "logger", instances[1].Type)
+	require.Equal(t, "logger", instances[1].Name)
+}
+
+func TestGetInstancesList(t *testing.T) {
+	defer viper.Reset()
+	readConfig(t, `
+plugins:
+  - type: elasticsearch
+    name: prod
+    index: datadog-agent
+    exclude_metrics:
+      - datadog.*
+  - type: elasticsearch
+    name: archive
+    index: datadog-agent-archive
+  - type: logger
+`)
+
+	instances, err := GetInstances(viper.GetViper())
+	require.Nil(t, err)
+	require.Len(t, instances, 3)
+	require.Equal(t, "prod", instances[0].Name)
+	require.Equal(t, "datadog-agent", instances[0].Config.GetString("index"))
+	require.Equal(t, []string{"datadog.*"}, instances[0].Config.GetStringSlice("exclude_metrics"))
+	require.False(t, instances[0].Config.IsSet("type"))
+	require.Equal(t, "archive", instances[1].Name)
+	require.Equal(t, "datadog-agent-archive", instances[1].Config.GetString("index"))
+	require.Equal(t, "logger", instances[2].Type)
+	require.Equal(t, "logger", instances[2].Name)
+}
+
+func TestGetInstancesEnv(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("plugins", `{"logger": {"ecs_compatible": true}}`)
+	instances, err := GetInstances(viper.GetViper())
+	require.Nil(t, err)
+	require.Len(t, instances, 1)
+	require.True(t, instances[0].Config.GetBool("ecs_compatible"))
+
+	viper.Set("plugins", `[{"type": "logger", "name": "debug"}]`)
+	instances, err = GetInstances(viper.GetViper())
+	require.Nil(t, err)
+	require.Len(t, instances, 1)
+	require.Equal(t, "debug", instances[0].Name)
+}
+
+func TestGetInstancesErrors(t *testing.T) {
+	defer viper.Reset()
+
+	testcases := []string{
+		`[{"name": "notype"}]`,
+		`[{"type": "logger"}, {"type": "logger"}]`,
+		`["logger"]`,
+		`{"logger": "foo"}`,
+		`{"logger"`,
+	}
+	for _, tc := range testcases {
+		viper.Set("plugins", tc)
+		_, err := GetInstances(viper.GetViper())
+		require.Error(t, err, tc)
+	}
+}
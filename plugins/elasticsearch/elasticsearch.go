@@ -4,18 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"github.com/masci/threadle/intake"
 	"github.com/masci/threadle/output"
 	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/processors"
 	"github.com/spf13/viper"
 )
 
-var (
-	es *elasticsearch.Client
-)
+func init() {
+	plugins.Register("elasticsearch", New,
+		plugins.Option{Name: "cloudid", Type: "string", Description: "Elastic Cloud ID, takes precedence over addresses"},
+		plugins.Option{Name: "addresses", Type: "[]string", Description: "URLs of the Elasticsearch nodes"},
+		plugins.Option{Name: "username", Type: "string", Description: "username to authenticate the client"},
+		plugins.Option{Name: "password", Type: "string", Description: "password to authenticate the client"},
+		plugins.Option{Name: "index", Type: "string", Default: "datadog-agent", Description: "index storing the data, the tenant is appended when set"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only send the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics sent to this output"},
+	)
+}
 
 // ES document
 type document map[string]interface{}
@@ -30,108 +43,414 @@ type host struct {
 	IP           string
 }
 
+// event field holding the Datadog specific attributes of an event
+type event struct {
+	Priority       string `json:"priority,omitempty"`
+	AlertType      string `json:"alert_type,omitempty"`
+	AggregationKey string `json:"aggregation_key,omitempty"`
+	SourceTypeName string `json:"source_type_name,omitempty"`
+}
+
 // ECS compatible labels field, we'll use it to store Datadog tags
 type labels map[string]string
 
 // Plugin implements plugins.Plugin
-type Plugin struct{}
+type Plugin struct {
+	cfg    *viper.Viper
+	es     *elasticsearch.Client
+	broker *intake.PubSub
+
+	// run is the state of the last Start, replaced only once the previous
+	// run has exited, together with the client and the indices
+	runMu sync.Mutex
+	run   *run
+
+	// indices keeps track of the indices already set up
+	indices   map[string]bool
+	indicesMu sync.Mutex
+
+	// lastErr is the error occurred during the last flush
+	lastErr  error
+	healthMu sync.Mutex
+}
+
+// run holds the state of a single Start, so that starting again never
+// touches the goroutines of a run that didn't stop in time
+type run struct {
+	subs     []<-chan *intake.Message
+	wg       sync.WaitGroup
+	failures chan error
+	// exited is closed once the messages of every subscription are processed
+	exited chan struct{}
+}
+
+// New creates an elasticsearch plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
 
 // Start subscribes to and processes the messages for the supported topics
-func (*Plugin) Start(b *intake.PubSub) {
+func (p *Plugin) Start(b *intake.PubSub) error {
+	// The goroutines of the previous run use the client and the indices
+	if prev := p.current(); prev != nil {
+		select {
+		case <-prev.exited:
+		default:
+			return errors.New("the previous run is still processing messages")
+		}
+	}
+	p.broker = b
+
 	// Create the Elasticsearch client
 	var err error
-	cfg := getEsConfig()
-	if es, err = elasticsearch.NewClient(*cfg); err != nil {
-		output.FATAL.Fatalf("Error creating elasticsearch client: %s", err)
+	if p.es, err = elasticsearch.NewClient(*getEsConfig(p.cfg)); err != nil {
+		return fmt.Errorf("error creating elasticsearch client: %w", err)
 	}
 
+	// Forget the indices set up with a previous client
+	p.indicesMu.Lock()
+	p.indices = map[string]bool{}
+	p.indicesMu.Unlock()
+
 	// Create the index if needed
-	indexName := viper.GetString("plugins.elasticsearch.index")
-	created, err := setupIndex(es, indexName)
+	indexName, err := p.getIndex("")
 	if err != nil {
-		output.FATAL.Fatalf("Unexpected error setting up the index '%s': %s", indexName, err)
-	}
-	if created {
-		output.INFO.Println("Index created:", indexName)
+		return fmt.Errorf("error setting up the index '%s': %w", indexName, err)
 	}
 
 	output.INFO.Println("Sending data to index:", indexName)
 
-	// Configure exclusion filters for metrics
-	exclude := plugins.GetFilters(viper.GetStringSlice("plugins.elasticsearch.exclude_metrics"))
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are sent to the index
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics sent to this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	r := &run{
+		failures: make(chan error, 1),
+		exited:   make(chan struct{}),
+	}
 
 	// Subcsribe to metrics messages
-	go func() {
-		for msg := range b.Subscribe(intake.SeriesEndpointV1) {
-			metrics, err := intake.DecodeV1Metrics([]byte(msg))
-			if err != nil {
-				output.ERROR.Println("error processing metrics: ", err)
-				continue
-			}
-			processV1Metrics(metrics, exclude)
+	p.subscribe(r, intake.SeriesEndpointV1, opts, func(msg *intake.Message) error {
+		metrics, err := msg.V1Metrics()
+		if err != nil {
+			output.ERROR.Println("error processing metrics: ", err)
+			return nil
 		}
-	}()
+		index, err := p.getIndex(msg.Tenant)
+		if err != nil {
+			return fmt.Errorf("error setting up the index: %w", err)
+		}
+		return p.processV1Metrics(index, chain.Process(filter.Process(metrics)))
+	})
+
+	// Subscribe to service checks messages
+	p.subscribe(r, intake.CheckRunsEndpointV1, opts, func(msg *intake.Message) error {
+		checkRuns, err := msg.CheckRuns()
+		if err != nil {
+			output.ERROR.Println("error processing check runs: ", err)
+			return nil
+		}
+		index, err := p.getIndex(msg.Tenant)
+		if err != nil {
+			return fmt.Errorf("error setting up the index: %w", err)
+		}
+		return p.processCheckRuns(index, checkRuns)
+	})
+
+	// Subscribe to events messages
+	p.subscribe(r, intake.EventsEndpointV2, opts, func(msg *intake.Message) error {
+		events, err := msg.Events()
+		if err != nil {
+			output.ERROR.Println("error processing events: ", err)
+			return nil
+		}
+		index, err := p.getIndex(msg.Tenant)
+		if err != nil {
+			return fmt.Errorf("error setting up the index: %w", err)
+		}
+		return p.processEvents(index, events)
+	})
 
 	// Subscribe to host metadata messages
+	p.subscribe(r, intake.IntakeEndpointV1, opts, func(msg *intake.Message) error {
+		hostMeta, err := msg.HostMeta()
+		if err != nil {
+			output.ERROR.Println("error processing host metadata: ", err)
+			return nil
+		}
+		index, err := p.getIndex(msg.Tenant)
+		if err != nil {
+			return fmt.Errorf("error setting up the index: %w", err)
+		}
+		return p.processHostMeta(index, hostMeta)
+	})
+
 	go func() {
-		for msg := range b.Subscribe(intake.IntakeEndpointV1) {
-			hostMeta, err := intake.DecodeHostMeta([]byte(msg))
-			if err != nil {
-				output.ERROR.Println("error processing host metadata: ", err)
-				continue
+		r.wg.Wait()
+		close(r.exited)
+	}()
+
+	p.runMu.Lock()
+	p.run = r
+	p.runMu.Unlock()
+
+	return nil
+}
+
+// Stop unsubscribes from the broker and waits for the pending messages to be
+// indexed. When ctx expires first, the plugin can't be started again until
+// the pending messages are processed.
+func (p *Plugin) Stop(ctx context.Context) error {
+	r := p.current()
+	if r == nil {
+		// never started
+		return nil
+	}
+	for _, ch := range r.subs {
+		p.broker.Unsubscribe(ch)
+	}
+	select {
+	case <-r.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Health returns the error occurred during the last flush to Elasticsearch, if any
+func (p *Plugin) Health() error {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return p.lastErr
+}
+
+// Check verifies that the Elasticsearch cluster can be reached
+func (p *Plugin) Check(ctx context.Context) error {
+	es, err := elasticsearch.NewClient(*getEsConfig(p.cfg))
+	if err != nil {
+		return fmt.Errorf("error creating elasticsearch client: %w", err)
+	}
+
+	res, err := es.Info(es.Info.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("unexpected response from elasticsearch: %s", res.Status())
+	}
+	return nil
+}
+
+// Failures returns the errors that prevented messages from being indexed,
+// for example when the cluster can't be reached
+func (p *Plugin) Failures() <-chan error {
+	if r := p.current(); r != nil {
+		return r.failures
+	}
+	return nil
+}
+
+// current returns the state of the last run, nil if never started
+func (p *Plugin) current() *run {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	return p.run
+}
+
+// subscribe processes the messages of a topic in a goroutine of the run r,
+// until the subscription is closed. Errors returned by process are logged and
+// reported as failures, that can be handled by a plugins.Supervisor.
+func (p *Plugin) subscribe(r *run, topic string, opts intake.SubscriptionOptions, process func(*intake.Message) error) {
+	ch := p.broker.SubscribeWithOptions(topic, opts)
+	r.subs = append(r.subs, ch)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for msg := range ch {
+			if err := process(msg); err != nil {
+				output.ERROR.Printf("Error indexing data from %s: %s", topic, err)
+				p.setError(err)
+				r.fail(err)
 			}
-			processHostMeta(hostMeta)
 		}
 	}()
 }
 
+// fail reports a failure without blocking, one pending failure is enough
+// to trigger a restart
+func (r *run) fail(err error) {
+	select {
+	case r.failures <- err:
+	default:
+	}
+}
+
+// setHealth records the outcome of a flush
+func (p *Plugin) setHealth(stats esutil.BulkIndexerStats) {
+	err := error(nil)
+	if stats.NumFailed > 0 {
+		err = fmt.Errorf("%d documents failed to be indexed", stats.NumFailed)
+	}
+	p.setError(err)
+}
+
+// setError records the error occurred while indexing data
+func (p *Plugin) setError(err error) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.lastErr = err
+}
+
+// bulkIndexer records the errors occurred while flushing, that esutil only
+// reports through a callback, and returns them on Close
+type bulkIndexer struct {
+	esutil.BulkIndexer
+
+	mu  sync.Mutex
+	err error
+}
+
+// Close flushes the pending documents and returns the first error occurred
+func (bi *bulkIndexer) Close(ctx context.Context) error {
+	if err := bi.BulkIndexer.Close(ctx); err != nil {
+		return err
+	}
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.err
+}
+
+func (bi *bulkIndexer) onError(ctx context.Context, err error) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if bi.err == nil {
+		bi.err = err
+	}
+}
+
+// newIndexer creates a bulk indexer writing to index
+func (p *Plugin) newIndexer(index string) (*bulkIndexer, error) {
+	bi := &bulkIndexer{}
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Index:   index,
+		Client:  p.es,
+		OnError: bi.onError,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the indexer: %w", err)
+	}
+	bi.BulkIndexer = indexer
+	return bi, nil
+}
+
 // processV1Metrics reads all the metrics, build the corresponding ES documents and stores them
 // using the _bulk api
-func processV1Metrics(metrics []intake.V1Metric, exclude plugins.Filters) {
+func (p *Plugin) processV1Metrics(index string, metrics []intake.V1Metric) error {
 	// Create the ES bulk indexer
-	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Index:  viper.GetString("plugins.elasticsearch.index"),
-		Client: es,
-	})
+	indexer, err := p.newIndexer(index)
 	if err != nil {
-		output.ERROR.Printf("Error creating the indexer: %s", err)
+		return err
 	}
 
 	// Convert all the metrics and add them to the indexer
-	for _, m := range plugins.ExcludeV1Metrics(metrics, exclude) {
-		jsonData, err := json.Marshal(getV1MetricDocument(&m))
-		if err != nil {
-			output.ERROR.Println(err)
-			continue
-		}
+	for _, m := range metrics {
+		for _, doc := range getV1MetricDocuments(&m) {
+			jsonData, err := json.Marshal(doc)
+			if err != nil {
+				output.ERROR.Println(err)
+				continue
+			}
 
-		err = indexer.Add(
-			context.Background(),
-			esutil.BulkIndexerItem{
-				Action: "index",
-				Body:   bytes.NewReader(jsonData),
-			},
-		)
-		if err != nil {
-			output.ERROR.Printf("Unexpected error: %s", err)
+			err = indexer.Add(
+				context.Background(),
+				esutil.BulkIndexerItem{
+					Action: "index",
+					Body:   bytes.NewReader(jsonData),
+				},
+			)
+			if err != nil {
+				output.ERROR.Printf("Unexpected error: %s", err)
+			}
 		}
 	}
 
 	if err := indexer.Close(context.Background()); err != nil {
-		output.FATAL.Fatalf("Unexpected error: %s", err)
+		return fmt.Errorf("error flushing metrics: %w", err)
 	}
 
+	p.setHealth(indexer.Stats())
 	output.DEBUG.Println("flushed", indexer.Stats().NumFlushed, "created", indexer.Stats().NumCreated, "failed", indexer.Stats().NumFailed)
+	return nil
 }
 
-func processHostMeta(hm *intake.HostMeta) {
+// processCheckRuns converts the service checks into ES documents and stores them using the _bulk api
+func (p *Plugin) processCheckRuns(index string, checkRuns []intake.CheckRun) error {
 	// Create the ES bulk indexer
-	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Index:  viper.GetString("plugins.elasticsearch.index"),
-		Client: es,
-	})
+	indexer, err := p.newIndexer(index)
+	if err != nil {
+		return err
+	}
+
+	for _, cr := range checkRuns {
+		if err = addDocument(indexer, getCheckRunDocument(&cr)); err != nil {
+			output.ERROR.Printf("Error adding check run to the indexer: %s", err)
+		}
+	}
+
+	// Flush data
+	if err := indexer.Close(context.Background()); err != nil {
+		return fmt.Errorf("error flushing check runs: %w", err)
+	}
+
+	p.setHealth(indexer.Stats())
+	output.DEBUG.Println("check runs flushed", indexer.Stats().NumFlushed, "created", indexer.Stats().NumCreated, "failed", indexer.Stats().NumFailed)
+	return nil
+}
+
+// processEvents converts the events into ES documents and stores them using the _bulk api
+func (p *Plugin) processEvents(index string, events []intake.Event) error {
+	// Create the ES bulk indexer
+	indexer, err := p.newIndexer(index)
 	if err != nil {
-		output.ERROR.Printf("Error creating the indexer: %s", err)
+		return err
+	}
+
+	for _, e := range events {
+		if err = addDocument(indexer, getEventDocument(&e)); err != nil {
+			output.ERROR.Printf("Error adding event to the indexer: %s", err)
+		}
+	}
+
+	// Flush data
+	if err := indexer.Close(context.Background()); err != nil {
+		return fmt.Errorf("error flushing events: %w", err)
+	}
+
+	p.setHealth(indexer.Stats())
+	output.DEBUG.Println("events flushed", indexer.Stats().NumFlushed, "created", indexer.Stats().NumCreated, "failed", indexer.Stats().NumFailed)
+	return nil
+}
+
+func (p *Plugin) processHostMeta(index string, hm *intake.HostMeta) error {
+	// Create the ES bulk indexer
+	indexer, err := p.newIndexer(index)
+	if err != nil {
+		return err
 	}
 
 	// Build the metadata document and add it to the bulk indexer
@@ -152,24 +471,53 @@ func processHostMeta(hm *intake.HostMeta) {
 
 	// Flush data
 	if err := indexer.Close(context.Background()); err != nil {
-		output.FATAL.Fatalf("Unexpected error: %s", err)
+		return fmt.Errorf("error flushing host metadata: %w", err)
 	}
 
+	p.setHealth(indexer.Stats())
 	output.DEBUG.Println("meta flushed", indexer.Stats().NumFlushed, "created", indexer.Stats().NumCreated, "failed", indexer.Stats().NumFailed)
+	return nil
+}
+
+// getIndex returns the index storing the data of a tenant, setting it up if needed.
+// Data is stored in the configured index, with the tenant name as a suffix when
+// API keys are mapped to tenants, see getIndexSuffix.
+func (p *Plugin) getIndex(tenant string) (string, error) {
+	indexName := p.cfg.GetString("index")
+	if suffix := getIndexSuffix(tenant); suffix != "" {
+		indexName = fmt.Sprintf("%s-%s", indexName, suffix)
+	}
+
+	p.indicesMu.Lock()
+	defer p.indicesMu.Unlock()
+
+	if p.indices[indexName] {
+		return indexName, nil
+	}
+	created, err := setupIndex(p.es, indexName)
+	if err != nil {
+		return indexName, err
+	}
+	if created {
+		output.INFO.Println("Index created:", indexName)
+	}
+	p.indices[indexName] = true
+
+	return indexName, nil
 }
 
-func getEsConfig() *elasticsearch.Config {
+func getEsConfig(settings *viper.Viper) *elasticsearch.Config {
 	cfg := elasticsearch.Config{
-		Username: viper.GetString("plugins.elasticsearch.username"),
-		Password: viper.GetString("plugins.elasticsearch.password"),
+		Username: settings.GetString("username"),
+		Password: settings.GetString("password"),
 	}
 
 	// cloud id takes precedence over addresses
-	if cloudid := viper.GetString("plugins.elasticsearch.cloudid"); cloudid != "" {
+	if cloudid := settings.GetString("cloudid"); cloudid != "" {
 		cfg.CloudID = cloudid
 		output.DEBUG.Println("Using Cloud ID", cloudid)
 	} else {
-		cfg.Addresses = viper.GetStringSlice("plugins.elasticsearch.addresses")
+		cfg.Addresses = settings.GetStringSlice("addresses")
 		output.DEBUG.Println("Using ES addresses", cfg.Addresses)
 	}
 
@@ -0,0 +1,75 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartError(t *testing.T) {
+	output.Init(0)
+	cfg := viper.New()
+	cfg.Set("addresses", []string{"http://127.0.0.1:1"})
+
+	p := New(cfg)
+	require.Error(t, p.Start(intake.NewPubsub()))
+}
+
+func TestStartWhileRunning(t *testing.T) {
+	output.Init(0)
+
+	// the previous run is still processing messages
+	r := &run{exited: make(chan struct{})}
+	p := &Plugin{cfg: viper.New(), run: r}
+	require.EqualError(t, p.Start(intake.NewPubsub()), "the previous run is still processing messages")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, p.Stop(ctx))
+
+	close(r.exited)
+	require.Nil(t, p.Stop(context.Background()))
+}
+
+func TestProcessV1MetricsError(t *testing.T) {
+	output.Init(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	var err error
+	p := &Plugin{}
+	p.es, err = elasticsearch.NewClient(elasticsearch.Config{
+		Addresses:  []string{srv.URL},
+		MaxRetries: 1,
+	})
+	require.Nil(t, err)
+
+	metrics := []intake.V1Metric{{Metric: "system.load.1", Points: []intake.Point{{1612906502, 1}}}}
+	require.Error(t, p.processV1Metrics("threadle", metrics))
+}
+
+func TestCheck(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	cfg := viper.New()
+	cfg.Set("addresses", []string{srv.URL})
+	p := &Plugin{cfg: cfg}
+	require.Nil(t, p.Check(context.Background()))
+
+	status = http.StatusUnauthorized
+	require.EqualError(t, p.Check(context.Background()), "unexpected response from elasticsearch: 401 Unauthorized")
+}
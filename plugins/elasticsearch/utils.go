@@ -7,13 +7,41 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/datadog"
 )
 
+// getLabels converts a list of Datadog tags into ECS labels, split as
+// described in datadog.SplitTag
+func getLabels(tags []string) labels {
+	l := labels{}
+	for _, t := range tags {
+		if key, value, ok := datadog.SplitTag(t); ok {
+			l[key] = value
+		}
+	}
+	return l
+}
+
+// getIndexSuffix turns a tenant into a valid index name suffix: it's
+// lowercased, the characters not allowed in index names are replaced with
+// underscores and the leading "-", "_" and "+" are trimmed
+func getIndexSuffix(tenant string) string {
+	suffix := strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		}
+		return unicode.ToLower(r)
+	}, tenant)
+	return strings.TrimLeft(suffix, "-_+")
+}
+
 func addDocument(indexer esutil.BulkIndexer, d *document) error {
 	jsonData, err := json.Marshal(d)
 	if err != nil {
@@ -29,35 +57,84 @@ func addDocument(indexer esutil.BulkIndexer, d *document) error {
 	)
 }
 
-// getV1MetricDocument converts a Datadog metric into an ECS compatible document
-func getV1MetricDocument(m *intake.V1Metric) *document {
-	d := document{}
-	d["@timestamp"] = time.Unix(int64(m.Points[0][0]), 0).UTC().Format(time.RFC3339)
-	d[m.Metric] = m.Points[0][1]
-	if len(m.Tags) > 0 {
-		labels := labels{}
-		for _, t := range m.Tags {
-			toks := strings.Split(t, ":")
-			if len(toks) < 2 {
-				toks = append(toks, "")
-			}
-			labels[toks[0]] = toks[1]
+// getV1MetricDocuments converts a Datadog metric into ECS compatible documents,
+// one for each point
+func getV1MetricDocuments(m *intake.V1Metric) []*document {
+	docs := make([]*document, 0, len(m.Points))
+	for _, p := range m.Points {
+		d := document{}
+		d["@timestamp"] = time.Unix(int64(p[0]), 0).UTC().Format(time.RFC3339)
+		d[m.Metric] = p[1]
+		if len(m.Tags) > 0 {
+			d["labels"] = getLabels(m.Tags)
+		}
+		d["host"] = host{
+			Name:     m.Host,
+			Hostname: m.Host,
+		}
+		if m.Interval > 0 {
+			d["interval"] = m.Interval
 		}
-		d["labels"] = labels
+		if m.Device != "" {
+			d["device"] = m.Device
+		}
+		d["type"] = m.Type
+		if m.SourceTypeName != "" {
+			d["source_type_name"] = m.SourceTypeName
+		}
+		docs = append(docs, &d)
+	}
+	return docs
+}
+
+// getCheckRunDocument converts a Datadog service check into an ECS compatible document,
+// the check status is stored like a metric so it can be plotted alongside the other series
+func getCheckRunDocument(cr *intake.CheckRun) *document {
+	d := document{}
+	d["@timestamp"] = time.Unix(cr.Timestamp, 0).UTC().Format(time.RFC3339)
+	d[cr.Check] = cr.Status
+	if len(cr.Tags) > 0 {
+		d["labels"] = getLabels(cr.Tags)
 	}
 	d["host"] = host{
-		Name:     m.Host,
-		Hostname: m.Host,
+		Name:     cr.HostName,
+		Hostname: cr.HostName,
+	}
+	d["type"] = "service_check"
+	if cr.Message != "" {
+		d["message"] = cr.Message
+	}
+
+	return &d
+}
+
+// getEventDocument converts a Datadog event into an ECS compatible document. Tags
+// are also stored as a list so the documents can be used as Grafana annotations.
+func getEventDocument(e *intake.Event) *document {
+	d := document{}
+	ts := time.Now()
+	if e.Timestamp > 0 {
+		ts = time.Unix(e.Timestamp, 0)
 	}
-	if m.Interval > 0 {
-		d["interval"] = m.Interval
+	d["@timestamp"] = ts.UTC().Format(time.RFC3339)
+	d["title"] = e.Title
+	d["message"] = e.Text
+	if len(e.Tags) > 0 {
+		d["labels"] = getLabels(e.Tags)
+		d["tags"] = e.Tags
 	}
-	if m.Device != "" {
-		d["device"] = m.Device
+	if e.Host != "" {
+		d["host"] = host{
+			Name:     e.Host,
+			Hostname: e.Host,
+		}
 	}
-	d["type"] = m.Type
-	if m.SourceTypeName != "" {
-		d["source_type_name"] = m.SourceTypeName
+	d["type"] = "event"
+	d["event"] = event{
+		Priority:       e.Priority,
+		AlertType:      e.AlertType,
+		AggregationKey: e.AggregationKey,
+		SourceTypeName: e.SourceTypeName,
 	}
 
 	return &d
@@ -76,15 +153,7 @@ func getHostMetadataDocument(hm *intake.HostMeta) *document {
 	}
 	// Convert tags to labels
 	if len(hm.HostTags.System) > 0 {
-		labels := labels{}
-		for _, t := range hm.HostTags.System {
-			toks := strings.Split(t, ":")
-			if len(toks) < 2 {
-				toks = append(toks, "")
-			}
-			labels[toks[0]] = toks[1]
-		}
-		d["labels"] = labels
+		d["labels"] = getLabels(hm.HostTags.System)
 	}
 	return &d
 }
@@ -26,6 +26,104 @@ func TestGetV1MetricDocument(t *testing.T) {
 		"type":              "gauge",
 	}
 
-	doc := getV1MetricDocument(&(metrics[0]))
+	docs := getV1MetricDocuments(&(metrics[0]))
+	require.Equal(t, []*document{expected}, docs)
+
+	// one document for each point
+	m := intake.V1Metric{
+		Metric: "request.latency.count",
+		Points: []intake.Point{{1612906502, 1}, {1612906512, 2}},
+		Type:   "count",
+	}
+	docs = getV1MetricDocuments(&m)
+	require.Len(t, docs, 2)
+	require.Equal(t, "2021-02-09T21:35:02Z", (*docs[0])["@timestamp"])
+	require.Equal(t, 1.0, (*docs[0])[m.Metric])
+	require.Equal(t, "2021-02-09T21:35:12Z", (*docs[1])["@timestamp"])
+	require.Equal(t, 2.0, (*docs[1])[m.Metric])
+
+	// metrics without points are skipped
+	m.Points = []intake.Point{}
+	require.Empty(t, getV1MetricDocuments(&m))
+}
+
+func TestGetCheckRunDocument(t *testing.T) {
+	cr := intake.CheckRun{
+		Check:     "datadog.agent.check_status",
+		HostName:  "MacLastic2.local",
+		Timestamp: 1612613793,
+		Status:    2,
+		Message:   "something went wrong",
+		Tags:      []string{"check:uptime", "url:http://localhost"},
+	}
+
+	expected := &document{
+		"@timestamp": "2021-02-06T12:16:33Z",
+		"host": host{
+			Name:     "MacLastic2.local",
+			Hostname: "MacLastic2.local",
+		},
+		"labels": labels{
+			"check": "uptime",
+			"url":   "http://localhost",
+		},
+		"datadog.agent.check_status": 2,
+		"message":                    "something went wrong",
+		"type":                       "service_check",
+	}
+
+	doc := getCheckRunDocument(&cr)
+	require.Equal(t, expected, doc)
+}
+
+func TestGetEventDocument(t *testing.T) {
+	e := intake.Event{
+		Title:          "Deployed threadle v0.3.0",
+		Text:           "Deployment completed successfully",
+		Timestamp:      1612906502,
+		Priority:       "normal",
+		Host:           "MacLastic2.local",
+		Tags:           []string{"env:prod"},
+		AlertType:      "info",
+		SourceTypeName: "deployments",
+	}
+
+	expected := &document{
+		"@timestamp": "2021-02-09T21:35:02Z",
+		"title":      "Deployed threadle v0.3.0",
+		"message":    "Deployment completed successfully",
+		"host": host{
+			Name:     "MacLastic2.local",
+			Hostname: "MacLastic2.local",
+		},
+		"labels": labels{
+			"env": "prod",
+		},
+		"tags": []string{"env:prod"},
+		"type": "event",
+		"event": event{
+			Priority:       "normal",
+			AlertType:      "info",
+			SourceTypeName: "deployments",
+		},
+	}
+
+	doc := getEventDocument(&e)
 	require.Equal(t, expected, doc)
 }
+
+func TestGetIndexSuffix(t *testing.T) {
+	require.Equal(t, "acme", getIndexSuffix("ACME"))
+	require.Equal(t, "acme_corp_eu", getIndexSuffix("Acme Corp/EU"))
+	require.Equal(t, "a_b_c_d", getIndexSuffix("a*b,c#d"))
+	require.Equal(t, "team", getIndexSuffix("-_team"))
+	require.Equal(t, "", getIndexSuffix(""))
+}
+
+func TestGetLabels(t *testing.T) {
+	require.Equal(t, labels{
+		"env":    "prod",
+		"url":    "http://localhost:8080",
+		"canary": "true",
+	}, getLabels([]string{"env:prod", "url:http://localhost:8080", "canary", "team:"}))
+}
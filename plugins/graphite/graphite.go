@@ -0,0 +1,263 @@
+// Package graphite sends the metrics to Graphite, or any storage accepting
+// the Carbon plaintext or pickle protocols.
+package graphite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	plugins.Register("graphite", New,
+		plugins.Option{Name: "address", Type: "string", Default: "localhost:2003", Description: "host and port of the Carbon receiver"},
+		plugins.Option{Name: "protocol", Type: "string", Default: "plaintext", Description: "either plaintext or pickle"},
+		plugins.Option{Name: "template", Type: "string", Default: "{host}.{metric}", Description: "template of the metric paths, with placeholders for the metric name and the tags"},
+		plugins.Option{Name: "tagged", Type: "bool", Default: false, Description: "append the tags to the paths using the Graphite 1.1 tagged series syntax"},
+		plugins.Option{Name: "flush_interval", Type: "duration", Default: "10s", Description: "how often the metrics are sent"},
+		plugins.Option{Name: "max_batch_size", Type: "int", Default: 500, Description: "points sent in a single pickle message or write"},
+		plugins.Option{Name: "max_pending_points", Type: "int", Default: 100000, Description: "points kept while Graphite can't be reached, the oldest are dropped"},
+		plugins.Option{Name: "timeout", Type: "duration", Default: "10s", Description: "timeout to connect and to send each batch"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only send the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics sent by this output"},
+	)
+}
+
+// Plugin implements plugins.Plugin. It doesn't report failures to be
+// restarted, as it reconnects on its own keeping the points not sent yet.
+type Plugin struct {
+	cfg      *viper.Viper
+	batcher  plugins.Batcher
+	template *pathTemplate
+
+	// pending holds the points waiting to be sent, dropped counts the points
+	// dropped because there were too many pending
+	mu      sync.Mutex
+	pending []point
+	dropped int
+
+	// conn is the connection to Graphite, only used while flushing
+	conn net.Conn
+}
+
+// New creates a graphite plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
+
+// Start subscribes to the metrics and starts sending them periodically
+func (p *Plugin) Start(b *intake.PubSub) error {
+	if p.cfg.GetString("address") == "" {
+		return errors.New("invalid configuration: address must be set")
+	}
+
+	template, err := parseTemplate(p.cfg.GetString("template"))
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var encode func([]point) []byte
+	switch protocol := p.cfg.GetString("protocol"); protocol {
+	case "plaintext":
+		encode = encodePlaintext
+	case "pickle":
+		encode = encodePickle
+	default:
+		return fmt.Errorf("invalid configuration: unknown protocol %q, either plaintext or pickle", protocol)
+	}
+
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are sent
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics sent by this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	flush := func(ctx context.Context) (bool, error) {
+		return p.flush(ctx, encode)
+	}
+	if err := p.batcher.Start(b, p.cfg.GetDuration("flush_interval"), flush); err != nil {
+		return err
+	}
+	p.template = template
+	p.mu.Lock()
+	p.pending = nil
+	p.dropped = 0
+	p.mu.Unlock()
+
+	output.INFO.Printf("Sending metrics to Graphite at %s using the %s protocol", p.cfg.GetString("address"), p.cfg.GetString("protocol"))
+
+	p.batcher.Subscribe(intake.SeriesEndpointV1, opts, func(msg *intake.Message) bool {
+		metrics, err := msg.V1Metrics()
+		if err != nil {
+			output.ERROR.Println("error processing metrics: ", err)
+			return false
+		}
+		p.add(msg.Tenant, chain.Process(filter.Process(metrics)))
+		return false
+	})
+
+	return nil
+}
+
+// Stop unsubscribes from the broker, sends the pending points and closes
+// the connection
+func (p *Plugin) Stop(ctx context.Context) error {
+	if err := p.batcher.Stop(ctx); err != nil {
+		return err
+	}
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return nil
+}
+
+// Health returns the error occurred during the last flush, if any
+func (p *Plugin) Health() error {
+	return p.batcher.Health()
+}
+
+// Check verifies that Graphite can be reached by opening a connection
+func (p *Plugin) Check(ctx context.Context) error {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// add converts the metrics into points and adds them to the pending ones.
+// Points with NaN or infinite values are skipped, as Graphite can't store
+// them.
+func (p *Plugin) add(tenant string, metrics []intake.V1Metric) {
+	tagged := p.cfg.GetBool("tagged")
+
+	var points []point
+	for i := range metrics {
+		m := &metrics[i]
+		tags := getTags(m, tenant)
+		path := p.template.render(m, tags)
+		if tagged {
+			path = p.template.appendTags(path, tags)
+		}
+		for _, pt := range m.Points {
+			if len(pt) < 2 || math.IsNaN(pt[1]) || math.IsInf(pt[1], 0) {
+				continue
+			}
+			points = append(points, point{path: path, value: pt[1], timestamp: int64(pt[0])})
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, points...)
+	p.trim()
+}
+
+// trim drops the oldest points past max_pending_points, must be called
+// holding mu
+func (p *Plugin) trim() {
+	if excess := len(p.pending) - p.cfg.GetInt("max_pending_points"); excess > 0 {
+		p.pending = append([]point(nil), p.pending[excess:]...)
+		p.dropped += excess
+	}
+}
+
+// flush sends the pending points in batches. When Graphite can't be
+// reached, the points not sent are kept to be sent at the next flush,
+// along with the new ones, after reconnecting. Points sent again after a
+// partial write are simply overwritten by Graphite.
+func (p *Plugin) flush(ctx context.Context, encode func([]point) []byte) (bool, error) {
+	p.mu.Lock()
+	pending := p.pending
+	dropped := p.dropped
+	p.pending = nil
+	p.dropped = 0
+	p.mu.Unlock()
+
+	if dropped > 0 {
+		output.WARN.Printf("Too many points pending for Graphite, %d points dropped", dropped)
+	}
+	if len(pending) == 0 {
+		return false, nil
+	}
+
+	sent, err := p.send(ctx, encode, pending)
+	if err != nil {
+		output.ERROR.Printf("Error sending metrics to Graphite, %d points kept to be sent later: %s", len(pending)-sent, err)
+
+		// put the points not sent back in front of the newer ones
+		p.mu.Lock()
+		p.pending = append(pending[sent:], p.pending...)
+		p.trim()
+		p.mu.Unlock()
+	}
+	return true, err
+}
+
+// send writes the points in batches, connecting first if needed. It returns
+// how many points were sent, along with the error that interrupted sending.
+func (p *Plugin) send(ctx context.Context, encode func([]point) []byte, points []point) (int, error) {
+	if p.conn == nil {
+		conn, err := p.dial(ctx)
+		if err != nil {
+			return 0, err
+		}
+		p.conn = conn
+	}
+
+	size := p.cfg.GetInt("max_batch_size")
+	if size <= 0 {
+		size = len(points)
+	}
+	timeout := p.cfg.GetDuration("timeout")
+	for sent := 0; sent < len(points); sent += size {
+		end := sent + size
+		if end > len(points) {
+			end = len(points)
+		}
+		if timeout > 0 {
+			p.conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := p.conn.Write(encode(points[sent:end])); err != nil {
+			// reconnect at the next flush
+			p.conn.Close()
+			p.conn = nil
+			return sent, err
+		}
+	}
+	return len(points), nil
+}
+
+// dial connects to Graphite
+func (p *Plugin) dial(ctx context.Context) (net.Conn, error) {
+	address := p.cfg.GetString("address")
+	if address == "" {
+		return nil, errors.New("address must be set")
+	}
+	d := net.Dialer{Timeout: p.cfg.GetDuration("timeout")}
+	return d.DialContext(ctx, "tcp", address)
+}
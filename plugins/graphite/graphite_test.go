@@ -0,0 +1,159 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/plugintest"
+	"github.com/stretchr/testify/require"
+)
+
+// server is a Carbon plaintext receiver recording the lines
+type server struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	lines []string
+}
+
+func newServer(t *testing.T, address string) *server {
+	ln, err := net.Listen("tcp", address)
+	require.Nil(t, err)
+	s := &server{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.mu.Lock()
+					s.lines = append(s.lines, scanner.Text())
+					s.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *server) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func newPlugin(t *testing.T, address string, settings map[string]interface{}) *Plugin {
+	return plugintest.NewPlugin(t, "graphite", map[string]interface{}{
+		"address": address,
+		"timeout": "1s",
+	}, settings).(*Plugin)
+}
+
+func TestGraphite(t *testing.T) {
+	srv := newServer(t, "127.0.0.1:0")
+	p := newPlugin(t, srv.ln.Addr().String(), map[string]interface{}{
+		"flush_interval":  "1h",
+		"template":        "datadog.{env}.{host}.{metric}",
+		"exclude_metrics": []string{"^datadog"},
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "system.load.1", "type": "gauge", "host": "web-1", "tags": ["env:prod"], "points": [[1612906502, 0.5]]},
+		{"metric": "datadog.agent.running", "type": "gauge", "host": "web-1", "points": [[1612906502, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "app.requests", "type": "count", "host": "web-2", "points": [[1612906502, 2], [1612906512, 3]]}
+	]}`)})
+
+	// the pending points are sent when stopping
+	require.Nil(t, p.Stop(context.Background()))
+	require.Nil(t, p.Health())
+
+	require.Eventually(t, func() bool { return len(srv.received()) == 3 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{
+		"datadog.prod.web-1.system.load.1 0.5 1612906502",
+		"datadog.web-2.app.requests 2 1612906502",
+		"datadog.web-2.app.requests 3 1612906512",
+	}, srv.received())
+}
+
+func TestGraphiteTagged(t *testing.T) {
+	srv := newServer(t, "127.0.0.1:0")
+	p := newPlugin(t, srv.ln.Addr().String(), map[string]interface{}{
+		"flush_interval": "1h",
+		"template":       "{metric}",
+		"tagged":         true,
+	})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	p.add("acme", []intake.V1Metric{{
+		Metric: "system.load.1", Host: "web-1", Tags: []string{"role:web", "role:db"},
+		Points: []intake.Point{{1612906502, 0.5}},
+	}})
+	require.Nil(t, p.Stop(context.Background()))
+
+	require.Eventually(t, func() bool { return len(srv.received()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, "system.load.1;host=web-1;role=db,web;tenant=acme 0.5 1612906502", srv.received()[0])
+}
+
+func TestGraphiteReconnect(t *testing.T) {
+	// reserve an address, then stop listening so that Graphite is down
+	srv := newServer(t, "127.0.0.1:0")
+	address := srv.ln.Addr().String()
+	srv.ln.Close()
+
+	p := newPlugin(t, address, map[string]interface{}{"flush_interval": "1h", "max_pending_points": 2})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	defer p.Stop(context.Background())
+
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906502, 1}, {1612906512, 2}}}})
+	_, err := p.flush(context.Background(), encodePlaintext)
+	require.Error(t, err)
+
+	// the points are kept while Graphite is down, dropping the oldest ones
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906522, 3}}}})
+	p.mu.Lock()
+	require.Len(t, p.pending, 2)
+	require.Equal(t, 1, p.dropped)
+	p.mu.Unlock()
+
+	srv = newServer(t, address)
+	_, err = p.flush(context.Background(), encodePlaintext)
+	require.Nil(t, err)
+	require.Eventually(t, func() bool { return len(srv.received()) == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a 2 1612906512", "a 3 1612906522"}, srv.received())
+}
+
+func TestEncodePickle(t *testing.T) {
+	// pickle.loads returns [('a.b', (1612906502, 0.5))]
+	require.Equal(t, []byte("\x00\x00\x00\x1e\x80\x02](X\x03\x00\x00\x00a.bJ\x06\x00\x23\x60G\x3f\xe0\x00\x00\x00\x00\x00\x00\x86\x86e."),
+		encodePickle([]point{{path: "a.b", value: 0.5, timestamp: 1612906502}}))
+}
+
+func TestCheck(t *testing.T) {
+	srv := newServer(t, "127.0.0.1:0")
+	p := newPlugin(t, srv.ln.Addr().String(), nil)
+	require.Nil(t, p.Check(context.Background()))
+
+	srv.ln.Close()
+	require.Error(t, p.Check(context.Background()))
+
+	p = newPlugin(t, "", nil)
+	require.EqualError(t, p.Check(context.Background()), "address must be set")
+	require.EqualError(t, p.Start(intake.NewPubsub()), "invalid configuration: address must be set")
+
+	p = newPlugin(t, "localhost:2004", map[string]interface{}{"protocol": "udp"})
+	require.EqualError(t, p.Start(intake.NewPubsub()), `invalid configuration: unknown protocol "udp", either plaintext or pickle`)
+	p = newPlugin(t, "localhost:2004", map[string]interface{}{"template": "{host}"})
+	require.EqualError(t, p.Start(intake.NewPubsub()), "invalid configuration: the template must contain the {metric} placeholder")
+}
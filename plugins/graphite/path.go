@@ -0,0 +1,166 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/datadog"
+)
+
+// segment is either a literal or a placeholder of a template node
+type segment struct {
+	literal string
+	key     string
+}
+
+// pathTemplate builds the dotted path of the metrics, like
+// "datadog.{env}.{host}.{metric}". Placeholders are replaced by the metric
+// name, or by the tag with the same key, while nodes left empty are skipped.
+type pathTemplate struct {
+	nodes [][]segment
+	// keys holds the keys of the placeholders, other than metric
+	keys map[string]bool
+}
+
+// parseTemplate parses a template, that must contain the {metric} placeholder
+func parseTemplate(s string) (*pathTemplate, error) {
+	t := &pathTemplate{keys: map[string]bool{}}
+	hasMetric := false
+	for _, node := range strings.Split(s, ".") {
+		var segments []segment
+		for node != "" {
+			start := strings.Index(node, "{")
+			if start < 0 {
+				segments = append(segments, segment{literal: node})
+				break
+			}
+			end := strings.Index(node[start:], "}")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed placeholder in template %q", s)
+			}
+			key := node[start+1 : start+end]
+			if key == "" {
+				return nil, fmt.Errorf("empty placeholder in template %q", s)
+			}
+			if start > 0 {
+				segments = append(segments, segment{literal: node[:start]})
+			}
+			segments = append(segments, segment{key: key})
+			if key == "metric" {
+				hasMetric = true
+			} else {
+				t.keys[key] = true
+			}
+			node = node[start+end+1:]
+		}
+		if len(segments) > 0 {
+			t.nodes = append(t.nodes, segments)
+		}
+	}
+	if !hasMetric {
+		return nil, errors.New("the template must contain the {metric} placeholder")
+	}
+	return t, nil
+}
+
+// render returns the path of a metric. The dots of the metric name are kept
+// as they separate the nodes of the Graphite hierarchy, while the values of
+// the other placeholders are sanitized into a single node.
+func (t *pathTemplate) render(m *intake.V1Metric, tags map[string][]string) string {
+	nodes := make([]string, 0, len(t.nodes))
+	for _, segments := range t.nodes {
+		var sb strings.Builder
+		placeholders, missing := 0, 0
+		for _, s := range segments {
+			switch s.key {
+			case "":
+				sb.WriteString(s.literal)
+			case "metric":
+				placeholders++
+				sb.WriteString(sanitize(m.Metric, true))
+			default:
+				placeholders++
+				if len(tags[s.key]) == 0 {
+					missing++
+					continue
+				}
+				sb.WriteString(sanitize(strings.Join(tags[s.key], "_"), false))
+			}
+		}
+		// skip the nodes whose placeholders are all missing
+		if placeholders > 0 && missing == placeholders {
+			continue
+		}
+		nodes = append(nodes, sb.String())
+	}
+	return strings.Join(nodes, ".")
+}
+
+// getTags returns the values of the tags of a metric by key, sorted. The
+// host, device and tenant are added unless a tag with the same key is
+// already there. Datadog tags are split as described in datadog.SplitTag.
+func getTags(m *intake.V1Metric, tenant string) map[string][]string {
+	values := datadog.TagValues(m.Tags)
+	for key, value := range map[string]string{"host": m.Host, "device": m.Device, "tenant": tenant} {
+		if _, found := values[key]; !found && value != "" {
+			values[key] = []string{value}
+		}
+	}
+	return values
+}
+
+// appendTags appends the tags not used by the template to the path, using
+// the Graphite 1.1 tagged series syntax:
+//
+//	system.load.1;env=prod;role=db,web
+//
+// The values of tags with the same key are joined by commas, while the
+// "name" tag is skipped as Graphite reserves it for the path.
+func (t *pathTemplate) appendTags(path string, tags map[string][]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		if !t.keys[key] && key != "name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(path)
+	for _, key := range keys {
+		sb.WriteString(";" + tagKeyEscaper.Replace(key) + "=" + sanitizeTagValue(strings.Join(tags[key], ",")))
+	}
+	return sb.String()
+}
+
+var (
+	tagKeyEscaper   = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_", "\n", "_")
+	tagValueEscaper = strings.NewReplacer(";", "_", " ", "_", "\n", "_")
+)
+
+// sanitizeTagValue replaces the characters not allowed in tag values, that
+// can't contain semicolons, spaces nor start with a tilde
+func sanitizeTagValue(v string) string {
+	v = tagValueEscaper.Replace(v)
+	if strings.HasPrefix(v, "~") {
+		v = "_" + v[1:]
+	}
+	return v
+}
+
+// sanitize replaces the characters that are not letters, digits, "_", "-"
+// or ":" with underscores. Dots are kept only when dots is true.
+func sanitize(s string, dots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == ':':
+			return r
+		case r == '.' && dots:
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,63 @@
+package graphite
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tmpl, err := parseTemplate("datadog.{env}.dc_{dc}.{host}.{metric}")
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"env": true, "dc": true, "host": true}, tmpl.keys)
+	require.Len(t, tmpl.nodes, 5)
+	require.Equal(t, []segment{{literal: "dc_"}, {key: "dc"}}, tmpl.nodes[2])
+
+	for template, msg := range map[string]string{
+		"{host}":         "the template must contain the {metric} placeholder",
+		"{host.{metric}": `unclosed placeholder in template "{host.{metric}"`,
+		"{}.{metric}":    `empty placeholder in template "{}.{metric}"`,
+		"":               "the template must contain the {metric} placeholder",
+	} {
+		_, err := parseTemplate(template)
+		require.EqualError(t, err, msg, template)
+	}
+}
+
+func TestRender(t *testing.T) {
+	m := &intake.V1Metric{
+		Metric: "system.disk.free",
+		Host:   "web-1.example.com",
+		Device: "/dev/sda1",
+		Tags:   []string{"env:prod", "role:web", "role:db", "canary"},
+	}
+	tags := getTags(m, "acme")
+	require.Equal(t, map[string][]string{
+		"env":    {"prod"},
+		"role":   {"db", "web"},
+		"canary": {"true"},
+		"host":   {"web-1.example.com"},
+		"device": {"/dev/sda1"},
+		"tenant": {"acme"},
+	}, tags)
+
+	tmpl, err := parseTemplate("{host}.{metric}")
+	require.Nil(t, err)
+	require.Equal(t, "web-1_example_com.system.disk.free", tmpl.render(m, tags))
+
+	// nodes whose placeholders are all missing are skipped
+	tmpl, err = parseTemplate("dd.{tenant}.{region}.{role}.{metric}.{device}")
+	require.Nil(t, err)
+	require.Equal(t, "dd.acme.db_web.system.disk.free._dev_sda1", tmpl.render(m, tags))
+
+	// the tags used by the template are not repeated
+	require.Equal(t, "path;canary=true;env=prod;host=web-1.example.com",
+		tmpl.appendTags("path", tags))
+}
+
+func TestSanitize(t *testing.T) {
+	require.Equal(t, "a_b-c:d_e", sanitize("a b-c:d.e", false))
+	require.Equal(t, "a_b-c:d.e", sanitize("a b-c:d.e", true))
+	require.Equal(t, "_home_a_b", sanitizeTagValue("~home;a b"))
+}
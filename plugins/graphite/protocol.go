@@ -0,0 +1,85 @@
+package graphite
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// point is a sample ready to be sent to Graphite
+type point struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// encodePlaintext encodes the points with the plaintext protocol, one line
+// per point:
+//
+//	system.load.1 0.5 1612906502
+func encodePlaintext(points []point) []byte {
+	var b []byte
+	for _, p := range points {
+		b = append(b, p.path...)
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, p.value, 'g', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, p.timestamp, 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// Opcodes of the pickle protocol 2
+const (
+	pickleProto     = 0x80
+	pickleEmptyList = ']'
+	pickleMark      = '('
+	pickleAppends   = 'e'
+	pickleUnicode   = 'X'
+	pickleBinInt    = 'J'
+	pickleBinFloat  = 'G'
+	pickleTuple2    = 0x86
+	pickleStop      = '.'
+)
+
+// encodePickle encodes the points with the pickle protocol, as a list of
+// (path, (timestamp, value)) tuples prefixed by its length as a 4 bytes big
+// endian integer
+func encodePickle(points []point) []byte {
+	b := make([]byte, 4, 4+len(points)*64)
+	b = append(b, pickleProto, 2, pickleEmptyList, pickleMark)
+	for _, p := range points {
+		b = append(b, pickleUnicode)
+		b = appendUint32(b, uint32(len(p.path)))
+		b = append(b, p.path...)
+
+		if p.timestamp >= math.MinInt32 && p.timestamp <= math.MaxInt32 {
+			b = append(b, pickleBinInt)
+			b = appendUint32(b, uint32(int32(p.timestamp)))
+		} else {
+			b = append(b, pickleBinFloat)
+			b = appendFloat64(b, float64(p.timestamp))
+		}
+		b = append(b, pickleBinFloat)
+		b = appendFloat64(b, p.value)
+		b = append(b, pickleTuple2, pickleTuple2)
+	}
+	b = append(b, pickleAppends, pickleStop)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+// appendUint32 appends v as a 4 bytes little endian integer
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendFloat64 appends v as a 8 bytes big endian double, as BINFLOAT expects
+func appendFloat64(b []byte, v float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,352 @@
+// Package influxdb writes the metrics to InfluxDB using the line protocol
+// and the v2 HTTP write API.
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	plugins.Register("influxdb", New,
+		plugins.Option{Name: "url", Type: "string", Default: "http://localhost:8086", Description: "URL of the InfluxDB server"},
+		plugins.Option{Name: "org", Type: "string", Description: "organization owning the bucket"},
+		plugins.Option{Name: "bucket", Type: "string", Description: "bucket storing the metrics"},
+		plugins.Option{Name: "token", Type: "string", Description: "API token allowed to write to the bucket"},
+		plugins.Option{Name: "file", Type: "string", Description: "write the line protocol to a file, or to stdout, instead of InfluxDB"},
+		plugins.Option{Name: "gzip", Type: "bool", Default: true, Description: "compress the requests"},
+		plugins.Option{Name: "flush_interval", Type: "duration", Default: "10s", Description: "how often the metrics are written"},
+		plugins.Option{Name: "max_batch_size", Type: "int", Default: 5000, Description: "lines written in a single request"},
+		plugins.Option{Name: "max_retries", Type: "int", Default: 3, Description: "retries when InfluxDB fails with a 5xx or 429"},
+		plugins.Option{Name: "retry_backoff", Type: "duration", Default: "1s", Description: "wait before the first retry, doubled at each retry"},
+		plugins.Option{Name: "timeout", Type: "duration", Default: "30s", Description: "timeout of each request"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only write the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics written by this output"},
+	)
+}
+
+// Plugin implements plugins.Plugin
+type Plugin struct {
+	plugins.Batcher
+
+	cfg *viper.Viper
+
+	// out receives the line protocol in file mode, closed once the run
+	// writing to it is over
+	out io.WriteCloser
+
+	// lines holds the line protocol waiting to be written
+	mu    sync.Mutex
+	lines []string
+}
+
+// New creates an influxdb plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
+
+// Start subscribes to the metrics and starts writing them periodically
+func (p *Plugin) Start(b *intake.PubSub) error {
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are written
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics written by this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var out io.WriteCloser
+	if file := p.cfg.GetString("file"); file != "" {
+		if out, err = openFile(file); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	flush := func(ctx context.Context) (bool, error) {
+		return p.flush(ctx, client, out)
+	}
+	if err := p.Batcher.Start(b, p.cfg.GetDuration("flush_interval"), flush); err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return err
+	}
+	// the previous run is over, including when it didn't stop in time
+	p.closeOutput()
+	p.out = out
+	p.mu.Lock()
+	p.lines = nil
+	p.mu.Unlock()
+
+	if out != nil {
+		output.INFO.Println("Writing line protocol to:", p.cfg.GetString("file"))
+	} else {
+		output.INFO.Printf("Writing metrics to bucket %s at %s", p.cfg.GetString("bucket"), p.cfg.GetString("url"))
+	}
+
+	p.Subscribe(intake.SeriesEndpointV1, opts, func(msg *intake.Message) bool {
+		metrics, err := msg.V1Metrics()
+		if err != nil {
+			output.ERROR.Println("error processing metrics: ", err)
+			return false
+		}
+		return p.add(msg.Tenant, chain.Process(filter.Process(metrics)))
+	})
+
+	return nil
+}
+
+// Stop unsubscribes from the broker and writes the pending metrics
+func (p *Plugin) Stop(ctx context.Context) error {
+	if err := p.Batcher.Stop(ctx); err != nil {
+		return err
+	}
+	return p.closeOutput()
+}
+
+// Check verifies that the bucket exists and the token can access it, or
+// that the file can be written in file mode
+func (p *Plugin) Check(ctx context.Context) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if file := p.cfg.GetString("file"); file != "" {
+		f, err := openFile(file)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	query := url.Values{"org": {p.cfg.GetString("org")}, "name": {p.cfg.GetString("bucket")}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint("/api/v2/buckets", query), nil)
+	if err != nil {
+		return err
+	}
+	p.setHeaders(req)
+
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	var buckets struct {
+		Buckets []json.RawMessage `json:"buckets"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&buckets); err != nil {
+		return fmt.Errorf("unexpected response from influxdb: %w", err)
+	}
+	if len(buckets.Buckets) == 0 {
+		return fmt.Errorf("bucket %s not found", p.cfg.GetString("bucket"))
+	}
+	return nil
+}
+
+// validate checks the settings needed to write to InfluxDB are there
+func (p *Plugin) validate() error {
+	if p.cfg.GetString("file") != "" {
+		return nil
+	}
+	for _, key := range []string{"url", "org", "bucket"} {
+		if p.cfg.GetString(key) == "" {
+			return fmt.Errorf("%s must be set", key)
+		}
+	}
+	return nil
+}
+
+// add converts the metrics to line protocol, it returns true when the batch
+// is full and should be written
+func (p *Plugin) add(tenant string, metrics []intake.V1Metric) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range metrics {
+		p.lines = append(p.lines, toLines(&metrics[i], tenant)...)
+	}
+	return len(p.lines) >= p.cfg.GetInt("max_batch_size")
+}
+
+// flush writes the pending lines, in batches of at most max_batch_size lines.
+// The lines of a batch that failed after all the retries are dropped.
+func (p *Plugin) flush(ctx context.Context, client *http.Client, out io.Writer) (bool, error) {
+	p.mu.Lock()
+	lines := p.lines
+	p.lines = nil
+	p.mu.Unlock()
+
+	if len(lines) == 0 {
+		return false, nil
+	}
+
+	var lastErr error
+	size := p.cfg.GetInt("max_batch_size")
+	if size <= 0 {
+		size = len(lines)
+	}
+	for start := 0; start < len(lines); start += size {
+		end := start + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if err := p.write(ctx, client, out, lines[start:end]); err != nil {
+			output.ERROR.Printf("Error writing metrics: %s", err)
+			lastErr = err
+		}
+	}
+	return true, lastErr
+}
+
+// write writes a batch of lines to out in file mode or to InfluxDB, retrying
+// when InfluxDB fails with a 5xx or a 429, or can't be reached
+func (p *Plugin) write(ctx context.Context, client *http.Client, out io.Writer, lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	if out != nil {
+		_, err := out.Write(body)
+		return err
+	}
+
+	if p.cfg.GetBool("gzip") {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	return plugins.Retry(ctx, p.cfg.GetInt("max_retries"), p.cfg.GetDuration("retry_backoff"), func() (bool, error) {
+		return p.post(ctx, client, body)
+	})
+}
+
+// post sends a single write request, returning whether it can be retried
+// along with the error
+func (p *Plugin) post(ctx context.Context, client *http.Client, body []byte) (bool, error) {
+	query := url.Values{
+		"org":       {p.cfg.GetString("org")},
+		"bucket":    {p.cfg.GetString("bucket")},
+		"precision": {"ns"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint("/api/v2/write", query), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	p.setHeaders(req)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.cfg.GetBool("gzip") {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		return false, nil
+	}
+	return res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests, responseError(res)
+}
+
+// endpoint returns the URL of an API endpoint
+func (p *Plugin) endpoint(path string, query url.Values) string {
+	return strings.TrimSuffix(p.cfg.GetString("url"), "/") + path + "?" + query.Encode()
+}
+
+// setHeaders sets the headers common to every request
+func (p *Plugin) setHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", "threadle")
+	if token := p.cfg.GetString("token"); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+}
+
+// closeOutput closes the file written in file mode, if any
+func (p *Plugin) closeOutput() error {
+	if p.out == nil {
+		return nil
+	}
+	err := p.out.Close()
+	p.out = nil
+	return err
+}
+
+// responseError returns an error with the status and message of a response
+func responseError(res *http.Response) error {
+	err := fmt.Errorf("unexpected response from influxdb: %s", res.Status)
+	// InfluxDB reports errors as JSON, like {"code":"invalid","message":"..."}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+		return fmt.Errorf("%w: %s", err, msg.Message)
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(body))
+	}
+	return err
+}
+
+// nopCloser doesn't close stdout when the plugin is stopped
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openFile opens the file the line protocol is appended to, stdout is used
+// when the name is "stdout" or "-"
+func openFile(name string) (io.WriteCloser, error) {
+	if name == "stdout" || name == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the output file: %w", err)
+	}
+	return f, nil
+}
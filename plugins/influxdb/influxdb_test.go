@@ -0,0 +1,171 @@
+package influxdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/plugintest"
+	"github.com/stretchr/testify/require"
+)
+
+// newServer starts an InfluxDB write endpoint replying with the statuses in
+// order, then with 204
+func newServer(t *testing.T, statuses ...int) *plugintest.Server {
+	return plugintest.NewServer(t, func(w http.ResponseWriter, status int) {
+		if status == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":"internal error","message":"something went wrong"}`))
+	}, statuses...)
+}
+
+func newPlugin(t *testing.T, url string, settings map[string]interface{}) *Plugin {
+	return plugintest.NewPlugin(t, "influxdb", map[string]interface{}{
+		"url":           url,
+		"org":           "acme",
+		"bucket":        "metrics",
+		"token":         "secret",
+		"retry_backoff": "1ms",
+	}, settings).(*Plugin)
+}
+
+func TestInfluxDB(t *testing.T) {
+	srv := newServer(t)
+	p := newPlugin(t, srv.URL, map[string]interface{}{
+		"flush_interval":  "1h",
+		"exclude_metrics": []string{"^datadog"},
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "system.load.1", "type": "gauge", "host": "web-1", "tags": ["env:prod"], "points": [[1612906502, 0.5]]},
+		{"metric": "datadog.agent.running", "type": "gauge", "points": [[1612906502, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "app.requests", "type": "count", "tags": ["path:/"], "points": [[1612906502, 2], [1612906512, 3]]}
+	]}`)})
+
+	// the pending metrics are written when stopping
+	require.Nil(t, p.Stop(context.Background()))
+	require.Nil(t, p.Health())
+
+	requests, bodies := srv.Received()
+	require.Len(t, requests, 1)
+	require.Equal(t, "/api/v2/write", requests[0].URL.Path)
+	require.Equal(t, "bucket=metrics&org=acme&precision=ns", requests[0].URL.RawQuery)
+	require.Equal(t, "Token secret", requests[0].Header.Get("Authorization"))
+	require.Equal(t, "gzip", requests[0].Header.Get("Content-Encoding"))
+	require.Equal(t, `system.load.1,env=prod,host=web-1,tenant=prod value=0.5 1612906502000000000
+app.requests,path=/ value=2 1612906502000000000
+app.requests,path=/ value=3 1612906512000000000
+`, string(bodies[0]))
+}
+
+func TestInfluxDBBatches(t *testing.T) {
+	srv := newServer(t)
+	p := newPlugin(t, srv.URL, map[string]interface{}{
+		"flush_interval": "10ms",
+		"max_batch_size": 2,
+		"gzip":           false,
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	defer p.Stop(context.Background())
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "a", "points": [[1612906502, 1], [1612906512, 1]]},
+		{"metric": "b", "points": [[1612906502, 1]]}
+	]}`)})
+
+	require.Eventually(t, func() bool {
+		_, bodies := srv.Received()
+		return len(bodies) == 2
+	}, time.Second, 10*time.Millisecond)
+	requests, bodies := srv.Received()
+	require.Empty(t, requests[0].Header.Get("Content-Encoding"))
+	require.Equal(t, 2, strings.Count(string(bodies[0]), "\n"))
+	require.Equal(t, 1, strings.Count(string(bodies[1]), "\n"))
+}
+
+func TestInfluxDBRetries(t *testing.T) {
+	srv := newServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	p := newPlugin(t, srv.URL, map[string]interface{}{"flush_interval": "1h"})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906502, 1}}}})
+	require.Nil(t, p.Stop(context.Background()))
+	requests, _ := srv.Received()
+	require.Len(t, requests, 3)
+	require.Nil(t, p.Health())
+
+	// 4xx are not retried
+	srv = newServer(t, http.StatusBadRequest)
+	p = newPlugin(t, srv.URL, map[string]interface{}{"flush_interval": "1h"})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906502, 1}}}})
+	require.Nil(t, p.Stop(context.Background()))
+	requests, _ = srv.Received()
+	require.Len(t, requests, 1)
+	require.EqualError(t, p.Health(), "unexpected response from influxdb: 400 Bad Request: something went wrong")
+	select {
+	case err := <-p.Failures():
+		require.Error(t, err)
+	default:
+		require.Fail(t, "the failure was not reported")
+	}
+}
+
+func TestInfluxDBFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.txt")
+	p := newPlugin(t, "", map[string]interface{}{"file": file, "org": "", "bucket": ""})
+	require.Nil(t, p.Check(context.Background()))
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "a", "host": "web-1", "points": [[1612906502, 1]]}
+	]}`)})
+	require.Nil(t, p.Stop(context.Background()))
+
+	data, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	require.Equal(t, "a,host=web-1 value=1 1612906502000000000\n", string(data))
+}
+
+func TestCheck(t *testing.T) {
+	body := `{"buckets": [{"name": "metrics"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/buckets" || r.URL.RawQuery != "name=metrics&org=acme" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"unauthorized","message":"unauthorized access"}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := newPlugin(t, srv.URL, nil)
+	require.Nil(t, p.Check(context.Background()))
+
+	body = `{"buckets": []}`
+	require.EqualError(t, p.Check(context.Background()), "bucket metrics not found")
+
+	p = newPlugin(t, srv.URL, map[string]interface{}{"token": "wrong"})
+	require.EqualError(t, p.Check(context.Background()), "unexpected response from influxdb: 401 Unauthorized: unauthorized access")
+
+	p = newPlugin(t, srv.URL, map[string]interface{}{"bucket": ""})
+	require.EqualError(t, p.Check(context.Background()), "bucket must be set")
+	require.EqualError(t, p.Start(intake.NewPubsub()), "invalid configuration: bucket must be set")
+}
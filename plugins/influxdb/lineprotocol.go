@@ -0,0 +1,61 @@
+package influxdb
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/datadog"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+// getTags returns the tags of a metric in the key=value form, sorted by key
+// as recommended by InfluxDB. The host, device and tenant are added as tags,
+// unless a tag with the same key is already there. Datadog tags are split as
+// described in datadog.SplitTag, while the values of tags with the same key
+// are joined by commas.
+func getTags(m *intake.V1Metric, tenant string) []string {
+	values := datadog.TagValues(m.Tags)
+	for key, value := range map[string]string{"host": m.Host, "device": m.Device, "tenant": tenant} {
+		if _, found := values[key]; !found && value != "" {
+			values[key] = []string{value}
+		}
+	}
+
+	tags := make([]string, 0, len(values))
+	for key, v := range values {
+		tags = append(tags, tagEscaper.Replace(key)+"="+tagEscaper.Replace(strings.Join(v, ",")))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// toLines converts the points of a metric into line protocol, using the
+// metric name as the measurement and the value as the "value" field:
+//
+//	system.load.1,env=prod,host=web-1 value=0.5 1612906502000000000
+//
+// Points with NaN or infinite values are skipped, as they're not supported.
+func toLines(m *intake.V1Metric, tenant string) []string {
+	var prefix strings.Builder
+	prefix.WriteString(measurementEscaper.Replace(m.Metric))
+	for _, tag := range getTags(m, tenant) {
+		prefix.WriteString("," + tag)
+	}
+	prefix.WriteString(" value=")
+
+	lines := make([]string, 0, len(m.Points))
+	for _, p := range m.Points {
+		if len(p) < 2 || math.IsNaN(p[1]) || math.IsInf(p[1], 0) {
+			continue
+		}
+		lines = append(lines, prefix.String()+strconv.FormatFloat(p[1], 'g', -1, 64)+" "+strconv.FormatInt(datadog.ToNanos(p[0]), 10))
+	}
+	return lines
+}
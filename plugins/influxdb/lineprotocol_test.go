@@ -0,0 +1,26 @@
+package influxdb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToLines(t *testing.T) {
+	m := intake.V1Metric{
+		Metric: "system.disk free",
+		Host:   "web-1",
+		Device: "/dev/sda1",
+		Tags:   []string{"env:prod", "role:web", "role:api", "ephemeral", "empty:", "path:/a b,c=d", "host:web-2"},
+		Points: []intake.Point{{1612906502, 0.5}, {1612906512.25, 1e6}, {1612906522, math.NaN()}, {1612906532}},
+	}
+	require.Equal(t, []string{
+		`system.disk\ free,device=/dev/sda1,env=prod,ephemeral=true,host=web-2,path=/a\ b\,c\=d,role=api\,web,tenant=prod value=0.5 1612906502000000000`,
+		`system.disk\ free,device=/dev/sda1,env=prod,ephemeral=true,host=web-2,path=/a\ b\,c\=d,role=api\,web,tenant=prod value=1e+06 1612906512250000000`,
+	}, toLines(&m, "prod"))
+
+	m = intake.V1Metric{Metric: "a,b", Points: []intake.Point{{1612906502, -1}}}
+	require.Equal(t, []string{`a\,b value=-1 1612906502000000000`}, toLines(&m, ""))
+}
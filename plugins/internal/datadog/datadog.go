@@ -0,0 +1,41 @@
+// Package datadog converts the tags and timestamps of the Datadog metrics
+// the same way for every output plugin.
+package datadog
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// SplitTag splits a tag on its first colon into a key and a value, so that
+// values can contain colons like URLs. Tags without a colon get the "true"
+// value, as most backends don't allow empty values, while tags with an empty
+// key or value, like "env:", are not valid and ok is false.
+func SplitTag(tag string) (key, value string, ok bool) {
+	key, value = tag, "true"
+	if i := strings.Index(tag, ":"); i >= 0 {
+		key, value = tag[:i], tag[i+1:]
+	}
+	return key, value, key != "" && value != ""
+}
+
+// TagValues returns the values of the valid tags by key, sorted
+func TagValues(tags []string) map[string][]string {
+	values := map[string][]string{}
+	for _, tag := range tags {
+		if key, value, ok := SplitTag(tag); ok {
+			values[key] = append(values[key], value)
+		}
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	return values
+}
+
+// ToNanos converts a timestamp in seconds to nanoseconds, with microsecond
+// precision to avoid rounding errors
+func ToNanos(ts float64) int64 {
+	return int64(math.Round(ts*1e6)) * 1000
+}
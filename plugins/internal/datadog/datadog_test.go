@@ -0,0 +1,41 @@
+package datadog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitTag(t *testing.T) {
+	testcases := []struct {
+		tag, key, value string
+		ok              bool
+	}{
+		{"env:prod", "env", "prod", true},
+		{"url:http://localhost:8080", "url", "http://localhost:8080", true},
+		{"canary", "canary", "true", true},
+		{"env:", "env", "", false},
+		{":prod", "", "prod", false},
+		{"", "", "true", false},
+	}
+	for _, tc := range testcases {
+		key, value, ok := SplitTag(tc.tag)
+		require.Equal(t, tc.key, key, tc.tag)
+		require.Equal(t, tc.value, value, tc.tag)
+		require.Equal(t, tc.ok, ok, tc.tag)
+	}
+}
+
+func TestTagValues(t *testing.T) {
+	require.Equal(t, map[string][]string{
+		"env":    {"prod"},
+		"role":   {"db", "web"},
+		"canary": {"true"},
+	}, TagValues([]string{"env:prod", "role:web", "role:db", "canary", "team:"}))
+}
+
+func TestToNanos(t *testing.T) {
+	require.Equal(t, int64(1612906502000000000), ToNanos(1612906502))
+	require.Equal(t, int64(1612906502123456000), ToNanos(1612906502.123456))
+	require.Equal(t, int64(0), ToNanos(0))
+}
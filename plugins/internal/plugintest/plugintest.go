@@ -0,0 +1,128 @@
+// Package plugintest provides the fixtures shared by the tests of the output
+// plugins.
+package plugintest
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/masci/threadle/internal/protowalk"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/spf13/viper"
+)
+
+// NewPlugin creates an instance of a registered plugin with logging turned
+// off, the settings are applied in order so later ones take precedence
+func NewPlugin(t *testing.T, name string, settings ...map[string]interface{}) plugins.Plugin {
+	t.Helper()
+	output.Init(0)
+	cfg := viper.New()
+	for _, s := range settings {
+		for k, v := range s {
+			cfg.Set(k, v)
+		}
+	}
+	r, found := plugins.Lookup(name)
+	if !found {
+		t.Fatalf("plugin %s not registered", name)
+	}
+	return r.New(cfg)
+}
+
+// Reply writes the response to a request, status is the next of the
+// statuses the Server was created with, or 0 once they're used up
+type Reply func(w http.ResponseWriter, status int)
+
+// Server is an HTTP endpoint recording the requests along with their bodies,
+// decompressed according to their Content-Encoding
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int
+}
+
+// NewServer starts a Server replying to the requests with the statuses in
+// order, then with 204. When reply is set it writes the responses instead.
+// The Server is closed at the end of the test.
+func NewServer(t *testing.T, reply Reply, statuses ...int) *Server {
+	s := &Server{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			// the handler doesn't run in the test goroutine, it can't fail it
+			t.Errorf("error reading the request body: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		status := 0
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		switch {
+		case reply != nil:
+			reply(w, status)
+		case status != 0:
+			w.WriteHeader(status)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Received returns the requests received so far and their bodies
+func (s *Server) Received() ([]*http.Request, [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...), append([][]byte(nil), s.bodies...)
+}
+
+// readBody reads and decompresses the body of a request
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header.Get("Content-Encoding") == "snappy" {
+		return snappy.Decode(nil, data)
+	}
+	return data, nil
+}
+
+// RangeFields calls fn for each field of a protobuf encoded message, failing
+// the test when the message is malformed
+func RangeFields(t *testing.T, b []byte, fn func(f *protowalk.Field)) {
+	t.Helper()
+	err := protowalk.Range(b, func(f *protowalk.Field) error {
+		fn(f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error decoding the message: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Package promlabels converts the Datadog metrics into Prometheus series names
+// and labels, shared by the Prometheus exporter and remote write plugins.
+package promlabels
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins/internal/datadog"
+)
+
+// Label is a Prometheus label
+type Label struct {
+	Name  string
+	Value string
+}
+
+// SanitizeName turns a Datadog metric name or tag key into a valid Prometheus
+// name, replacing the invalid characters with underscores. Colons are only
+// allowed in metric names.
+func SanitizeName(name string, colons bool) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		case r == ':' && colons:
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// MetricName returns the name of the Prometheus series of a metric, counts
+// get the _total suffix of counters
+func MetricName(m *intake.V1Metric) string {
+	name := SanitizeName(m.Metric, true)
+	if m.Type == "count" {
+		name += "_total"
+	}
+	return name
+}
+
+// Labels converts the host, device and tags of a metric into labels, sorted
+// by name along with the __name__ label. Datadog tags are split as described
+// in datadog.SplitTag, while the values of tags with the same key are joined
+// by commas.
+func Labels(name string, m *intake.V1Metric) []Label {
+	values := map[string][]string{}
+	for _, tag := range m.Tags {
+		key, value, ok := datadog.SplitTag(tag)
+		if !ok {
+			continue
+		}
+		key = SanitizeName(key, false)
+		// names starting with __ are reserved for internal use
+		if strings.HasPrefix(key, "__") {
+			key = "tag" + key
+		}
+		values[key] = append(values[key], value)
+	}
+	if _, found := values["host"]; !found && m.Host != "" {
+		values["host"] = []string{m.Host}
+	}
+	if _, found := values["device"]; !found && m.Device != "" {
+		values["device"] = []string{m.Device}
+	}
+
+	labels := []Label{{Name: "__name__", Value: name}}
+	for key, v := range values {
+		sort.Strings(v)
+		labels = append(labels, Label{Name: key, Value: strings.Join(v, ",")})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// SeriesKey identifies a series by its labels
+func SeriesKey(labels []Label) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
@@ -0,0 +1,55 @@
+package promlabels
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeName(t *testing.T) {
+	testcases := []struct {
+		name   string
+		colons bool
+		want   string
+	}{
+		{"system.cpu.user", true, "system_cpu_user"},
+		{"app:requests-total", true, "app:requests_total"},
+		{"app:requests", false, "app_requests"},
+		{"9gag.visits", true, "_9gag_visits"},
+		{"kube_node", false, "kube_node"},
+		{"città", false, "citt_"},
+	}
+	for _, tc := range testcases {
+		require.Equal(t, tc.want, SanitizeName(tc.name, tc.colons), tc.name)
+	}
+}
+
+func TestGetLabels(t *testing.T) {
+	m := intake.V1Metric{
+		Metric: "system.disk.free",
+		Host:   "web-1",
+		Device: "/dev/sda1",
+		Tags:   []string{"env:prod", "role:web", "role:api", "ephemeral", "kube.namespace:default", "__name__:foo", "url:http://localhost", "team:"},
+	}
+	require.Equal(t, []Label{
+		{"__name__", "system_disk_free"},
+		{"device", "/dev/sda1"},
+		{"env", "prod"},
+		{"ephemeral", "true"},
+		{"host", "web-1"},
+		{"kube_namespace", "default"},
+		{"role", "api,web"},
+		{"tag__name__", "foo"},
+		{"url", "http://localhost"},
+	}, Labels(MetricName(&m), &m))
+
+	// tags take precedence over the host
+	m = intake.V1Metric{Host: "web-1", Tags: []string{"host:web-2"}}
+	require.Equal(t, []Label{{"__name__", "foo"}, {"host", "web-2"}}, Labels("foo", &m))
+}
+
+func TestMetricName(t *testing.T) {
+	require.Equal(t, "app_requests", MetricName(&intake.V1Metric{Metric: "app.requests", Type: "rate"}))
+	require.Equal(t, "app_requests_total", MetricName(&intake.V1Metric{Metric: "app.requests", Type: "count"}))
+}
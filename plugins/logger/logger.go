@@ -1,48 +1,103 @@
 package logger
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/plugins"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-var (
-	broker *intake.PubSub
-	logger zerolog.Logger
-)
+func init() {
+	plugins.Register("logger", New,
+		plugins.Option{Name: "ecs_compatible", Type: "bool", Default: false, Description: "make the log lines ECS compatible"},
+		plugins.Option{Name: "topics", Type: "[]string", Default: []string{"/**"}, Description: "topics to log, wildcards are supported"},
+	)
+}
 
 // Plugin implements plugins.Plugin
-type Plugin struct{}
+type Plugin struct {
+	cfg    *viper.Viper
+	logger zerolog.Logger
+	ecs    bool
+	broker *intake.PubSub
+	subs   []<-chan *intake.Message
+	wg     sync.WaitGroup
+}
+
+// New creates a logger plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
 
 // Start subscribes and processes the messages for the supported topics
-func (*Plugin) Start(b *intake.PubSub) {
-	broker = b
-
-	// Setup the logger
-	if viper.GetBool("plugins.logger.ecs_compatible") {
-		zerolog.TimeFieldFormat = time.RFC3339
-		zerolog.TimestampFieldName = "@timestamp"
-		zerolog.MessageFieldName = "message"
-		zerolog.LevelFieldName = "log.level"
-		log.Logger = log.With().Str("ecs.version", "1.6.0").Logger()
+func (p *Plugin) Start(b *intake.PubSub) error {
+	p.broker = b
+	p.subs = nil
+
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Setup the logger, ECS fields are added to each line rather than
+	// changing the zerolog globals so that other instances are not affected
+	p.ecs = p.cfg.GetBool("ecs_compatible")
+	if p.ecs {
+		p.logger = zerolog.New(os.Stderr).With().Str("ecs.version", "1.6.0").Logger()
+	} else {
+		p.logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	}
+
+	// Log all the topics unless configured otherwise
+	topics := p.cfg.GetStringSlice("topics")
+	if len(topics) == 0 {
+		topics = []string{"/**"}
 	}
+	for _, topic := range topics {
+		ch := b.SubscribeWithOptions(topic, opts)
+		p.subs = append(p.subs, ch)
+		p.wg.Add(1)
+		go p.process(ch)
+	}
+
+	return nil
+}
 
-	// Log all the /api/v1/* endpoints
-	for _, ep := range intake.GetV1Endpoints() {
-		process(ep)
+// Stop unsubscribes from the broker and waits for the pending messages to be logged
+func (p *Plugin) Stop(ctx context.Context) error {
+	for _, ch := range p.subs {
+		p.broker.Unsubscribe(ch)
 	}
-	// Log the /intake endpoint
-	process(intake.IntakeEndpointV1)
+	return plugins.Wait(ctx, &p.wg)
+}
+
+// Health always returns nil, logging can't fail
+func (p *Plugin) Health() error {
+	return nil
 }
 
 // process reads the message from the broker and logs to stderr
-func process(topic string) {
-	go func() {
-		for msg := range broker.Subscribe(topic) {
-			log.Info().Str("topic", topic).RawJSON("message", msg).Msg("")
+func (p *Plugin) process(ch <-chan *intake.Message) {
+	defer p.wg.Done()
+
+	for msg := range ch {
+		var event *zerolog.Event
+		if p.ecs {
+			event = p.logger.Log().Str("@timestamp", time.Now().Format(time.RFC3339)).Str("log.level", "info")
+		} else {
+			event = p.logger.Info()
 		}
-	}()
+		event = event.Str("topic", msg.Topic).Str("endpoint", msg.Endpoint).Str("remote_addr", msg.RemoteAddr)
+		if msg.Tenant != "" {
+			event = event.Str("tenant", msg.Tenant)
+		}
+		event.RawJSON("message", msg.Body).Msg("")
+	}
 }
@@ -0,0 +1,219 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+)
+
+// managed is a running plugin instance
+type managed struct {
+	inst     Instance
+	settings map[string]interface{}
+	plugin   Plugin
+}
+
+// Manager runs the configured plugin instances and applies the changes to
+// the configuration without interrupting the other instances
+type Manager struct {
+	// StopTimeout bounds how long an instance removed from the config is
+	// given to process the messages already received
+	StopTimeout time.Duration
+
+	broker *intake.PubSub
+
+	// applyMu serializes Apply and Stop, that register the health checks
+	// after releasing mu as the health endpoint runs them, calling Health
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	running map[string]*managed
+}
+
+// NewManager returns a Manager subscribing the plugins to the broker
+func NewManager(b *intake.PubSub) *Manager {
+	return &Manager{
+		StopTimeout: 30 * time.Second,
+		broker:      b,
+		running:     map[string]*managed{},
+	}
+}
+
+// Apply starts, stops and restarts the plugins so that the running instances
+// match the configured ones. An instance whose settings changed is replaced by
+// starting the new one first, then stopping the old one once it has processed
+// the messages already buffered, so that no message is lost. When the new
+// instance fails to start, the old one is kept running.
+//
+// While an instance is replaced both the old and the new one are subscribed
+// for a short time, so the few messages published meanwhile are processed
+// twice, for example indexed twice by Elasticsearch. Apply doesn't wait for
+// the old instances to stop while holding the lock, so that Running and Health
+// can be called in the meantime, while Stop waits for Apply to return.
+func (m *Manager) Apply(instances []Instance) {
+	// old instances are stopped outside the lock, with the message to log
+	// once they're done
+	type stopping struct {
+		mp  *managed
+		msg string
+	}
+	var stops []stopping
+	// health checks to register once mu is released, nil ones are removed
+	checks := map[string]func() error{}
+
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	m.mu.Lock()
+	configured := map[string]bool{}
+	for _, inst := range instances {
+		configured[inst.Name] = true
+		settings := inst.Config.AllSettings()
+
+		old, found := m.running[inst.Name]
+		if found && old.inst.Type == inst.Type && reflect.DeepEqual(old.settings, settings) {
+			continue
+		}
+
+		p, err := m.start(inst)
+		if err != nil {
+			output.ERROR.Printf("Plugin %s failed to initialize, skipping: %s", inst.Name, err)
+			continue
+		}
+		m.running[inst.Name] = &managed{inst: inst, settings: settings, plugin: p}
+		checks[inst.Name] = p.Health
+
+		if !found {
+			output.INFO.Printf("Plugin started: %s (%s)", inst.Name, inst.Type)
+			continue
+		}
+		msg := fmt.Sprintf("Plugin %s restarted, changed options: %s", inst.Name, strings.Join(changedKeys(old.settings, settings), ", "))
+		if old.inst.Type != inst.Type {
+			msg = fmt.Sprintf("Plugin %s restarted, type changed: %s -> %s", inst.Name, old.inst.Type, inst.Type)
+		}
+		stops = append(stops, stopping{old, msg})
+	}
+
+	for name, old := range m.running {
+		if configured[name] {
+			continue
+		}
+		checks[name] = nil
+		delete(m.running, name)
+		stops = append(stops, stopping{old, fmt.Sprintf("Plugin stopped: %s (%s)", name, old.inst.Type)})
+	}
+	m.mu.Unlock()
+
+	for name, check := range checks {
+		intake.RegisterHealthCheck(name, check)
+	}
+	for _, s := range stops {
+		m.stop(s.mp)
+		output.INFO.Println(s.msg)
+	}
+}
+
+// Running returns the names of the running instances, sorted
+func (m *Manager) Running() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.running))
+	for name := range m.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Health returns an error when no instance is running, as every message
+// sent by the Datadog Agent would be discarded
+func (m *Manager) Health() error {
+	if len(m.Running()) == 0 {
+		return errors.New("no plugins running, the data sent by the Datadog Agent is discarded")
+	}
+	return nil
+}
+
+// Stop stops all the running instances concurrently, waiting until they're
+// done or the context expires
+func (m *Manager) Stop(ctx context.Context) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	m.mu.Lock()
+	running := m.running
+	m.running = map[string]*managed{}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, mp := range running {
+		wg.Add(1)
+		go func(name string, p Plugin) {
+			defer wg.Done()
+			if err := p.Stop(ctx); err != nil {
+				output.ERROR.Printf("Plugin %s didn't stop cleanly: %s", name, err)
+				return
+			}
+			output.DEBUG.Println("Plugin stopped:", name)
+		}(name, mp.plugin)
+		intake.RegisterHealthCheck(name, nil)
+	}
+	wg.Wait()
+}
+
+// start creates and starts a plugin instance, supervised if configured
+func (m *Manager) start(inst Instance) (Plugin, error) {
+	p, err := NewInstance(inst)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restart the plugin when it fails at runtime, if configured. A failed
+	// plugin is given as long to stop as one removed from the config, as it
+	// might be in the middle of a flush retrying a slow output.
+	if inst.Config.GetBool("restart") {
+		s := NewSupervisor(inst.Name, p, inst.Config.GetDuration("max_backoff"))
+		s.StopTimeout = m.StopTimeout
+		p = s
+	}
+
+	if err := p.Start(m.broker); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// stop stops an instance waiting at most StopTimeout
+func (m *Manager) stop(mp *managed) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.StopTimeout)
+	defer cancel()
+	if err := mp.plugin.Stop(ctx); err != nil {
+		output.ERROR.Printf("Plugin %s didn't stop cleanly: %s", mp.inst.Name, err)
+	}
+}
+
+// changedKeys returns the names of the settings added, removed or changed,
+// values are not returned as they might contain secrets
+func changedKeys(old, new map[string]interface{}) []string {
+	keys := []string{}
+	for k, v := range new {
+		if ov, found := old[k]; !found || !reflect.DeepEqual(ov, v) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range old {
+		if _, found := new[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
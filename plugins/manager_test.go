@@ -0,0 +1,174 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	managerPlugins   []*fakePlugin
+	managerPluginsMu sync.Mutex
+)
+
+func init() {
+	Register("test_manager", func(cfg *viper.Viper) Plugin {
+		p := &fakePlugin{}
+		if cfg.GetBool("fail") {
+			p.startErr = errors.New("boom")
+		}
+		p.hang = cfg.GetBool("hang")
+		managerPluginsMu.Lock()
+		managerPlugins = append(managerPlugins, p)
+		managerPluginsMu.Unlock()
+		return p
+	})
+}
+
+func newTestInstance(name string, settings map[string]interface{}) Instance {
+	return newInstance("test_manager", name, settings)
+}
+
+func TestManagerApply(t *testing.T) {
+	output.Init(0)
+	managerPlugins = nil
+
+	m := NewManager(intake.NewPubsub())
+	m.Apply([]Instance{
+		newTestInstance("a", nil),
+		newTestInstance("b", map[string]interface{}{"index": "foo"}),
+	})
+	require.Equal(t, []string{"a", "b"}, m.Running())
+	require.Len(t, managerPlugins, 2)
+
+	// unchanged instances are left alone, changed ones are replaced
+	m.Apply([]Instance{
+		newTestInstance("a", nil),
+		newTestInstance("b", map[string]interface{}{"index": "bar"}),
+		newTestInstance("c", nil),
+	})
+	require.Equal(t, []string{"a", "b", "c"}, m.Running())
+	require.Len(t, managerPlugins, 4)
+	_, stops := managerPlugins[0].counts()
+	require.Equal(t, 0, stops)
+	_, stops = managerPlugins[1].counts()
+	require.Equal(t, 1, stops)
+
+	// the old instance is kept when the new one can't start
+	m.Apply([]Instance{
+		newTestInstance("a", map[string]interface{}{"fail": true}),
+		newTestInstance("b", map[string]interface{}{"index": "bar"}),
+	})
+	require.Equal(t, []string{"a", "b"}, m.Running())
+	_, stops = managerPlugins[0].counts()
+	require.Equal(t, 0, stops)
+	_, stops = managerPlugins[3].counts()
+	require.Equal(t, 1, stops, "removed instances are stopped")
+
+	require.Nil(t, m.Health())
+
+	m.Stop(context.Background())
+	require.Empty(t, m.Running())
+	require.Error(t, m.Health())
+	for _, i := range []int{0, 2} {
+		_, stops = managerPlugins[i].counts()
+		require.Equal(t, 1, stops)
+	}
+}
+
+func TestManagerApplySlowStop(t *testing.T) {
+	output.Init(0)
+	managerPluginsMu.Lock()
+	managerPlugins = nil
+	managerPluginsMu.Unlock()
+
+	m := NewManager(intake.NewPubsub())
+	m.StopTimeout = 200 * time.Millisecond
+	m.Apply([]Instance{newTestInstance("a", map[string]interface{}{"hang": true})})
+
+	done := make(chan struct{})
+	go func() {
+		m.Apply([]Instance{newTestInstance("a", nil)})
+		close(done)
+	}()
+
+	// the old instance takes StopTimeout to stop, the manager can be used meanwhile
+	managerPluginsMu.Lock()
+	old := managerPlugins[0]
+	managerPluginsMu.Unlock()
+	require.Eventually(t, func() bool {
+		_, stops := old.counts()
+		return stops == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"a"}, m.Running())
+	select {
+	case <-done:
+		t.Fatal("Apply returned before the old instance stopped")
+	default:
+	}
+
+	<-done
+	m.Stop(context.Background())
+}
+
+func TestManagerApplyHealthProbe(t *testing.T) {
+	output.Init(0)
+	m := NewManager(intake.NewPubsub())
+	intake.RegisterHealthCheck("plugins", m.Health)
+	defer intake.RegisterHealthCheck("plugins", nil)
+
+	// probe the health endpoint while the instances are replaced
+	done := make(chan struct{})
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			intake.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", intake.HealthEndpoint, nil))
+		}
+	}()
+
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		for i := 0; i < 100; i++ {
+			m.Apply([]Instance{newTestInstance("a", map[string]interface{}{"index": i})})
+		}
+		m.Stop(context.Background())
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Apply blocked by the health endpoint")
+	}
+	close(done)
+	<-probed
+}
+
+func TestManagerNothingStarted(t *testing.T) {
+	output.Init(0)
+
+	// the configuration is valid but the only plugin fails to start
+	m := NewManager(intake.NewPubsub())
+	m.Apply([]Instance{newTestInstance("a", map[string]interface{}{"fail": true})})
+	require.Empty(t, m.Running())
+	require.EqualError(t, m.Health(), "no plugins running, the data sent by the Datadog Agent is discarded")
+}
+
+func TestChangedKeys(t *testing.T) {
+	old := map[string]interface{}{"index": "foo", "username": "bar", "topics": []string{"/a"}}
+	new := map[string]interface{}{"index": "foo", "password": "secret", "topics": []string{"/b"}}
+	require.Equal(t, []string{"password", "topics", "username"}, changedKeys(old, new))
+}
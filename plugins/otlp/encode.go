@@ -0,0 +1,182 @@
+package otlp
+
+import (
+	"math"
+
+	"github.com/masci/threadle/internal/protowalk"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// scopeName is the name of the instrumentation scope of the metrics
+	scopeName = "threadle"
+	// temporalityDelta is the value of AGGREGATION_TEMPORALITY_DELTA
+	temporalityDelta = 1
+)
+
+// keyValue is an attribute with a string value
+type keyValue struct {
+	Key   string
+	Value string
+}
+
+// dataPoint is a NumberDataPoint, times are in nanoseconds
+type dataPoint struct {
+	Attributes []keyValue
+	Start      uint64
+	Time       uint64
+	Value      float64
+}
+
+// metric is a gauge or a delta sum
+type metric struct {
+	Name      string
+	Unit      string
+	Sum       bool
+	Monotonic bool
+	Points    []dataPoint
+}
+
+// resourceMetrics groups the metrics of a resource, like a host
+type resourceMetrics struct {
+	Attributes []keyValue
+	Metrics    []*metric
+}
+
+// encodeRequest encodes an ExportMetricsServiceRequest protobuf message, as
+// defined in https://github.com/open-telemetry/opentelemetry-proto:
+//
+//	ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	Resource { repeated KeyValue attributes = 1; }
+//	ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//	InstrumentationScope { string name = 1; }
+func encodeRequest(resources []*resourceMetrics) []byte {
+	var b []byte
+	for _, rm := range resources {
+		var resource []byte
+		for _, kv := range rm.Attributes {
+			resource = appendMessage(resource, 1, encodeKeyValue(kv))
+		}
+
+		var is []byte
+		is = protowire.AppendTag(is, 1, protowire.BytesType)
+		is = protowire.AppendString(is, scopeName)
+
+		var scope []byte
+		scope = appendMessage(scope, 1, is)
+		for _, m := range rm.Metrics {
+			scope = appendMessage(scope, 2, encodeMetric(m))
+		}
+
+		var rmb []byte
+		rmb = appendMessage(rmb, 1, resource)
+		rmb = appendMessage(rmb, 2, scope)
+		b = appendMessage(b, 1, rmb)
+	}
+	return b
+}
+
+// encodeMetric encodes a Metric message:
+//
+//	Metric { string name = 1; string unit = 3; Gauge gauge = 5; Sum sum = 7; }
+//	Gauge { repeated NumberDataPoint data_points = 1; }
+//	Sum {
+//	  repeated NumberDataPoint data_points = 1;
+//	  AggregationTemporality aggregation_temporality = 2;
+//	  bool is_monotonic = 3;
+//	}
+func encodeMetric(m *metric) []byte {
+	var data []byte
+	for _, p := range m.Points {
+		data = appendMessage(data, 1, encodeDataPoint(p))
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.Name)
+	if m.Unit != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, m.Unit)
+	}
+	if !m.Sum {
+		return appendMessage(b, 5, data)
+	}
+	data = protowire.AppendTag(data, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, temporalityDelta)
+	if m.Monotonic {
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+	}
+	return appendMessage(b, 7, data)
+}
+
+// encodeDataPoint encodes a NumberDataPoint message:
+//
+//	NumberDataPoint {
+//	  repeated KeyValue attributes = 7;
+//	  fixed64 start_time_unix_nano = 2;
+//	  fixed64 time_unix_nano = 3;
+//	  double as_double = 4;
+//	}
+func encodeDataPoint(p dataPoint) []byte {
+	var b []byte
+	for _, kv := range p.Attributes {
+		b = appendMessage(b, 7, encodeKeyValue(kv))
+	}
+	if p.Start > 0 {
+		b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, p.Start)
+	}
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, p.Time)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(p.Value))
+	return b
+}
+
+// encodeKeyValue encodes a KeyValue message with a string value:
+//
+//	KeyValue { string key = 1; AnyValue value = 2; }
+//	AnyValue { string string_value = 1; }
+func encodeKeyValue(kv keyValue) []byte {
+	var value []byte
+	value = protowire.AppendTag(value, 1, protowire.BytesType)
+	value = protowire.AppendString(value, kv.Value)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, kv.Key)
+	return appendMessage(b, 2, value)
+}
+
+// appendMessage appends an embedded message as field num
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// decodePartialSuccess decodes the ExportMetricsServiceResponse message,
+// returning the number of data points rejected by the server and why:
+//
+//	ExportMetricsServiceResponse { ExportMetricsPartialSuccess partial_success = 1; }
+//	ExportMetricsPartialSuccess { int64 rejected_data_points = 1; string error_message = 2; }
+//
+// A malformed response is decoded as far as possible.
+func decodePartialSuccess(b []byte) (rejected int64, msg string) {
+	protowalk.Range(b, func(f *protowalk.Field) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		return protowalk.Range(f.Bytes, func(f *protowalk.Field) error {
+			switch {
+			case f.Num == 1 && f.Type == protowire.VarintType:
+				rejected = int64(f.Scalar)
+			case f.Num == 2 && f.Type == protowire.BytesType:
+				msg = string(f.Bytes)
+			}
+			return nil
+		})
+	})
+	return rejected, msg
+}
@@ -0,0 +1,427 @@
+// Package otlp exports the metrics to OpenTelemetry collectors, or any
+// backend supporting OTLP/HTTP with protobuf payloads.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/internal/protowalk"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/plugins/internal/datadog"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	plugins.Register("otlp", New,
+		plugins.Option{Name: "endpoint", Type: "string", Default: "http://localhost:4318/v1/metrics", Description: "URL of the OTLP/HTTP metrics endpoint"},
+		plugins.Option{Name: "headers", Type: "map", Description: "headers sent with each request, like API keys"},
+		plugins.Option{Name: "gzip", Type: "bool", Default: true, Description: "compress the requests"},
+		plugins.Option{Name: "flush_interval", Type: "duration", Default: "10s", Description: "how often the metrics are exported"},
+		plugins.Option{Name: "max_batch_size", Type: "int", Default: 5000, Description: "data points after which the metrics are exported right away"},
+		plugins.Option{Name: "monotonic_sums", Type: "bool", Default: false, Description: "flag the sums as monotonic, when the counts and rates never decrease"},
+		plugins.Option{Name: "max_retries", Type: "int", Default: 3, Description: "retries when the endpoint is unavailable"},
+		plugins.Option{Name: "retry_backoff", Type: "duration", Default: "1s", Description: "wait before the first retry, doubled at each retry"},
+		plugins.Option{Name: "timeout", Type: "duration", Default: "30s", Description: "timeout of each request"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only export the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics exported by this output"},
+	)
+}
+
+// hostInfo holds the host metadata sent by the Datadog Agent, mapped to the
+// OpenTelemetry semantic conventions
+type hostInfo struct {
+	id     string
+	osType string
+	arch   string
+}
+
+// batch holds the metrics waiting to be exported, grouped by resource
+type batch struct {
+	resources  []*resourceMetrics
+	byResource map[string]*resourceMetrics
+	byMetric   map[string]*metric
+	points     int
+}
+
+func newBatch() *batch {
+	return &batch{
+		byResource: map[string]*resourceMetrics{},
+		byMetric:   map[string]*metric{},
+	}
+}
+
+// Plugin implements plugins.Plugin
+type Plugin struct {
+	plugins.Batcher
+
+	cfg *viper.Viper
+
+	// pending holds the metrics waiting to be exported, hosts the metadata
+	// of the hosts keyed by hostname
+	mu      sync.Mutex
+	pending *batch
+	hosts   map[string]hostInfo
+}
+
+// New creates an otlp plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
+
+// Start subscribes to the metrics and the host metadata, and starts
+// exporting the metrics periodically
+func (p *Plugin) Start(b *intake.PubSub) error {
+	if p.cfg.GetString("endpoint") == "" {
+		return errors.New("invalid configuration: endpoint must be set")
+	}
+
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are exported
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics exported by this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	flush := func(ctx context.Context) (bool, error) {
+		return p.flush(ctx, client)
+	}
+	if err := p.Batcher.Start(b, p.cfg.GetDuration("flush_interval"), flush); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.pending = newBatch()
+	p.hosts = map[string]hostInfo{}
+	p.mu.Unlock()
+
+	output.INFO.Println("Exporting metrics to:", p.cfg.GetString("endpoint"))
+
+	// Subscribe to metrics messages
+	p.Subscribe(intake.SeriesEndpointV1, opts, func(msg *intake.Message) bool {
+		metrics, err := msg.V1Metrics()
+		if err != nil {
+			output.ERROR.Println("error processing metrics: ", err)
+			return false
+		}
+		return p.add(msg.Tenant, chain.Process(filter.Process(metrics)))
+	})
+
+	// Subscribe to host metadata messages, used for the resource attributes
+	p.Subscribe(intake.IntakeEndpointV1, opts, func(msg *intake.Message) bool {
+		hostMeta, err := msg.HostMeta()
+		if err != nil {
+			output.ERROR.Println("error processing host metadata: ", err)
+			return false
+		}
+		p.setHostMeta(hostMeta)
+		return false
+	})
+
+	return nil
+}
+
+// Check verifies that the endpoint accepts data by sending an empty request
+func (p *Plugin) Check(ctx context.Context) error {
+	if p.cfg.GetString("endpoint") == "" {
+		return errors.New("endpoint must be set")
+	}
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	return p.send(ctx, client, nil)
+}
+
+// setHostMeta records the metadata of a host
+func (p *Plugin) setHostMeta(hm *intake.HostMeta) {
+	hostname := hm.Meta.Hostname
+	if hostname == "" {
+		hostname = hm.InternalHostname
+	}
+	if hostname == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts[hostname] = hostInfo{
+		id:     hm.UUID,
+		osType: getOSType(hm.Os),
+		arch:   getHostArch(hm.SystemStats.Machine),
+	}
+}
+
+// add converts the metrics and adds them to the pending batch, it returns
+// true when the batch is full and should be exported
+func (p *Plugin) add(tenant string, metrics []intake.V1Metric) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range metrics {
+		m := &metrics[i]
+		rKey := tenant + "\x00" + m.Host
+		rm := p.pending.byResource[rKey]
+		if rm == nil {
+			rm = &resourceMetrics{Attributes: p.resourceAttributes(tenant, m.Host)}
+			p.pending.byResource[rKey] = rm
+			p.pending.resources = append(p.pending.resources, rm)
+		}
+
+		converted := convert(m, p.cfg.GetBool("monotonic_sums"))
+		if len(converted.Points) == 0 {
+			continue
+		}
+		mKey := fmt.Sprintf("%s\x00%s\x00%s\x00%t", rKey, converted.Name, converted.Unit, converted.Sum)
+		if existing := p.pending.byMetric[mKey]; existing != nil {
+			existing.Points = append(existing.Points, converted.Points...)
+		} else {
+			p.pending.byMetric[mKey] = converted
+			rm.Metrics = append(rm.Metrics, converted)
+		}
+		p.pending.points += len(converted.Points)
+	}
+	return p.pending.points >= p.cfg.GetInt("max_batch_size")
+}
+
+// resourceAttributes describes the host sending the metrics, using the
+// metadata sent by the Datadog Agent when available
+func (p *Plugin) resourceAttributes(tenant, host string) []keyValue {
+	attrs := []keyValue{}
+	if host != "" {
+		attrs = append(attrs, keyValue{"host.name", host})
+		info := p.hosts[host]
+		for _, kv := range []keyValue{{"host.id", info.id}, {"os.type", info.osType}, {"host.arch", info.arch}} {
+			if kv.Value != "" {
+				attrs = append(attrs, kv)
+			}
+		}
+	}
+	if tenant != "" {
+		attrs = append(attrs, keyValue{"tenant", tenant})
+	}
+	return attrs
+}
+
+// convert turns a metric into an OTLP metric. Gauges are sent as gauges,
+// counts as delta sums, and rates as delta sums of the rate multiplied by
+// the interval, or as gauges when the interval is unknown. Sums are flagged
+// as monotonic when monotonic is true, as Datadog counts and rates can
+// decrease otherwise.
+func convert(m *intake.V1Metric, monotonic bool) *metric {
+	ret := &metric{Name: m.Metric, Unit: m.Unit}
+	attrs := getAttributes(m)
+	interval := uint64(m.Interval) * uint64(time.Second)
+
+	multiplier := 1.0
+	switch m.Type {
+	case "count":
+		ret.Sum = true
+	case "rate":
+		if m.Interval > 0 {
+			ret.Sum = true
+			multiplier = float64(m.Interval)
+		}
+	}
+
+	ret.Monotonic = ret.Sum && monotonic
+
+	for _, point := range m.Points {
+		if len(point) < 2 {
+			continue
+		}
+		dp := dataPoint{
+			Attributes: attrs,
+			Time:       toNanos(point[0]),
+			Value:      point[1] * multiplier,
+		}
+		if ret.Sum && interval > 0 && dp.Time > interval {
+			dp.Start = dp.Time - interval
+		}
+		ret.Points = append(ret.Points, dp)
+	}
+	return ret
+}
+
+// getAttributes converts the tags and the device of a metric into
+// attributes, sorted by key. Datadog tags are split as described in
+// datadog.SplitTag, while the values of tags with the same key are joined by
+// commas.
+func getAttributes(m *intake.V1Metric) []keyValue {
+	values := datadog.TagValues(m.Tags)
+	if _, found := values["device"]; !found && m.Device != "" {
+		values["device"] = []string{m.Device}
+	}
+
+	attrs := make([]keyValue, 0, len(values))
+	for key, v := range values {
+		attrs = append(attrs, keyValue{key, strings.Join(v, ",")})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+// toNanos converts a Datadog timestamp to nanoseconds, 0 when unknown
+func toNanos(ts float64) uint64 {
+	if ts <= 0 {
+		return 0
+	}
+	return uint64(datadog.ToNanos(ts))
+}
+
+// getOSType maps the OS reported by the Datadog Agent to the os.type
+// semantic convention
+func getOSType(os string) string {
+	os = strings.ToLower(os)
+	switch {
+	case os == "":
+		return ""
+	case strings.Contains(os, "linux"):
+		return "linux"
+	case strings.HasPrefix(os, "win"):
+		return "windows"
+	case strings.HasPrefix(os, "darwin"), strings.HasPrefix(os, "mac"):
+		return "darwin"
+	}
+	return os
+}
+
+// getHostArch maps the machine reported by the Datadog Agent to the
+// host.arch semantic convention
+func getHostArch(machine string) string {
+	switch machine = strings.ToLower(machine); machine {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i686", "x86":
+		return "x86"
+	case "ppc64le", "ppc64", "s390x":
+		return machine
+	}
+	if strings.HasPrefix(machine, "arm") {
+		return "arm32"
+	}
+	return machine
+}
+
+// flush exports the pending metrics, that are dropped if the export failed
+// after all the retries
+func (p *Plugin) flush(ctx context.Context, client *http.Client) (bool, error) {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = newBatch()
+	p.mu.Unlock()
+
+	if pending.points == 0 {
+		return false, nil
+	}
+
+	err := p.send(ctx, client, pending.resources)
+	if err != nil {
+		output.ERROR.Printf("Error exporting metrics: %s", err)
+	}
+	return true, err
+}
+
+// send exports the metrics, retrying when the endpoint is unavailable or
+// can't be reached
+func (p *Plugin) send(ctx context.Context, client *http.Client, resources []*resourceMetrics) error {
+	body := encodeRequest(resources)
+	if p.cfg.GetBool("gzip") {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	return plugins.Retry(ctx, p.cfg.GetInt("max_retries"), p.cfg.GetDuration("retry_backoff"), func() (bool, error) {
+		return p.post(ctx, client, body)
+	})
+}
+
+// post sends a single request, returning whether it can be retried along
+// with the error. As per the OTLP specification, only 429, 502, 503 and 504
+// are retried.
+func (p *Plugin) post(ctx context.Context, client *http.Client, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetString("endpoint"), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range p.cfg.GetStringMapString("headers") {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "threadle")
+	if p.cfg.GetBool("gzip") {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode/100 == 2 {
+		if rejected, msg := decodePartialSuccess(resBody); rejected > 0 {
+			output.WARN.Printf("%d data points rejected by the endpoint: %s", rejected, msg)
+		}
+		return false, nil
+	}
+
+	err = fmt.Errorf("unexpected response from the endpoint: %s", res.Status)
+	if msg := getStatusMessage(res.Header.Get("Content-Type"), resBody); msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, err
+	}
+	return false, err
+}
+
+// getStatusMessage returns the message of an error response, encoded as a
+// google.rpc.Status protobuf message { string message = 2; } or as text
+func getStatusMessage(contentType string, body []byte) string {
+	if !strings.HasPrefix(contentType, "application/x-protobuf") {
+		return string(bytes.TrimSpace(body))
+	}
+	msg := ""
+	protowalk.Range(body, func(f *protowalk.Field) error {
+		if f.Num == 2 && f.Type == protowire.BytesType {
+			msg = string(f.Bytes)
+		}
+		return nil
+	})
+	return msg
+}
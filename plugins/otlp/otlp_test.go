@@ -0,0 +1,366 @@
+package otlp
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/internal/protowalk"
+	"github.com/masci/threadle/plugins/internal/plugintest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedPoint is a data point decoded from a request, with the attributes
+// of its resource and metric for easier assertions
+type decodedPoint struct {
+	Resource   map[string]string
+	Scope      string
+	Name       string
+	Unit       string
+	Kind       string
+	Monotonic  bool
+	Delta      bool
+	Attributes map[string]string
+	Start      uint64
+	Time       uint64
+	Value      float64
+}
+
+// decodeRequest decodes an ExportMetricsServiceRequest into its data points
+func decodeRequest(t *testing.T, b []byte) []decodedPoint {
+	var points []decodedPoint
+	plugintest.RangeFields(t, b, func(f *protowalk.Field) {
+		require.Equal(t, protowire.Number(1), f.Num)
+		resource := map[string]string{}
+		plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+			switch f.Num {
+			case 1:
+				plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+					key, value := decodeKeyValue(t, f.Bytes)
+					resource[key] = value
+				})
+			case 2:
+				scope := ""
+				plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+					switch f.Num {
+					case 1:
+						plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+							scope = string(f.Bytes)
+						})
+					case 2:
+						for _, dp := range decodeMetric(t, f.Bytes) {
+							dp.Resource = resource
+							dp.Scope = scope
+							points = append(points, dp)
+						}
+					}
+				})
+			}
+		})
+	})
+	return points
+}
+
+func decodeMetric(t *testing.T, b []byte) []decodedPoint {
+	var name, unit string
+	var points []decodedPoint
+	plugintest.RangeFields(t, b, func(f *protowalk.Field) {
+		switch f.Num {
+		case 1:
+			name = string(f.Bytes)
+		case 3:
+			unit = string(f.Bytes)
+		case 5, 7:
+			kind, delta, monotonic := "gauge", false, false
+			if f.Num == 7 {
+				kind = "sum"
+			}
+			var data [][]byte
+			plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+				switch f.Num {
+				case 1:
+					data = append(data, f.Bytes)
+				case 2:
+					delta = f.Scalar == temporalityDelta
+				case 3:
+					monotonic = f.Scalar == 1
+				}
+			})
+			for _, d := range data {
+				dp := decodedPoint{Kind: kind, Delta: delta, Monotonic: monotonic, Attributes: map[string]string{}}
+				plugintest.RangeFields(t, d, func(f *protowalk.Field) {
+					switch f.Num {
+					case 7:
+						key, value := decodeKeyValue(t, f.Bytes)
+						dp.Attributes[key] = value
+					case 2:
+						dp.Start = f.Scalar
+					case 3:
+						dp.Time = f.Scalar
+					case 4:
+						dp.Value = math.Float64frombits(f.Scalar)
+					}
+				})
+				points = append(points, dp)
+			}
+		}
+	})
+	for i := range points {
+		points[i].Name, points[i].Unit = name, unit
+	}
+	return points
+}
+
+func decodeKeyValue(t *testing.T, b []byte) (key, value string) {
+	plugintest.RangeFields(t, b, func(f *protowalk.Field) {
+		switch f.Num {
+		case 1:
+			key = string(f.Bytes)
+		case 2:
+			plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+				value = string(f.Bytes)
+			})
+		}
+	})
+	return key, value
+}
+
+// newServer starts an OTLP/HTTP endpoint replying with the statuses in
+// order, along with a google.rpc.Status message, then with 200
+func newServer(t *testing.T, statuses ...int) *plugintest.Server {
+	return plugintest.NewServer(t, func(w http.ResponseWriter, status int) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		if status == 0 {
+			return
+		}
+		w.WriteHeader(status)
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, 3)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, "something went wrong")
+		w.Write(msg)
+	}, statuses...)
+}
+
+func newPlugin(t *testing.T, endpoint string, settings map[string]interface{}) *Plugin {
+	return plugintest.NewPlugin(t, "otlp", map[string]interface{}{
+		"endpoint":      endpoint,
+		"retry_backoff": "1ms",
+	}, settings).(*Plugin)
+}
+
+func TestOTLP(t *testing.T) {
+	srv := newServer(t)
+	p := newPlugin(t, srv.URL+"/v1/metrics", map[string]interface{}{
+		"flush_interval":  "1h",
+		"headers":         map[string]string{"api-key": "secret"},
+		"exclude_metrics": []string{"^datadog"},
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.IntakeEndpointV1, &intake.Message{Body: []byte(`{
+		"uuid": "1234", "internalHostname": "web-1", "os": "GNU/Linux",
+		"systemStats": {"machine": "x86_64"}, "meta": {"hostname": "web-1"}
+	}`)})
+	// wait for the host metadata to be processed before the metrics
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.hosts["web-1"].id != ""
+	}, time.Second, time.Millisecond)
+
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "system.load.1", "type": "gauge", "host": "web-1", "tags": ["env:prod", "role:db", "role:web", "canary"], "points": [[1612906502, 0.5]]},
+		{"metric": "system.disk.free", "type": "gauge", "host": "web-1", "device": "/dev/sda1", "unit": "By", "points": [[1612906502, 1024]]},
+		{"metric": "datadog.agent.running", "type": "gauge", "host": "web-1", "points": [[1612906502, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "app.requests", "type": "count", "interval": 10, "points": [[1612906502, 2], [1612906512, 3]]},
+		{"metric": "app.hits", "type": "rate", "interval": 10, "points": [[1612906502, 0.5]]},
+		{"metric": "app.misses", "type": "rate", "points": [[1612906502, 0.25]]}
+	]}`)})
+
+	// the pending metrics are exported when stopping
+	require.Nil(t, p.Stop(context.Background()))
+	require.Nil(t, p.Health())
+
+	requests, bodies := srv.Received()
+	require.Len(t, requests, 1)
+	require.Equal(t, "/v1/metrics", requests[0].URL.Path)
+	require.Equal(t, "application/x-protobuf", requests[0].Header.Get("Content-Type"))
+	require.Equal(t, "gzip", requests[0].Header.Get("Content-Encoding"))
+	require.Equal(t, "secret", requests[0].Header.Get("Api-Key"))
+
+	points := decodeRequest(t, bodies[0])
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Name != points[j].Name {
+			return points[i].Name < points[j].Name
+		}
+		return points[i].Time < points[j].Time
+	})
+	webResource := map[string]string{"host.name": "web-1", "host.id": "1234", "os.type": "linux", "host.arch": "amd64", "tenant": "prod"}
+	require.Equal(t, []decodedPoint{
+		{
+			Resource: map[string]string{}, Scope: "threadle", Name: "app.hits", Kind: "sum", Delta: true,
+			Attributes: map[string]string{}, Start: 1612906492000000000, Time: 1612906502000000000, Value: 5,
+		},
+		{
+			Resource: map[string]string{}, Scope: "threadle", Name: "app.misses", Kind: "gauge",
+			Attributes: map[string]string{}, Time: 1612906502000000000, Value: 0.25,
+		},
+		{
+			Resource: map[string]string{}, Scope: "threadle", Name: "app.requests", Kind: "sum", Delta: true,
+			Attributes: map[string]string{}, Start: 1612906492000000000, Time: 1612906502000000000, Value: 2,
+		},
+		{
+			Resource: map[string]string{}, Scope: "threadle", Name: "app.requests", Kind: "sum", Delta: true,
+			Attributes: map[string]string{}, Start: 1612906502000000000, Time: 1612906512000000000, Value: 3,
+		},
+		{
+			Resource: webResource, Scope: "threadle", Name: "system.disk.free", Unit: "By", Kind: "gauge",
+			Attributes: map[string]string{"device": "/dev/sda1"}, Time: 1612906502000000000, Value: 1024,
+		},
+		{
+			Resource: webResource, Scope: "threadle", Name: "system.load.1", Kind: "gauge",
+			Attributes: map[string]string{"env": "prod", "role": "db,web", "canary": "true"}, Time: 1612906502000000000, Value: 0.5,
+		},
+	}, points)
+}
+
+func TestOTLPBatches(t *testing.T) {
+	srv := newServer(t)
+	p := newPlugin(t, srv.URL, map[string]interface{}{
+		"flush_interval": "1h",
+		"max_batch_size": 2,
+		"gzip":           false,
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "a", "points": [[1612906502, 1], [1612906512, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "b", "points": [[1612906502, 1]]}
+	]}`)})
+
+	// the first batch is full and exported right away
+	require.Eventually(t, func() bool {
+		_, bodies := srv.Received()
+		return len(bodies) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, p.Stop(context.Background()))
+
+	requests, bodies := srv.Received()
+	require.Len(t, requests, 2)
+	require.Empty(t, requests[0].Header.Get("Content-Encoding"))
+	require.Len(t, decodeRequest(t, bodies[0]), 2)
+	require.Len(t, decodeRequest(t, bodies[1]), 1)
+}
+
+func TestOTLPRetries(t *testing.T) {
+	srv := newServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	p := newPlugin(t, srv.URL, map[string]interface{}{"flush_interval": "1h"})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906502, 1}}}})
+	require.Nil(t, p.Stop(context.Background()))
+	requests, _ := srv.Received()
+	require.Len(t, requests, 3)
+	require.Nil(t, p.Health())
+
+	// other errors are not retried
+	srv = newServer(t, http.StatusBadRequest)
+	p = newPlugin(t, srv.URL, map[string]interface{}{"flush_interval": "1h"})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+	p.add("", []intake.V1Metric{{Metric: "a", Points: []intake.Point{{1612906502, 1}}}})
+	require.Nil(t, p.Stop(context.Background()))
+	requests, _ = srv.Received()
+	require.Len(t, requests, 1)
+	require.EqualError(t, p.Health(), "unexpected response from the endpoint: 400 Bad Request: something went wrong")
+	select {
+	case err := <-p.Failures():
+		require.Error(t, err)
+	default:
+		require.Fail(t, "the failure was not reported")
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	// counts and rates can decrease, sums aren't monotonic by default
+	count := &intake.V1Metric{Metric: "a", Type: "count", Points: []intake.Point{{1612906502, 2}, {1612906512, 3}}}
+	for _, p := range decodeMetric(t, encodeMetric(convert(count, false))) {
+		require.Equal(t, "sum", p.Kind)
+		require.False(t, p.Monotonic)
+	}
+	rate := &intake.V1Metric{Metric: "a", Type: "rate", Interval: 10, Points: []intake.Point{{1612906502, 0.5}}}
+	for _, p := range decodeMetric(t, encodeMetric(convert(rate, false))) {
+		require.False(t, p.Monotonic)
+	}
+
+	// unless configured otherwise, whatever the values of the batch
+	count.Points = append(count.Points, intake.Point{1612906522, -1})
+	for _, p := range decodeMetric(t, encodeMetric(convert(count, true))) {
+		require.True(t, p.Monotonic)
+	}
+	for _, p := range decodeMetric(t, encodeMetric(convert(rate, true))) {
+		require.True(t, p.Monotonic)
+	}
+
+	// gauges are never monotonic
+	gauge := &intake.V1Metric{Metric: "a", Type: "gauge", Points: []intake.Point{{1612906502, 1}}}
+	require.False(t, convert(gauge, true).Monotonic)
+}
+
+func TestPartialSuccess(t *testing.T) {
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, 2)
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, "invalid points")
+
+	rejected, msg := decodePartialSuccess(appendMessage(nil, 1, partial))
+	require.Equal(t, int64(2), rejected)
+	require.Equal(t, "invalid points", msg)
+
+	rejected, msg = decodePartialSuccess(nil)
+	require.Zero(t, rejected)
+	require.Empty(t, msg)
+}
+
+func TestHostMeta(t *testing.T) {
+	require.Equal(t, "linux", getOSType("GNU/Linux"))
+	require.Equal(t, "windows", getOSType("Windows"))
+	require.Equal(t, "darwin", getOSType("Darwin"))
+	require.Equal(t, "", getOSType(""))
+
+	require.Equal(t, "amd64", getHostArch("x86_64"))
+	require.Equal(t, "arm64", getHostArch("aarch64"))
+	require.Equal(t, "x86", getHostArch("i686"))
+	require.Equal(t, "arm32", getHostArch("armv7l"))
+	require.Equal(t, "ppc64le", getHostArch("ppc64le"))
+}
+
+func TestCheck(t *testing.T) {
+	srv := newServer(t)
+	p := newPlugin(t, srv.URL, map[string]interface{}{"gzip": false})
+	require.Nil(t, p.Check(context.Background()))
+	_, bodies := srv.Received()
+	require.Len(t, bodies, 1)
+	require.Empty(t, bodies[0])
+
+	srv = newServer(t, http.StatusUnauthorized)
+	p = newPlugin(t, srv.URL, nil)
+	require.True(t, strings.HasPrefix(p.Check(context.Background()).Error(), "unexpected response from the endpoint: 401 Unauthorized"))
+
+	p = newPlugin(t, "", nil)
+	require.EqualError(t, p.Check(context.Background()), "endpoint must be set")
+	require.EqualError(t, p.Start(intake.NewPubsub()), "invalid configuration: endpoint must be set")
+}
@@ -0,0 +1,362 @@
+// Package prometheus exposes the metrics received from the Datadog Agent to
+// be scraped by Prometheus.
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/plugins/internal/promlabels"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	plugins.Register("prometheus_exporter", New,
+		plugins.Option{Name: "address", Type: "string", Default: ":3061", Description: "address the metrics are served on"},
+		plugins.Option{Name: "path", Type: "string", Default: "/metrics", Description: "path the metrics are served on"},
+		plugins.Option{Name: "expiry", Type: "duration", Default: "5m", Description: "how long a series not updated is exposed"},
+		plugins.Option{Name: "timestamps", Type: "bool", Default: false, Description: "expose the timestamps of the samples"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only expose the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics exposed by this output"},
+	)
+}
+
+// Content types of the exposition formats
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// series holds the latest value of a series
+type series struct {
+	labels    []promlabels.Label
+	value     float64
+	timestamp float64
+	updated   time.Time
+}
+
+// family groups the series of a metric, with its Prometheus type
+type family struct {
+	typ    string
+	series map[string]*series
+}
+
+// Plugin implements plugins.Plugin
+type Plugin struct {
+	cfg      *viper.Viper
+	broker   *intake.PubSub
+	subs     []<-chan *intake.Message
+	wg       sync.WaitGroup
+	server   *http.Server
+	addr     net.Addr
+	failures chan error
+
+	// families holds the series exposed, keyed by metric name
+	mu       sync.Mutex
+	families map[string]*family
+	swept    time.Time
+	now      func() time.Time
+
+	// lastErr is the error returned by the HTTP server
+	lastErr  error
+	healthMu sync.Mutex
+}
+
+// New creates a prometheus_exporter plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg, now: time.Now}
+}
+
+// Start subscribes to the metrics and serves them on the configured address
+func (p *Plugin) Start(b *intake.PubSub) error {
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are exposed
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics exposed by this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Listen right away so that errors are reported on start
+	ln, err := net.Listen("tcp", p.cfg.GetString("address"))
+	if err != nil {
+		return err
+	}
+
+	p.broker = b
+	p.subs = nil
+	p.failures = make(chan error, 1)
+	p.families = map[string]*family{}
+	p.addr = ln.Addr()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(p.cfg.GetString("path"), p.handler)
+	p.server = &http.Server{Handler: mux}
+	go func() {
+		if err := p.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			output.ERROR.Println("Error serving metrics:", err)
+			p.setError(err)
+			p.fail(err)
+		}
+	}()
+
+	output.INFO.Printf("Serving metrics at %s%s", ln.Addr(), p.cfg.GetString("path"))
+
+	ch := p.broker.SubscribeWithOptions(intake.SeriesEndpointV1, opts)
+	p.subs = append(p.subs, ch)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for msg := range ch {
+			metrics, err := msg.V1Metrics()
+			if err != nil {
+				output.ERROR.Println("error processing metrics: ", err)
+				continue
+			}
+			p.update(msg.Tenant, chain.Process(filter.Process(metrics)))
+		}
+	}()
+
+	return nil
+}
+
+// Stop unsubscribes from the broker and stops serving the metrics
+func (p *Plugin) Stop(ctx context.Context) error {
+	if p.server == nil {
+		// never started
+		return nil
+	}
+	for _, ch := range p.subs {
+		p.broker.Unsubscribe(ch)
+	}
+	err := plugins.Wait(ctx, &p.wg)
+	if shutdownErr := p.server.Shutdown(ctx); shutdownErr != nil {
+		return shutdownErr
+	}
+	return err
+}
+
+// Health returns the error returned by the HTTP server, if any
+func (p *Plugin) Health() error {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return p.lastErr
+}
+
+// Failures returns the errors that stopped the HTTP server
+func (p *Plugin) Failures() <-chan error {
+	return p.failures
+}
+
+// fail reports a failure without blocking
+func (p *Plugin) fail(err error) {
+	select {
+	case p.failures <- err:
+	default:
+	}
+}
+
+// setError records the error returned by the HTTP server
+func (p *Plugin) setError(err error) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.lastErr = err
+}
+
+// update stores the latest value of the series. Gauges and rates, that
+// Datadog reports per second, are exposed as gauges while counts, that hold
+// the increment over the interval, are accumulated into counters. The
+// tenant owning the API key is added as a label, when set.
+func (p *Plugin) update(tenant string, metrics []intake.V1Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for i := range metrics {
+		m := &metrics[i]
+		name, typ := promlabels.SanitizeName(m.Metric, true), "gauge"
+		if m.Type == "count" {
+			typ = "counter"
+		}
+
+		labels := promlabels.Labels(promlabels.MetricName(m), m)
+		if tenant != "" && !hasLabel(labels, "tenant") {
+			labels = append(labels, promlabels.Label{Name: "tenant", Value: tenant})
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		}
+
+		// a metric changing type starts over
+		f := p.families[name]
+		if f == nil || f.typ != typ {
+			f = &family{typ: typ, series: map[string]*series{}}
+			p.families[name] = f
+		}
+		key := promlabels.SeriesKey(labels)
+		s := f.series[key]
+		if s == nil {
+			s = &series{labels: labels}
+			f.series[key] = s
+		}
+		s.updated = now
+
+		for _, point := range m.Points {
+			if len(point) < 2 {
+				continue
+			}
+			if typ == "counter" {
+				s.value += point[1]
+			} else if point[0] >= s.timestamp {
+				s.value = point[1]
+			}
+			if point[0] > s.timestamp {
+				s.timestamp = point[0]
+			}
+		}
+	}
+
+	// don't wait for a scrape to forget the expired series
+	if now.Sub(p.swept) > p.cfg.GetDuration("expiry") {
+		p.expire(now)
+	}
+}
+
+// expire removes the series not updated within the expiry, so that the
+// series the Datadog Agent stopped sending are not exposed anymore
+func (p *Plugin) expire(now time.Time) {
+	p.swept = now
+	expiry := p.cfg.GetDuration("expiry")
+	for name, f := range p.families {
+		for key, s := range f.series {
+			if now.Sub(s.updated) > expiry {
+				delete(f.series, key)
+			}
+		}
+		if len(f.series) == 0 {
+			delete(p.families, name)
+		}
+	}
+}
+
+// handler serves the metrics in the OpenMetrics format when requested by
+// the scraper, in the Prometheus text format otherwise
+func (p *Plugin) handler(rw http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		rw.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		rw.Header().Set("Content-Type", textContentType)
+	}
+
+	// don't hold the lock while the scraper reads the body
+	p.mu.Lock()
+	p.expire(p.now())
+	body := p.render(openMetrics)
+	p.mu.Unlock()
+
+	if _, err := io.WriteString(rw, body); err != nil {
+		output.DEBUG.Println("Error writing metrics:", err)
+	}
+}
+
+// render returns the series sorted by name and labels, must be called
+// holding mu
+func (p *Plugin) render(openMetrics bool) string {
+	timestamps := p.cfg.GetBool("timestamps")
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		f := p.families[name]
+		// the OpenMetrics format names counters without the suffix of
+		// their samples
+		typeName := name
+		if f.typ == "counter" && !openMetrics {
+			typeName += "_total"
+		}
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", typeName, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			writeSeries(&sb, s)
+			if timestamps && s.timestamp > 0 {
+				if openMetrics {
+					sb.WriteString(" " + strconv.FormatFloat(s.timestamp, 'f', -1, 64))
+				} else {
+					sb.WriteString(" " + strconv.FormatInt(int64(s.timestamp*1000), 10))
+				}
+			}
+			sb.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		sb.WriteString("# EOF\n")
+	}
+	return sb.String()
+}
+
+// writeSeries writes the name, labels and value of a series
+func writeSeries(sb *strings.Builder, s *series) {
+	labels := make([]string, 0, len(s.labels))
+	for _, l := range s.labels {
+		if l.Name == "__name__" {
+			sb.WriteString(l.Value)
+			continue
+		}
+		labels = append(labels, l.Name+`="`+escapeLabelValue(l.Value)+`"`)
+	}
+	if len(labels) > 0 {
+		sb.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	sb.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes backslashes, double quotes and new lines
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// hasLabel returns whether a label with the given name is set
+func hasLabel(labels []promlabels.Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func newPlugin(t *testing.T, settings map[string]interface{}) *Plugin {
+	output.Init(0)
+	cfg := viper.New()
+	cfg.Set("address", "127.0.0.1:0")
+	for k, v := range settings {
+		cfg.Set(k, v)
+	}
+	r, found := plugins.Lookup("prometheus_exporter")
+	require.True(t, found)
+	return r.New(cfg).(*Plugin)
+}
+
+// scrape returns the response of the metrics endpoint
+func scrape(p *Plugin, accept string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	p.handler(rw, req)
+	return rw
+}
+
+func TestExporter(t *testing.T) {
+	p := newPlugin(t, map[string]interface{}{"exclude_metrics": []string{"^datadog"}})
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	defer p.Stop(context.Background())
+
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "system.load.1", "type": "gauge", "host": "web-1", "tags": ["env:prod"], "points": [[1612906502, 0.5], [1612906512, 0.75]]},
+		{"metric": "system.load.1", "type": "gauge", "host": "web-2", "tags": ["env:prod", "Role:db"], "points": [[1612906502, 1]]},
+		{"metric": "app.requests", "type": "count", "tags": ["path:/"], "points": [[1612906502, 2], [1612906512, 3]]},
+		{"metric": "datadog.agent.running", "type": "gauge", "points": [[1612906502, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "app.requests", "type": "count", "tags": ["path:/"], "points": [[1612906522, 1]]},
+		{"metric": "app.latency", "type": "rate", "tags": ["msg:say \"hi\""], "points": [[1612906522, 0.25]]}
+	]}`)})
+
+	expected := `# TYPE app_latency gauge
+app_latency{msg="say \"hi\"",tenant="prod"} 0.25
+# TYPE app_requests_total counter
+app_requests_total{path="/"} 5
+app_requests_total{path="/",tenant="prod"} 1
+# TYPE system_load_1 gauge
+system_load_1{Role="db",env="prod",host="web-2"} 1
+system_load_1{env="prod",host="web-1"} 0.75
+`
+	require.Eventually(t, func() bool {
+		return scrape(p, "").Body.String() == expected
+	}, time.Second, 10*time.Millisecond, scrape(p, "").Body.String())
+	require.Equal(t, textContentType, scrape(p, "").Header().Get("Content-Type"))
+
+	// the same metrics in the OpenMetrics format
+	rw := scrape(p, "application/openmetrics-text; version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	require.Equal(t, openMetricsContentType, rw.Header().Get("Content-Type"))
+	require.Equal(t, `# TYPE app_latency gauge
+app_latency{msg="say \"hi\"",tenant="prod"} 0.25
+# TYPE app_requests counter
+app_requests_total{path="/"} 5
+app_requests_total{path="/",tenant="prod"} 1
+# TYPE system_load_1 gauge
+system_load_1{Role="db",env="prod",host="web-2"} 1
+system_load_1{env="prod",host="web-1"} 0.75
+# EOF
+`, rw.Body.String())
+}
+
+func TestExporterServe(t *testing.T) {
+	p := newPlugin(t, map[string]interface{}{"path": "/custom"})
+	require.Nil(t, p.Start(intake.NewPubsub()))
+
+	res, err := http.Get("http://" + p.addr.String() + "/custom")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, err = http.Get("http://" + p.addr.String() + "/metrics")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// the address is already in use
+	other := newPlugin(t, map[string]interface{}{"address": p.addr.String()})
+	require.Error(t, other.Start(intake.NewPubsub()))
+	require.Nil(t, other.Stop(context.Background()))
+
+	require.Nil(t, p.Stop(context.Background()))
+	require.Nil(t, p.Health())
+}
+
+func TestExporterExpiry(t *testing.T) {
+	p := newPlugin(t, map[string]interface{}{"expiry": "1m", "timestamps": true})
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.families = map[string]*family{}
+
+	p.update("", []intake.V1Metric{
+		{Metric: "a", Points: []intake.Point{{1612906502, 1}}},
+		{Metric: "b", Points: []intake.Point{{1612906502, 2}}},
+	})
+	now = now.Add(30 * time.Second)
+	p.update("", []intake.V1Metric{{Metric: "b", Points: []intake.Point{{1612906532.5, 3}}}})
+	require.Equal(t, "# TYPE a gauge\na 1 1612906502000\n# TYPE b gauge\nb 3 1612906532500\n", scrape(p, "").Body.String())
+	require.Equal(t, "# TYPE b gauge\nb 3 1612906532.5\n# EOF\n", func() string {
+		now = now.Add(45 * time.Second)
+		return scrape(p, "application/openmetrics-text").Body.String()
+	}())
+
+	// older points don't replace the latest value
+	p.update("", []intake.V1Metric{{Metric: "b", Points: []intake.Point{{1612906502, 4}}}})
+	require.Equal(t, "# TYPE b gauge\nb 3 1612906532500\n", scrape(p, "").Body.String())
+
+	// a metric changing type starts over
+	p.update("", []intake.V1Metric{{Metric: "b", Type: "count", Points: []intake.Point{{1612906542, 4}}}})
+	require.Equal(t, "# TYPE b_total counter\nb_total 4 1612906542000\n", scrape(p, "").Body.String())
+}
@@ -0,0 +1,118 @@
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+)
+
+// Factory creates a plugin reading its settings from cfg
+type Factory func(cfg *viper.Viper) Plugin
+
+// Option describes a setting accepted by a plugin
+type Option struct {
+	Name        string
+	Type        string
+	Default     interface{}
+	Description string
+}
+
+// Registration holds what's needed to create a plugin from the config
+type Registration struct {
+	Name    string
+	Factory Factory
+	Options []Option
+}
+
+// CommonOptions are accepted by every plugin
+var CommonOptions = []Option{
+	{"buffer_size", "int", intake.DefaultSubscriptionOptions.BufferSize, "number of messages that can be queued for the plugin"},
+	{"overflow", "string", string(intake.DefaultSubscriptionOptions.Overflow), "what to do when the buffer is full: block, drop_newest, drop_oldest or spill"},
+	{"spill_dir", "string", "", "where to write the messages with the spill policy, defaults to the system temp dir"},
+	{"restart", "bool", false, "restart the plugin when it fails while running"},
+	{"max_backoff", "duration", DefaultMaxBackoff.String(), "maximum time to wait before restarting the plugin"},
+}
+
+var (
+	registry   = map[string]*Registration{}
+	registryMu sync.RWMutex
+)
+
+// Register makes a plugin available under the given name, along with the
+// options it accepts. It's meant to be called from the init function of the
+// package implementing the plugin and panics if the name is already taken,
+// or if an option clashes with one of the CommonOptions:
+//
+//	func init() {
+//		plugins.Register("logger", New, plugins.Option{...})
+//	}
+func Register(name string, factory Factory, options ...Option) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("plugins: Register factory is nil for " + name)
+	}
+	if _, found := registry[name]; found {
+		panic("plugins: Register called twice for " + name)
+	}
+	for _, opt := range options {
+		for _, common := range CommonOptions {
+			if opt.Name == common.Name {
+				panic("plugins: Register option " + opt.Name + " of " + name + " is a common option")
+			}
+		}
+	}
+	registry[name] = &Registration{
+		Name:    name,
+		Factory: factory,
+		Options: options,
+	}
+}
+
+// Lookup returns the registration of a plugin
+func Lookup(name string) (*Registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, found := registry[name]
+	return r, found
+}
+
+// Registered returns the registered plugins sorted by name
+func Registered() []*Registration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	ret := make([]*Registration, 0, len(registry))
+	for _, r := range registry {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// New creates an instance of the plugin, applying the defaults of the
+// options not set in cfg
+func (r *Registration) New(cfg *viper.Viper) Plugin {
+	for _, opts := range [][]Option{CommonOptions, r.Options} {
+		for _, o := range opts {
+			if o.Default != nil {
+				cfg.SetDefault(o.Name, o.Default)
+			}
+		}
+	}
+	return r.Factory(cfg)
+}
+
+// NewInstance creates the plugin for a configured instance
+func NewInstance(inst Instance) (Plugin, error) {
+	r, found := Lookup(inst.Type)
+	if !found {
+		return nil, fmt.Errorf("unknown plugin type '%s'", inst.Type)
+	}
+	return r.New(inst.Config), nil
+}
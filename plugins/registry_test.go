@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	var got *viper.Viper
+	factory := func(cfg *viper.Viper) Plugin {
+		got = cfg
+		return &fakePlugin{}
+	}
+	Register("test_register", factory, Option{Name: "foo", Type: "string", Default: "bar"})
+
+	r, found := Lookup("test_register")
+	require.True(t, found)
+	require.Equal(t, "test_register", r.Name)
+	require.Contains(t, Registered(), r)
+
+	// names must be unique
+	require.Panics(t, func() { Register("test_register", factory) })
+
+	// options can't clash with the common ones
+	require.Panics(t, func() { Register("test_register_common", factory, Option{Name: "buffer_size", Type: "int"}) })
+	_, found = Lookup("test_register_common")
+	require.False(t, found)
+
+	// defaults are applied to the instance config
+	cfg := viper.New()
+	cfg.Set("buffer_size", 10)
+	p, err := NewInstance(Instance{Type: "test_register", Name: "test", Config: cfg})
+	require.Nil(t, err)
+	require.NotNil(t, p)
+	require.Equal(t, "bar", got.GetString("foo"))
+	require.Equal(t, 10, got.GetInt("buffer_size"))
+	require.Equal(t, "drop_oldest", got.GetString("overflow"))
+
+	_, err = NewInstance(Instance{Type: "test_unknown", Name: "test", Config: viper.New()})
+	require.Error(t, err)
+}
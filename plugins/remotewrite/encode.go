@@ -0,0 +1,60 @@
+package remotewrite
+
+import (
+	"math"
+
+	"github.com/masci/threadle/plugins/internal/promlabels"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sample is a Prometheus sample, with the timestamp in milliseconds
+type sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// timeSeries is a series in the remote write format
+type timeSeries struct {
+	Labels  []promlabels.Label
+	Samples []sample
+}
+
+// toMillis converts a Datadog timestamp, in seconds, to milliseconds
+func toMillis(ts float64) int64 {
+	return int64(math.Round(ts * 1000))
+}
+
+// encodeWriteRequest encodes the series as a WriteRequest protobuf message,
+// as defined in the Prometheus prompb package:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var b []byte
+	for _, ts := range series {
+		var tsb []byte
+		for _, l := range ts.Labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Value)
+			tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, lb)
+		}
+		for _, s := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+			tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, sb)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, tsb)
+	}
+	return b
+}
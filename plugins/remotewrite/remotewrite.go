@@ -0,0 +1,267 @@
+// Package remotewrite sends the metrics to Prometheus compatible storages,
+// like Prometheus itself, Mimir or Thanos, using the remote write protocol.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/masci/threadle/plugins/internal/promlabels"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	plugins.Register("prometheus_remote_write", New,
+		plugins.Option{Name: "url", Type: "string", Description: "URL of the remote write endpoint"},
+		plugins.Option{Name: "username", Type: "string", Description: "username for basic auth"},
+		plugins.Option{Name: "password", Type: "string", Description: "password for basic auth"},
+		plugins.Option{Name: "bearer_token", Type: "string", Description: "token sent in the Authorization header"},
+		plugins.Option{Name: "tenant_header", Type: "string", Description: "header carrying the tenant, like X-Scope-OrgID"},
+		plugins.Option{Name: "flush_interval", Type: "duration", Default: "10s", Description: "how often the metrics are sent"},
+		plugins.Option{Name: "max_batch_size", Type: "int", Default: 5000, Description: "samples sent in a single request"},
+		plugins.Option{Name: "max_retries", Type: "int", Default: 3, Description: "retries when the endpoint fails with a 5xx"},
+		plugins.Option{Name: "retry_backoff", Type: "duration", Default: "1s", Description: "wait before the first retry, doubled at each retry"},
+		plugins.Option{Name: "timeout", Type: "duration", Default: "30s", Description: "timeout of each request"},
+		plugins.Option{Name: "include_metrics", Type: "matcher", Description: "only send the matching metrics"},
+		plugins.Option{Name: "exclude_metrics", Type: "matcher", Description: "metrics to ignore, like a list of regexps matching their name"},
+		plugins.Option{Name: "processors", Type: "list", Description: "processors applied to the metrics sent to this output"},
+	)
+}
+
+// counterTTL is how long the value of a counter not updated is kept
+const counterTTL = time.Hour
+
+// counter is the cumulative value of a Datadog count
+type counter struct {
+	value   float64
+	updated time.Time
+}
+
+// batch holds the series waiting to be sent for a tenant
+type batch struct {
+	series  []timeSeries
+	samples int
+}
+
+// Plugin implements plugins.Plugin
+type Plugin struct {
+	plugins.Batcher
+
+	cfg *viper.Viper
+
+	// batches holds the pending series for each tenant, counters the
+	// cumulative value of the counts
+	mu       sync.Mutex
+	batches  map[string]*batch
+	counters map[string]*counter
+}
+
+// New creates a prometheus_remote_write plugin reading its settings from cfg
+func New(cfg *viper.Viper) plugins.Plugin {
+	return &Plugin{cfg: cfg}
+}
+
+// Start subscribes to the metrics and starts sending them periodically
+func (p *Plugin) Start(b *intake.PubSub) error {
+	if p.cfg.GetString("url") == "" {
+		return errors.New("invalid configuration: url must be set")
+	}
+
+	// Configure how messages are delivered by the broker
+	opts, err := plugins.GetSubscriptionOptions(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure which metrics are sent
+	filter, err := plugins.GetMetricsFilter(p.cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Configure the processors applied only to the metrics sent to this output
+	chain, err := processors.FromConfig(p.cfg, "processors")
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	flush := func(ctx context.Context) (bool, error) {
+		return p.flush(ctx, client)
+	}
+	if err := p.Batcher.Start(b, p.cfg.GetDuration("flush_interval"), flush); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.batches = map[string]*batch{}
+	p.counters = map[string]*counter{}
+	p.mu.Unlock()
+
+	output.INFO.Println("Sending metrics to:", p.cfg.GetString("url"))
+
+	p.Subscribe(intake.SeriesEndpointV1, opts, func(msg *intake.Message) bool {
+		metrics, err := msg.V1Metrics()
+		if err != nil {
+			output.ERROR.Println("error processing metrics: ", err)
+			return false
+		}
+		return p.add(msg.Tenant, chain.Process(filter.Process(metrics)))
+	})
+
+	return nil
+}
+
+// Check verifies that the endpoint accepts data by sending an empty request
+func (p *Plugin) Check(ctx context.Context) error {
+	if p.cfg.GetString("url") == "" {
+		return errors.New("url must be set")
+	}
+	client := &http.Client{Timeout: p.cfg.GetDuration("timeout")}
+	return p.send(ctx, client, "", nil)
+}
+
+// add converts the metrics and adds them to the batch of the tenant, it
+// returns true when the batch is full and should be sent
+func (p *Plugin) add(tenant string, metrics []intake.V1Metric) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := p.batches[tenant]
+	if b == nil {
+		b = &batch{}
+		p.batches[tenant] = b
+	}
+	now := time.Now()
+	for i := range metrics {
+		ts := p.convert(&metrics[i], now)
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		b.series = append(b.series, ts)
+		b.samples += len(ts.Samples)
+	}
+	return b.samples >= p.cfg.GetInt("max_batch_size")
+}
+
+// convert turns a metric into a series. Gauges and rates, that Datadog
+// reports per second, are sent as they are while counts, that hold the
+// increment over the interval, are accumulated into Prometheus counters.
+func (p *Plugin) convert(m *intake.V1Metric, now time.Time) timeSeries {
+	ts := timeSeries{Labels: promlabels.Labels(promlabels.MetricName(m), m)}
+
+	var c *counter
+	if m.Type == "count" {
+		key := promlabels.SeriesKey(ts.Labels)
+		if c = p.counters[key]; c == nil {
+			c = &counter{}
+			p.counters[key] = c
+		}
+		c.updated = now
+	}
+
+	for _, point := range m.Points {
+		if len(point) < 2 {
+			continue
+		}
+		value := point[1]
+		if c != nil {
+			c.value += value
+			value = c.value
+		}
+		ts.Samples = append(ts.Samples, sample{Value: value, Timestamp: toMillis(point[0])})
+	}
+	return ts
+}
+
+// flush sends the pending metrics, in requests of at most max_batch_size
+// samples. The metrics of a request that failed after all the retries are
+// dropped.
+func (p *Plugin) flush(ctx context.Context, client *http.Client) (bool, error) {
+	p.mu.Lock()
+	batches := p.batches
+	p.batches = map[string]*batch{}
+	// forget the counters not updated for a while
+	for key, c := range p.counters {
+		if time.Since(c.updated) > counterTTL {
+			delete(p.counters, key)
+		}
+	}
+	p.mu.Unlock()
+
+	var lastErr error
+	maxSamples := p.cfg.GetInt("max_batch_size")
+	for tenant, b := range batches {
+		start, samples := 0, 0
+		for i, ts := range b.series {
+			samples += len(ts.Samples)
+			if samples < maxSamples && i < len(b.series)-1 {
+				continue
+			}
+			if err := p.send(ctx, client, tenant, b.series[start:i+1]); err != nil {
+				output.ERROR.Printf("Error sending metrics: %s", err)
+				lastErr = err
+			}
+			start, samples = i+1, 0
+		}
+	}
+	return len(batches) > 0, lastErr
+}
+
+// send writes the series to the endpoint, retrying when it fails with a 5xx
+// or can't be reached
+func (p *Plugin) send(ctx context.Context, client *http.Client, tenant string, series []timeSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	return plugins.Retry(ctx, p.cfg.GetInt("max_retries"), p.cfg.GetDuration("retry_backoff"), func() (bool, error) {
+		return p.post(ctx, client, tenant, body)
+	})
+}
+
+// post sends a single request, returning whether it can be retried along
+// with the error
+func (p *Plugin) post(ctx context.Context, client *http.Client, tenant string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetString("url"), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "threadle")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if user := p.cfg.GetString("username"); user != "" {
+		req.SetBasicAuth(user, p.cfg.GetString("password"))
+	}
+	if token := p.cfg.GetString("bearer_token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if header := p.cfg.GetString("tenant_header"); header != "" && tenant != "" {
+		req.Header.Set(header, tenant)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected response from the endpoint: %s", res.Status)
+	if msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512)); len(bytes.TrimSpace(msg)) > 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(msg))
+	}
+	return res.StatusCode/100 == 5, err
+}
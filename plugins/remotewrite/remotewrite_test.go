@@ -0,0 +1,189 @@
+package remotewrite
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/internal/protowalk"
+	"github.com/masci/threadle/plugins/internal/plugintest"
+	"github.com/masci/threadle/plugins/internal/promlabels"
+	"github.com/stretchr/testify/require"
+)
+
+// received returns the requests received by srv and the series they carried
+func received(t *testing.T, srv *plugintest.Server) ([]*http.Request, [][]timeSeries) {
+	requests, bodies := srv.Received()
+	series := make([][]timeSeries, 0, len(bodies))
+	for _, body := range bodies {
+		series = append(series, decodeWriteRequest(t, body))
+	}
+	return requests, series
+}
+
+// decodeWriteRequest decodes the series of a WriteRequest
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	ret := []timeSeries{}
+	plugintest.RangeFields(t, b, func(f *protowalk.Field) {
+		ts := timeSeries{}
+		plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+			switch f.Num {
+			case 1:
+				l := promlabels.Label{}
+				plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+					if f.Num == 1 {
+						l.Name = string(f.Bytes)
+					} else {
+						l.Value = string(f.Bytes)
+					}
+				})
+				ts.Labels = append(ts.Labels, l)
+			case 2:
+				s := sample{}
+				plugintest.RangeFields(t, f.Bytes, func(f *protowalk.Field) {
+					if f.Num == 1 {
+						s.Value = math.Float64frombits(f.Scalar)
+					} else {
+						s.Timestamp = int64(f.Scalar)
+					}
+				})
+				ts.Samples = append(ts.Samples, s)
+			}
+		})
+		ret = append(ret, ts)
+	})
+	return ret
+}
+
+func newPlugin(t *testing.T, url string, settings map[string]interface{}) *Plugin {
+	return plugintest.NewPlugin(t, "prometheus_remote_write", map[string]interface{}{
+		"url":           url,
+		"retry_backoff": "1ms",
+	}, settings).(*Plugin)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	recv := plugintest.NewServer(t, nil)
+	p := newPlugin(t, recv.URL, map[string]interface{}{
+		"flush_interval":  "1h",
+		"tenant_header":   "X-Scope-OrgID",
+		"exclude_metrics": []string{"^datadog"},
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "system.load.1", "type": "gauge", "host": "web-1", "tags": ["env:prod"], "points": [[1612906502, 0.5]]},
+		{"metric": "app.requests", "type": "count", "tags": ["path:/"], "points": [[1612906502, 2], [1612906512, 3]]},
+		{"metric": "datadog.agent.running", "type": "gauge", "points": [[1612906502, 1]]}
+	]}`)})
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Tenant: "prod", Body: []byte(`{"series": [
+		{"metric": "app.requests", "type": "count", "tags": ["path:/"], "points": [[1612906522, 1]]},
+		{"metric": "app.latency", "type": "rate", "interval": 10, "points": [[1612906522, 0.25]]}
+	]}`)})
+
+	// the pending metrics are sent when stopping
+	require.Nil(t, p.Stop(context.Background()))
+	require.Nil(t, p.Health())
+
+	requests, series := received(t, recv)
+	require.Len(t, requests, 1)
+	require.Equal(t, "snappy", requests[0].Header.Get("Content-Encoding"))
+	require.Equal(t, "application/x-protobuf", requests[0].Header.Get("Content-Type"))
+	require.Equal(t, "0.1.0", requests[0].Header.Get("X-Prometheus-Remote-Write-Version"))
+	require.Equal(t, "prod", requests[0].Header.Get("X-Scope-OrgID"))
+	require.Equal(t, []timeSeries{
+		{
+			Labels:  []promlabels.Label{{Name: "__name__", Value: "system_load_1"}, {Name: "env", Value: "prod"}, {Name: "host", Value: "web-1"}},
+			Samples: []sample{{0.5, 1612906502000}},
+		},
+		{
+			Labels:  []promlabels.Label{{Name: "__name__", Value: "app_requests_total"}, {Name: "path", Value: "/"}},
+			Samples: []sample{{2, 1612906502000}, {5, 1612906512000}},
+		},
+		{
+			Labels:  []promlabels.Label{{Name: "__name__", Value: "app_requests_total"}, {Name: "path", Value: "/"}},
+			Samples: []sample{{6, 1612906522000}},
+		},
+		{
+			Labels:  []promlabels.Label{{Name: "__name__", Value: "app_latency"}},
+			Samples: []sample{{0.25, 1612906522000}},
+		},
+	}, series[0])
+}
+
+func TestRemoteWriteBatches(t *testing.T) {
+	recv := plugintest.NewServer(t, nil)
+	p := newPlugin(t, recv.URL, map[string]interface{}{
+		"flush_interval": "10ms",
+		"max_batch_size": 2,
+	})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	defer p.Stop(context.Background())
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [
+		{"metric": "a", "points": [[1612906502, 1]]},
+		{"metric": "b", "points": [[1612906502, 1], [1612906512, 1]]},
+		{"metric": "c", "points": [[1612906502, 1]]}
+	]}`)})
+
+	// batches are split at max_batch_size samples
+	require.Eventually(t, func() bool {
+		_, bodies := recv.Received()
+		return len(bodies) == 2
+	}, time.Second, 10*time.Millisecond)
+	_, series := received(t, recv)
+	require.Len(t, series[0], 2)
+	require.Len(t, series[1], 1)
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	// 5xx are retried
+	recv := plugintest.NewServer(t, nil, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	p := newPlugin(t, recv.URL, nil)
+	require.Nil(t, p.Check(context.Background()))
+	requests, _ := received(t, recv)
+	require.Len(t, requests, 3)
+
+	// until max_retries
+	recv = plugintest.NewServer(t, nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	p = newPlugin(t, recv.URL, map[string]interface{}{"max_retries": 2})
+	require.EqualError(t, p.Check(context.Background()), "unexpected response from the endpoint: 503 Service Unavailable")
+	requests, _ = received(t, recv)
+	require.Len(t, requests, 3)
+
+	// while 4xx are not
+	recv = plugintest.NewServer(t, nil, http.StatusBadRequest)
+	p = newPlugin(t, recv.URL, nil)
+	require.Error(t, p.Check(context.Background()))
+	requests, _ = received(t, recv)
+	require.Len(t, requests, 1)
+}
+
+func TestRemoteWriteFailure(t *testing.T) {
+	recv := plugintest.NewServer(t, nil, http.StatusBadRequest)
+	p := newPlugin(t, recv.URL, map[string]interface{}{"flush_interval": "1h"})
+
+	broker := intake.NewPubsub()
+	require.Nil(t, p.Start(broker))
+	broker.Publish(intake.SeriesEndpointV1, &intake.Message{Body: []byte(`{"series": [{"metric": "a", "points": [[1612906502, 1]]}]}`)})
+	require.Nil(t, p.Stop(context.Background()))
+
+	require.Error(t, p.Health())
+	select {
+	case err := <-p.Failures():
+		require.Error(t, err)
+	default:
+		require.Fail(t, "the failure was not reported")
+	}
+}
+
+func TestStartError(t *testing.T) {
+	p := newPlugin(t, "", nil)
+	require.EqualError(t, p.Start(intake.NewPubsub()), "invalid configuration: url must be set")
+	require.Nil(t, p.Stop(context.Background()))
+}
@@ -0,0 +1,213 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+)
+
+// Default backoff between restarts of a supervised plugin
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// Failer is implemented by plugins able to report runtime failures, for
+// example when the storage they write to can't be reached
+type Failer interface {
+	// Failures returns the channel receiving the errors occurred while
+	// processing messages, the channel is replaced at every Start
+	Failures() <-chan error
+}
+
+// Supervisor wraps a plugin and restarts it when it reports a failure,
+// waiting longer after every consecutive failure up to MaxBackoff. The
+// backoff is reset once the plugin runs for MaxBackoff without failing.
+// Messages published while the plugin is down are not delivered to it.
+//
+// A failed plugin is started again only once its Stop returned without
+// errors, so that two runs of the same plugin never overlap.
+type Supervisor struct {
+	Name       string
+	Plugin     Plugin
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StopTimeout bounds how long a failed plugin is given to stop, at every
+	// attempt
+	StopTimeout time.Duration
+
+	mu         sync.Mutex
+	restarting error
+	watch      *watch
+}
+
+// watch is the state of the supervision started by a single Start
+type watch struct {
+	done     chan struct{}
+	stopOnce sync.Once
+	// exited is closed when the supervision is over
+	exited chan struct{}
+}
+
+func (w *watch) stop() {
+	w.stopOnce.Do(func() { close(w.done) })
+}
+
+// NewSupervisor returns a Supervisor for the plugin using the default backoff
+func NewSupervisor(name string, p Plugin, maxBackoff time.Duration) *Supervisor {
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	minBackoff := DefaultMinBackoff
+	if minBackoff > maxBackoff {
+		minBackoff = maxBackoff
+	}
+	return &Supervisor{
+		Name:        name,
+		Plugin:      p,
+		MinBackoff:  minBackoff,
+		MaxBackoff:  maxBackoff,
+		StopTimeout: 10 * time.Second,
+	}
+}
+
+// Start starts the plugin and watches for its failures, errors occurred
+// while starting the plugin the first time are returned to the caller
+func (s *Supervisor) Start(b *intake.PubSub) error {
+	if w := s.current(); w != nil {
+		select {
+		case <-w.exited:
+		default:
+			return fmt.Errorf("plugin %s is still being stopped", s.Name)
+		}
+	}
+
+	if err := s.Plugin.Start(b); err != nil {
+		return err
+	}
+
+	f, ok := s.Plugin.(Failer)
+	if !ok {
+		output.DEBUG.Printf("Plugin %s can't report failures, it won't be restarted", s.Name)
+		return nil
+	}
+
+	w := &watch{done: make(chan struct{}), exited: make(chan struct{})}
+	s.mu.Lock()
+	s.watch = w
+	s.mu.Unlock()
+	go s.supervise(w, b, f)
+	return nil
+}
+
+// Stop stops watching the plugin and stops it
+func (s *Supervisor) Stop(ctx context.Context) error {
+	if w := s.current(); w != nil {
+		w.stop()
+		select {
+		case <-w.exited:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.Plugin.Stop(ctx)
+}
+
+// Health returns the plugin health, or the error causing a restart while
+// the plugin is down
+func (s *Supervisor) Health() error {
+	s.mu.Lock()
+	err := s.restarting
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return s.Plugin.Health()
+}
+
+// current returns the last supervision started, nil if none
+func (s *Supervisor) current() *watch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watch
+}
+
+func (s *Supervisor) setRestarting(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restarting = err
+}
+
+// supervise restarts the plugin every time it fails, until w is stopped
+func (s *Supervisor) supervise(w *watch, b *intake.PubSub, f Failer) {
+	defer close(w.exited)
+
+	backoff := s.MinBackoff
+	startedAt := time.Now()
+	for {
+		var cause error
+		select {
+		case <-w.done:
+			return
+		case cause = <-f.Failures():
+		}
+
+		// the plugin was working fine for a while, start over
+		if time.Since(startedAt) > s.MaxBackoff {
+			backoff = s.MinBackoff
+		}
+
+		output.ERROR.Printf("Plugin %s failed, restarting in %s: %s", s.Name, backoff, cause)
+		s.setRestarting(fmt.Errorf("restarting after failure: %w", cause))
+
+		// keep trying until the plugin stops, then until it starts again
+		stopped := false
+		for {
+			if !stopped {
+				stopped = s.stopPlugin()
+			}
+
+			select {
+			case <-w.done:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > s.MaxBackoff {
+				backoff = s.MaxBackoff
+			}
+
+			if !stopped {
+				continue
+			}
+			err := s.Plugin.Start(b)
+			if err == nil {
+				break
+			}
+			output.ERROR.Printf("Plugin %s failed to restart, retrying in %s: %s", s.Name, backoff, err)
+			s.setRestarting(fmt.Errorf("restarting after failure: %w", err))
+		}
+
+		output.INFO.Println("Plugin restarted:", s.Name)
+		s.setRestarting(nil)
+		startedAt = time.Now()
+	}
+}
+
+// stopPlugin stops the failed plugin within StopTimeout, it returns false
+// when the plugin might still be running
+func (s *Supervisor) stopPlugin() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.StopTimeout)
+	defer cancel()
+	if err := s.Plugin.Stop(ctx); err != nil {
+		output.ERROR.Printf("Plugin %s didn't stop in time, it won't be restarted until it does: %s", s.Name, err)
+		return false
+	}
+	return true
+}
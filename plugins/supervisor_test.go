@@ -0,0 +1,174 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePlugin counts how many times it's started and stopped
+type fakePlugin struct {
+	mu       sync.Mutex
+	starts   int
+	stops    int
+	startErr error
+	// stopErrs is the number of calls to Stop failing before succeeding
+	stopErrs int
+	// hang makes Stop block until its context is done
+	hang     bool
+	failures chan error
+}
+
+func (p *fakePlugin) Start(*intake.PubSub) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starts++
+	p.failures = make(chan error, 1)
+	return p.startErr
+}
+
+func (p *fakePlugin) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stops++
+	if p.hang {
+		p.mu.Unlock()
+		<-ctx.Done()
+		p.mu.Lock()
+		return ctx.Err()
+	}
+	if p.stopErrs > 0 {
+		p.stopErrs--
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func (p *fakePlugin) Health() error {
+	return nil
+}
+
+func (p *fakePlugin) Failures() <-chan error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failures
+}
+
+func (p *fakePlugin) counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.starts, p.stops
+}
+
+func TestSupervisorStartError(t *testing.T) {
+	p := &fakePlugin{startErr: errors.New("boom")}
+	s := NewSupervisor("fake", p, time.Second)
+	require.EqualError(t, s.Start(intake.NewPubsub()), "boom")
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	output.Init(0)
+
+	p := &fakePlugin{}
+	s := NewSupervisor("fake", p, 50*time.Millisecond)
+	s.MinBackoff = 10 * time.Millisecond
+	require.Nil(t, s.Start(intake.NewPubsub()))
+
+	p.failures <- errors.New("boom")
+	require.Eventually(t, func() bool {
+		starts, stops := p.counts()
+		return starts == 2 && stops == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return s.Health() == nil }, time.Second, 5*time.Millisecond)
+
+	// the plugin keeps being supervised after a restart
+	p.mu.Lock()
+	p.failures <- errors.New("boom")
+	p.mu.Unlock()
+	require.Eventually(t, func() bool {
+		starts, _ := p.counts()
+		return starts == 3
+	}, time.Second, 5*time.Millisecond)
+
+	require.Nil(t, s.Stop(context.Background()))
+	_, stops := p.counts()
+	require.Equal(t, 3, stops)
+}
+
+func TestSupervisorRestartError(t *testing.T) {
+	output.Init(0)
+
+	p := &fakePlugin{}
+	s := NewSupervisor("fake", p, 20*time.Millisecond)
+	s.MinBackoff = 5 * time.Millisecond
+	require.Nil(t, s.Start(intake.NewPubsub()))
+
+	// the plugin can't be restarted, the supervisor keeps trying
+	p.mu.Lock()
+	p.startErr = errors.New("still down")
+	p.mu.Unlock()
+	p.failures <- errors.New("boom")
+	require.Eventually(t, func() bool {
+		starts, _ := p.counts()
+		return starts > 3
+	}, time.Second, 5*time.Millisecond)
+	require.Error(t, s.Health())
+
+	require.Nil(t, s.Stop(context.Background()))
+}
+
+func TestSupervisorRestartAfterStop(t *testing.T) {
+	output.Init(0)
+
+	p := &fakePlugin{stopErrs: 2}
+	s := NewSupervisor("fake", p, 20*time.Millisecond)
+	s.MinBackoff = 5 * time.Millisecond
+	require.Nil(t, s.Start(intake.NewPubsub()))
+
+	// the plugin is restarted only once it stopped cleanly
+	p.failures <- errors.New("boom")
+	require.Eventually(t, func() bool {
+		starts, _ := p.counts()
+		return starts == 2
+	}, time.Second, 5*time.Millisecond)
+	_, stops := p.counts()
+	require.Equal(t, 3, stops)
+
+	require.Nil(t, s.Stop(context.Background()))
+}
+
+func TestSupervisorStartWhileStopping(t *testing.T) {
+	output.Init(0)
+
+	p := &fakePlugin{hang: true}
+	s := NewSupervisor("fake", p, time.Second)
+	s.StopTimeout = 100 * time.Millisecond
+	require.Nil(t, s.Start(intake.NewPubsub()))
+
+	// the failed plugin is being stopped, the supervisor can't be started again
+	p.failures <- errors.New("boom")
+	require.Eventually(t, func() bool {
+		_, stops := p.counts()
+		return stops == 1
+	}, time.Second, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, s.Stop(ctx))
+	require.Error(t, s.Start(intake.NewPubsub()))
+	starts, _ := p.counts()
+	require.Equal(t, 1, starts)
+
+	// once the supervision is over the plugin can be started again
+	p.mu.Lock()
+	p.hang = false
+	p.mu.Unlock()
+	require.Nil(t, s.Stop(context.Background()))
+	require.Nil(t, s.Start(intake.NewPubsub()))
+	require.Nil(t, s.Stop(context.Background()))
+}
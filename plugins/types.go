@@ -1,8 +1,27 @@
 package plugins
 
-import "github.com/masci/threadle/intake"
+import (
+	"context"
+
+	"github.com/masci/threadle/intake"
+)
 
 // Plugin is the interface provided by any plugin
 type Plugin interface {
-	Start(*intake.PubSub)
+	// Start subscribes to the topics and starts processing messages, an error
+	// is returned when the plugin can't be initialised
+	Start(*intake.PubSub) error
+	// Stop unsubscribes from the broker and returns once the messages already
+	// received are processed, or when the context is done
+	Stop(context.Context) error
+	// Health returns an error when the plugin is not working properly
+	Health() error
+}
+
+// Checker is implemented by plugins able to verify that their outputs can be
+// reached, without starting the plugin
+type Checker interface {
+	// Check returns an error when the output can't be reached before the
+	// context is done
+	Check(context.Context) error
 }
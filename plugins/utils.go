@@ -1,18 +1,25 @@
 package plugins
 
 import (
+	"context"
+	"fmt"
 	"regexp"
+	"sync"
 
 	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/viper"
 )
 
 // Filters is a slice of exclusion filters
 type Filters []*regexp.Regexp
 
-// ExcludeV1Metrics drops metrics according to one or more exclusion filters for their name
+// ExcludeV1Metrics drops metrics according to one or more exclusion filters for their name.
+// The metrics are shared among plugins so the input slice is left untouched.
+//
+// Deprecated: use GetMetricsFilter, supporting include lists and matching on tags.
 func ExcludeV1Metrics(metrics []intake.V1Metric, exclude Filters) []intake.V1Metric {
-	// filter in-place
-	n := 0
+	ret := make([]intake.V1Metric, 0, len(metrics))
 	for _, m := range metrics {
 		keep := true
 		for _, reg := range exclude {
@@ -22,19 +29,116 @@ func ExcludeV1Metrics(metrics []intake.V1Metric, exclude Filters) []intake.V1Met
 			}
 		}
 		if keep {
-			metrics[n] = m
-			n++
+			ret = append(ret, m)
 		}
 	}
-	return metrics[:n]
+	return ret
 }
 
-// GetFilters populate a Filters object from a slice of regex strings
+// GetFilters populate a Filters object from a slice of regex strings, it panics
+// when any of them is not valid
+//
+// Deprecated: use GetMetricsFilter, supporting include lists and matching on tags.
 func GetFilters(regexList []string) Filters {
+	f, err := CompileFilters(regexList)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// CompileFilters populate a Filters object from a slice of regex strings,
+// failing when any of them is not valid
+//
+// Deprecated: use GetMetricsFilter, supporting include lists and matching on tags.
+func CompileFilters(regexList []string) (Filters, error) {
 	f := Filters{}
 	for _, r := range regexList {
-		f = append(f, regexp.MustCompile(r))
+		reg, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter '%s': %w", r, err)
+		}
+		f = append(f, reg)
 	}
 
-	return f
+	return f, nil
+}
+
+// GetMetricsFilter builds a filter out of the include_metrics and exclude_metrics
+// options of a plugin, both accepting a matcher as described in processors.ParseMatcher,
+// for example:
+//
+//	plugins:
+//	  elasticsearch:
+//	    include_metrics:
+//	      all:
+//	        - name: ^system\.
+//	        - tag: env:prod
+//	        - type: gauge
+//	    exclude_metrics:
+//	      - .*datadog.*
+//
+// As when exclude_metrics only accepted a list of regexps, a string is split
+// on whitespace into a list, one regexp per item.
+func GetMetricsFilter(cfg *viper.Viper) (*processors.Filter, error) {
+	include, err := processors.ParseMatcher(getMatcherConfig(cfg, "include_metrics"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid include_metrics: %w", err)
+	}
+	exclude, err := processors.ParseMatcher(getMatcherConfig(cfg, "exclude_metrics"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude_metrics: %w", err)
+	}
+	return processors.NewFilter(include, exclude), nil
+}
+
+// getMatcherConfig returns the config of a matcher, splitting strings on
+// whitespace like viper.GetStringSlice does
+func getMatcherConfig(cfg *viper.Viper, key string) interface{} {
+	if _, ok := cfg.Get(key).(string); ok {
+		return cfg.GetStringSlice(key)
+	}
+	return cfg.Get(key)
+}
+
+// GetSubscriptionOptions reads from the plugin config how messages should be
+// delivered by the broker, for example:
+//
+//	plugins:
+//	  elasticsearch:
+//	    buffer_size: 100
+//	    overflow: spill
+//	    spill_dir: /var/lib/threadle
+func GetSubscriptionOptions(cfg *viper.Viper) (intake.SubscriptionOptions, error) {
+	opts := intake.DefaultSubscriptionOptions
+	if cfg.IsSet("buffer_size") {
+		opts.BufferSize = cfg.GetInt("buffer_size")
+	}
+	if cfg.IsSet("overflow") {
+		policy, err := intake.ParseOverflowPolicy(cfg.GetString("overflow"))
+		if err != nil {
+			return opts, err
+		}
+		opts.Overflow = policy
+	}
+	opts.SpillDir = cfg.GetString("spill_dir")
+
+	return opts, nil
+}
+
+// Wait blocks until the WaitGroup counter is zero or the context is done,
+// in which case the context error is returned
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
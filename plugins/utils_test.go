@@ -1,10 +1,14 @@
 package plugins
 
 import (
+	"context"
 	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 )
 
@@ -64,7 +68,94 @@ func TestExcludeV1Metrics(t *testing.T) {
 	}
 
 	for _, testcase := range testcases {
+		original := append([]intake.V1Metric{}, testcase.metrics...)
 		res := ExcludeV1Metrics(testcase.metrics, testcase.exclude)
 		require.Equal(t, testcase.expected, res)
+		// metrics are shared among plugins, the input must be left untouched
+		require.Equal(t, original, testcase.metrics)
 	}
 }
+
+func TestGetSubscriptionOptions(t *testing.T) {
+	cfg := viper.New()
+
+	// defaults
+	opts, err := GetSubscriptionOptions(cfg)
+	require.Nil(t, err)
+	require.Equal(t, intake.DefaultSubscriptionOptions, opts)
+
+	cfg.Set("buffer_size", 100)
+	cfg.Set("overflow", "spill")
+	cfg.Set("spill_dir", "/tmp")
+	opts, err = GetSubscriptionOptions(cfg)
+	require.Nil(t, err)
+	require.Equal(t, intake.SubscriptionOptions{
+		BufferSize: 100,
+		Overflow:   intake.OverflowSpill,
+		SpillDir:   "/tmp",
+	}, opts)
+
+	cfg.Set("overflow", "whatever")
+	_, err = GetSubscriptionOptions(cfg)
+	require.NotNil(t, err)
+}
+
+func TestWait(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// the context expires before the counter goes to zero
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, Wait(ctx, &wg))
+
+	wg.Done()
+	require.Nil(t, Wait(context.Background(), &wg))
+}
+
+func TestGetFilters(t *testing.T) {
+	f := GetFilters([]string{`.+\.datadog\..+`, `^system\.`})
+	require.Len(t, f, 2)
+	require.Panics(t, func() { GetFilters([]string{`datadog.(`}) })
+}
+
+func TestCompileFilters(t *testing.T) {
+	f, err := CompileFilters([]string{`.+\.datadog\..+`, `^system\.`})
+	require.Nil(t, err)
+	require.Len(t, f, 2)
+
+	_, err = CompileFilters([]string{`^system\.`, `datadog.(`})
+	require.EqualError(t, err, "invalid filter 'datadog.(': error parsing regexp: missing closing ): `datadog.(`")
+}
+
+func TestGetMetricsFilter(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("include_metrics", map[string]interface{}{"tag": "env:prod"})
+	cfg.Set("exclude_metrics", []string{`.+\.datadog\..+`})
+
+	f, err := GetMetricsFilter(cfg)
+	require.Nil(t, err)
+	got := f.Process([]intake.V1Metric{
+		{Metric: "system.cpu.system", Tags: []string{"env:prod"}},
+		{Metric: "system.cpu.user", Tags: []string{"env:dev"}},
+		{Metric: "foo.datadog.bar", Tags: []string{"env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{{Metric: "system.cpu.system", Tags: []string{"env:prod"}}}, got)
+
+	// nothing configured, everything is kept
+	f, err = GetMetricsFilter(viper.New())
+	require.Nil(t, err)
+	require.Len(t, f.Process([]intake.V1Metric{{Metric: "foo"}}), 1)
+
+	// strings are split on whitespace, like exclude_metrics always did
+	cfg = viper.New()
+	cfg.Set("exclude_metrics", `^system\.cpu\. \.datadog\.`)
+	f, err = GetMetricsFilter(cfg)
+	require.Nil(t, err)
+	got = f.Process([]intake.V1Metric{{Metric: "system.cpu.user"}, {Metric: "foo.datadog.bar"}, {Metric: "system.load.1"}})
+	require.Equal(t, []intake.V1Metric{{Metric: "system.load.1"}}, got)
+
+	cfg.Set("include_metrics", map[string]interface{}{"foo": "bar"})
+	_, err = GetMetricsFilter(cfg)
+	require.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package plugins
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/masci/threadle/processors"
+	"github.com/spf13/cast"
+)
+
+// Problem is an issue found in the configuration of the plugins
+type Problem struct {
+	// Instance is the name of the instance affected, empty when the
+	// problem concerns the whole configuration
+	Instance string
+	Message  string
+	// Fatal problems prevent Threadle from working
+	Fatal bool
+}
+
+func (p Problem) String() string {
+	if p.Instance == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("plugin %s: %s", p.Instance, p.Message)
+}
+
+// Validate checks the configured instances against the registered plugins,
+// reporting unknown plugins, unknown options and options with the wrong type.
+// Having no plugin enabled is a fatal problem, as every message would be lost.
+// Plugins can still fail to start, see Manager.Health.
+func Validate(instances []Instance) []Problem {
+	problems := []Problem{}
+
+	names := []string{}
+	for _, r := range Registered() {
+		names = append(names, r.Name)
+	}
+
+	enabled := 0
+	for _, inst := range instances {
+		r, found := Lookup(inst.Type)
+		if !found {
+			msg := fmt.Sprintf("unknown plugin type '%s'", inst.Type)
+			if s := suggest(inst.Type, names); s != "" {
+				msg += fmt.Sprintf(", did you mean '%s'?", s)
+			}
+			problems = append(problems, Problem{Instance: inst.Name, Message: msg})
+			continue
+		}
+		enabled++
+		problems = append(problems, validateOptions(inst, r)...)
+	}
+
+	if enabled == 0 {
+		problems = append(problems, Problem{
+			Message: "no plugins enabled, the data sent by the Datadog Agent would be discarded",
+			Fatal:   true,
+		})
+	}
+
+	return problems
+}
+
+// validateOptions checks the settings of an instance against the options
+// accepted by the plugin
+func validateOptions(inst Instance, r *Registration) []Problem {
+	problems := []Problem{}
+
+	known := map[string]Option{}
+	optNames := []string{}
+	for _, opts := range [][]Option{CommonOptions, r.Options} {
+		for _, o := range opts {
+			known[o.Name] = o
+			optNames = append(optNames, o.Name)
+		}
+	}
+
+	settings := inst.Config.AllSettings()
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		o, found := known[k]
+		if !found {
+			msg := fmt.Sprintf("unknown option '%s'", k)
+			if s := suggest(k, optNames); s != "" {
+				msg += fmt.Sprintf(", did you mean '%s'?", s)
+			}
+			problems = append(problems, Problem{Instance: inst.Name, Message: msg})
+			continue
+		}
+		if err := checkType(o.Type, settings[k]); err != nil {
+			problems = append(problems, Problem{
+				Instance: inst.Name,
+				Message:  fmt.Sprintf("option '%s' should be of type %s: %s", k, o.Type, err),
+			})
+		}
+	}
+
+	return problems
+}
+
+// checkType returns an error when value can't be used as an option of the given type
+func checkType(optType string, value interface{}) error {
+	var err error
+	switch optType {
+	case "string":
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+			err = fmt.Errorf("got %T", value)
+		default:
+			_, err = cast.ToStringE(value)
+		}
+	case "bool":
+		_, err = cast.ToBoolE(value)
+	case "int":
+		_, err = cast.ToIntE(value)
+	case "duration":
+		_, err = cast.ToDurationE(value)
+	case "[]string":
+		_, err = cast.ToStringSliceE(value)
+	case "list":
+		_, err = cast.ToSliceE(value)
+	case "map":
+		_, err = cast.ToStringMapStringE(value)
+	case "matcher":
+		_, err = processors.ParseMatcher(value)
+	}
+	return err
+}
+
+// suggest returns the candidate closest to name, if it's close enough to be a typo
+func suggest(name string, candidates []string) string {
+	// allow one typo every three characters
+	maxDist := len(name) / 3
+	if maxDist < 1 {
+		maxDist = 1
+	}
+
+	best, bestDist := "", maxDist+1
+	for _, c := range candidates {
+		if d := levenshtein(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	Register("test_validate", func(*viper.Viper) Plugin { return &fakePlugin{} },
+		Option{Name: "index", Type: "string"},
+		Option{Name: "enabled", Type: "bool"},
+		Option{Name: "timeout", Type: "duration"},
+		Option{Name: "topics", Type: "[]string"},
+		Option{Name: "headers", Type: "map"},
+	)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("index", "foo")
+	cfg.Set("enabled", "yes please")
+	cfg.Set("timeout", "10s")
+	cfg.Set("topcs", []string{"/api/v1/series"})
+	cfg.Set("buffer_size", 10)
+	cfg.Set("headers", map[string]interface{}{"x-api-key": "secret"})
+
+	problems := Validate([]Instance{
+		{Type: "test_validate", Name: "valid", Config: cfg},
+		{Type: "test_validat", Name: "typo", Config: viper.New()},
+	})
+	require.Equal(t, []Problem{
+		{Instance: "valid", Message: `option 'enabled' should be of type bool: strconv.ParseBool: parsing "yes please": invalid syntax`},
+		{Instance: "valid", Message: "unknown option 'topcs', did you mean 'topics'?"},
+		{Instance: "typo", Message: "unknown plugin type 'test_validat', did you mean 'test_validate'?"},
+	}, problems)
+}
+
+func TestValidateNoPlugins(t *testing.T) {
+	problems := Validate([]Instance{
+		{Type: "foo", Name: "foo", Config: viper.New()},
+	})
+	require.Len(t, problems, 2)
+	require.False(t, problems[0].Fatal)
+	require.True(t, problems[1].Fatal)
+
+	problems = Validate([]Instance{})
+	require.Len(t, problems, 1)
+	require.True(t, problems[0].Fatal)
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"elasticsearch", "logger"}
+	require.Equal(t, "elasticsearch", suggest("elasticsearh", candidates))
+	require.Equal(t, "logger", suggest("loger", candidates))
+	require.Equal(t, "", suggest("graphite", candidates))
+	require.Equal(t, 3, levenshtein("kitten", "sitting"))
+}
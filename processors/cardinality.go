@@ -0,0 +1,341 @@
+package processors
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("cardinality", newCardinality)
+	intake.RegisterStatus("cardinality", cardinalityStatus)
+}
+
+// Cardinality actions
+const (
+	cardinalityDrop      = "drop"
+	cardinalityAggregate = "aggregate"
+)
+
+var (
+	// trackers holds the last tracker used for each name, it's used to
+	// report the limited metrics and to keep the series across reloads.
+	// Names must be unique in the whole config, see CheckNames.
+	trackers   = map[string]*tracker{}
+	trackersMu sync.Mutex
+)
+
+// cardinality limits the number of series of each metric, a series being the
+// metric name along with its host, device and tags. Once a metric reaches
+// max_series, the metrics of new series are either dropped or aggregated by
+// removing the offending tags, that must be listed:
+//
+//	processors:
+//	  - type: cardinality
+//	    match: ^kubernetes\.
+//	    max_series: 500
+//	    action: aggregate
+//	    tags: [pod_name, container_id]
+//
+// The series are counted over a window, so that the series that stopped
+// reporting eventually make room for the new ones.
+type cardinality struct {
+	name   string
+	match  Matcher
+	action string
+	tags   map[string]bool
+	t      *tracker
+}
+
+// tracker counts the series seen for each metric, up to maxSeries for at
+// most maxMetrics metrics, and how many metrics were limited. Metrics past
+// maxMetrics are not tracked nor limited, only counted.
+type tracker struct {
+	name       string
+	maxSeries  int
+	maxMetrics int
+	window     time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	reset     time.Time
+	series    map[string]map[uint64]bool
+	limited   map[string]uint64
+	untracked uint64
+}
+
+func newCardinality(cfg *viper.Viper) (Processor, error) {
+	cfg.SetDefault("name", "cardinality")
+	cfg.SetDefault("max_series", 1000)
+	cfg.SetDefault("max_metrics", 10000)
+	cfg.SetDefault("window", time.Hour)
+	cfg.SetDefault("action", cardinalityDrop)
+
+	c := &cardinality{
+		name:   cfg.GetString("name"),
+		action: cfg.GetString("action"),
+		tags:   map[string]bool{},
+	}
+	if c.action != cardinalityDrop && c.action != cardinalityAggregate {
+		return nil, fmt.Errorf("unknown action '%s', must be one of %s, %s", c.action, cardinalityDrop, cardinalityAggregate)
+	}
+	for _, key := range cfg.GetStringSlice("tags") {
+		c.tags[key] = true
+	}
+	if c.action == cardinalityAggregate && len(c.tags) == 0 {
+		return nil, errors.New("tags must list the tags removed by the aggregate action")
+	}
+
+	var err error
+	if c.match, err = ParseMatcher(cfg.Get("match")); err != nil {
+		return nil, err
+	}
+
+	name := c.name
+	maxSeries := cfg.GetInt("max_series")
+	maxMetrics := cfg.GetInt("max_metrics")
+	window := cfg.GetDuration("window")
+	if maxSeries <= 0 || maxMetrics <= 0 {
+		return nil, errors.New("max_series and max_metrics must be greater than zero")
+	}
+
+	// keep counting the series seen so far when the config is reloaded
+	trackersMu.Lock()
+	t := trackers[name]
+	trackersMu.Unlock()
+	if t == nil || t.maxSeries != maxSeries || t.maxMetrics != maxMetrics || t.window != window {
+		t = newTracker(name, maxSeries, maxMetrics, window)
+	}
+	c.t = t
+
+	return c, nil
+}
+
+func newTracker(name string, maxSeries, maxMetrics int, window time.Duration) *tracker {
+	return &tracker{
+		name:       name,
+		maxSeries:  maxSeries,
+		maxMetrics: maxMetrics,
+		window:     window,
+		now:        time.Now,
+		series:     map[string]map[uint64]bool{},
+		limited:    map[string]uint64{},
+	}
+}
+
+// Process implements Processor
+func (c *cardinality) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	// the tracker is only reported once it's actually used
+	trackersMu.Lock()
+	trackers[c.t.name] = c.t
+	trackersMu.Unlock()
+
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.t.expire()
+
+	ret := make([]intake.V1Metric, 0, len(metrics))
+	// position in ret of the aggregated series
+	aggregated := map[string]int{}
+	for i := range metrics {
+		m := metrics[i]
+		if c.match != nil && !c.match.Match(&m) {
+			ret = append(ret, m)
+			continue
+		}
+		if c.t.add(&m) {
+			ret = append(ret, m)
+			continue
+		}
+
+		if c.t.limit(m.Metric) {
+			output.WARN.Printf("Cardinality limit of %d series reached for metric %s, action: %s",
+				c.t.maxSeries, m.Metric, c.action)
+		}
+		if c.action == cardinalityDrop {
+			continue
+		}
+
+		m.Tags = filterTags(m.Tags, func(key, value string) bool { return !c.tags[key] })
+		key := fmt.Sprintf("%s\x00%s\x00%d\x00%d", m.Metric, m.Type, m.Interval, seriesHash(&m))
+		if j, found := aggregated[key]; found {
+			ret[j].Points = mergePoints(ret[j].Points, m.Points, m.Type == "count" || m.Type == "rate")
+			continue
+		}
+		aggregated[key] = len(ret)
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// expire forgets the series seen when the window is over
+func (t *tracker) expire() {
+	if t.window <= 0 {
+		return
+	}
+	now := t.now()
+	if now.Before(t.reset) {
+		return
+	}
+	t.reset = now.Add(t.window)
+	t.series = map[string]map[uint64]bool{}
+	t.limited = map[string]uint64{}
+	t.untracked = 0
+}
+
+// add tracks the series of the metric, returning false when the metric
+// reached the limit. Once maxMetrics metrics are tracked, new metrics are
+// let through untracked, as they can't be told apart from the legit ones.
+func (t *tracker) add(m *intake.V1Metric) bool {
+	set, found := t.series[m.Metric]
+	if !found {
+		if len(t.series) >= t.maxMetrics {
+			t.untracked++
+			return true
+		}
+		set = map[uint64]bool{}
+		t.series[m.Metric] = set
+	}
+
+	h := seriesHash(m)
+	if set[h] {
+		return true
+	}
+	if len(set) >= t.maxSeries {
+		return false
+	}
+	set[h] = true
+	return true
+}
+
+// limit counts a limited metric, returning true the first time the metric
+// is limited in the current window. Only tracked metrics are limited, so
+// there are at most maxMetrics of them.
+func (t *tracker) limit(metric string) bool {
+	if n, found := t.limited[metric]; found {
+		t.limited[metric] = n + 1
+		return false
+	}
+	t.limited[metric] = 1
+	return true
+}
+
+// seriesHash identifies the series of a metric, along with its name
+func seriesHash(m *intake.V1Metric) uint64 {
+	tags := make([]string, len(m.Tags))
+	copy(tags, m.Tags)
+	sort.Strings(tags)
+
+	h := fnv.New64a()
+	h.Write([]byte(m.Host))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Device))
+	for _, tag := range tags {
+		h.Write([]byte{0})
+		h.Write([]byte(tag))
+	}
+	return h.Sum64()
+}
+
+// mergePoints returns a copy of a with the points of b, the values of the
+// points with the same timestamp are summed or replaced
+func mergePoints(a, b []intake.Point, sum bool) []intake.Point {
+	ret := make([]intake.Point, len(a), len(a)+len(b))
+	copy(ret, a)
+	for _, p := range b {
+		if len(p) < 2 {
+			continue
+		}
+		found := false
+		for i, q := range ret {
+			if len(q) < 2 || q[0] != p[0] {
+				continue
+			}
+			if sum {
+				ret[i] = intake.Point{q[0], q[1] + p[1]}
+			} else {
+				ret[i] = p
+			}
+			found = true
+			break
+		}
+		if !found {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// limitedMetric reports how many times a metric was limited
+type limitedMetric struct {
+	Metric  string `json:"metric"`
+	Series  int    `json:"series"`
+	Limited uint64 `json:"limited"`
+}
+
+// trackerStatus reports the state of a tracker
+type trackerStatus struct {
+	Name      string          `json:"name"`
+	MaxSeries int             `json:"max_series"`
+	Metrics   int             `json:"metrics"`
+	Limited   []limitedMetric `json:"limited"`
+	// Untracked counts the metrics let through as max_metrics was reached
+	Untracked uint64 `json:"untracked"`
+}
+
+func (t *tracker) status() trackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := trackerStatus{
+		Name:      t.name,
+		MaxSeries: t.maxSeries,
+		Metrics:   len(t.series),
+		Limited:   []limitedMetric{},
+		Untracked: t.untracked,
+	}
+	for metric, n := range t.limited {
+		st.Limited = append(st.Limited, limitedMetric{Metric: metric, Series: len(t.series[metric]), Limited: n})
+	}
+	sort.Slice(st.Limited, func(i, j int) bool { return st.Limited[i].Metric < st.Limited[j].Metric })
+	return st
+}
+
+// cardinalityStatus reports the metrics limited by each cardinality processor
+func cardinalityStatus() interface{} {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+
+	ret := []trackerStatus{}
+	for _, t := range trackers {
+		ret = append(ret, t.status())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// CheckNames returns an error when two cardinality processors of the chains
+// share the same name, as they would share the series seen too
+func CheckNames(chains ...Chain) error {
+	seen := map[string]bool{}
+	for _, chain := range chains {
+		for _, p := range chain {
+			c, ok := p.(*cardinality)
+			if !ok {
+				continue
+			}
+			if seen[c.name] {
+				return fmt.Errorf("more than one cardinality processor named '%s', give each of them a different name", c.name)
+			}
+			seen[c.name] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package processors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// getStatus returns the status of the tracker with the given name
+func getStatus(t *testing.T, name string) trackerStatus {
+	for _, st := range cardinalityStatus().([]trackerStatus) {
+		if st.Name == name {
+			return st
+		}
+	}
+	require.FailNow(t, "tracker not found", name)
+	return trackerStatus{}
+}
+
+func TestCardinalityDrop(t *testing.T) {
+	output.Init(0)
+	p := newProcessor(t, `
+processors:
+  - type: cardinality
+    name: test_drop
+    match: ^app\.
+    max_series: 2
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "app.requests", Tags: []string{"path:/a", "env:prod"}},
+		{Metric: "app.requests", Tags: []string{"env:prod", "path:/b"}},
+		{Metric: "app.requests", Tags: []string{"env:prod", "path:/c"}},
+		{Metric: "app.requests", Host: "web-1", Tags: []string{"env:prod", "path:/a"}},
+		// same series as the first one, tags in a different order
+		{Metric: "app.requests", Tags: []string{"env:prod", "path:/a"}},
+		{Metric: "app.errors", Tags: []string{"path:/c"}},
+		{Metric: "system.cpu.user", Host: "web-1"},
+		{Metric: "system.cpu.user", Host: "web-2"},
+		{Metric: "system.cpu.user", Host: "web-3"},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "app.requests", Tags: []string{"path:/a", "env:prod"}},
+		{Metric: "app.requests", Tags: []string{"env:prod", "path:/b"}},
+		{Metric: "app.requests", Tags: []string{"env:prod", "path:/a"}},
+		{Metric: "app.errors", Tags: []string{"path:/c"}},
+		{Metric: "system.cpu.user", Host: "web-1"},
+		{Metric: "system.cpu.user", Host: "web-2"},
+		{Metric: "system.cpu.user", Host: "web-3"},
+	}, got)
+
+	require.Equal(t, trackerStatus{
+		Name:      "test_drop",
+		MaxSeries: 2,
+		Metrics:   2,
+		Limited:   []limitedMetric{{Metric: "app.requests", Series: 2, Limited: 2}},
+	}, getStatus(t, "test_drop"))
+}
+
+func TestCardinalityAggregate(t *testing.T) {
+	output.Init(0)
+	p := newProcessor(t, `
+processors:
+  - type: cardinality
+    name: test_aggregate
+    max_series: 1
+    action: aggregate
+    tags: [pod]
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "requests", Type: "count", Tags: []string{"pod:a", "env:prod"}, Points: []intake.Point{{10, 1}}},
+		{Metric: "requests", Type: "count", Tags: []string{"pod:b", "env:prod"}, Points: []intake.Point{{10, 2}}},
+		{Metric: "requests", Type: "count", Tags: []string{"pod:c", "env:prod"}, Points: []intake.Point{{10, 3}, {20, 1}}},
+		{Metric: "requests", Type: "count", Tags: []string{"pod:d", "env:dev"}, Points: []intake.Point{{10, 4}}},
+		{Metric: "memory", Type: "gauge", Tags: []string{"pod:a"}, Points: []intake.Point{{10, 1}}},
+		{Metric: "memory", Type: "gauge", Tags: []string{"pod:b"}, Points: []intake.Point{{10, 2}}},
+		{Metric: "memory", Type: "gauge", Tags: []string{"pod:c"}, Points: []intake.Point{{10, 3}}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "requests", Type: "count", Tags: []string{"pod:a", "env:prod"}, Points: []intake.Point{{10, 1}}},
+		{Metric: "requests", Type: "count", Tags: []string{"env:prod"}, Points: []intake.Point{{10, 5}, {20, 1}}},
+		{Metric: "requests", Type: "count", Tags: []string{"env:dev"}, Points: []intake.Point{{10, 4}}},
+		{Metric: "memory", Type: "gauge", Tags: []string{"pod:a"}, Points: []intake.Point{{10, 1}}},
+		{Metric: "memory", Type: "gauge", Tags: []string{}, Points: []intake.Point{{10, 3}}},
+	}, got)
+
+}
+
+func TestCardinalityWindow(t *testing.T) {
+	output.Init(0)
+	p := newProcessor(t, `
+processors:
+  - type: cardinality
+    name: test_window
+    max_series: 1
+    max_metrics: 1
+    window: 1m
+`)
+	now := time.Now()
+	p.(*cardinality).t.now = func() time.Time { return now }
+
+	metrics := []intake.V1Metric{
+		{Metric: "a", Host: "web-1"},
+		{Metric: "a", Host: "web-2"},
+		{Metric: "b", Host: "web-1"},
+	}
+	// only one metric name is tracked, the others are let through
+	require.Equal(t, []intake.V1Metric{metrics[0], metrics[2]}, process(t, p, metrics))
+	require.Equal(t, trackerStatus{
+		Name:      "test_window",
+		MaxSeries: 1,
+		Metrics:   1,
+		Limited:   []limitedMetric{{Metric: "a", Series: 1, Limited: 1}},
+		Untracked: 1,
+	}, getStatus(t, "test_window"))
+
+	// the series are forgotten once the window is over
+	now = now.Add(time.Minute)
+	require.Equal(t, metrics[1:], process(t, p, metrics[1:]))
+}
+
+func TestCardinalityReload(t *testing.T) {
+	output.Init(0)
+	config := `
+processors:
+  - type: cardinality
+    name: test_reload
+    max_series: 1
+`
+	p := newProcessor(t, config)
+	require.Len(t, process(t, p, []intake.V1Metric{{Metric: "a", Host: "web-1"}}), 1)
+
+	// the series seen by the previous processor are kept
+	p = newProcessor(t, config)
+	require.Empty(t, process(t, p, []intake.V1Metric{{Metric: "a", Host: "web-2"}}))
+
+	// unless the limits changed
+	p = newProcessor(t, `
+processors:
+  - type: cardinality
+    name: test_reload
+    max_series: 2
+`)
+	require.Len(t, process(t, p, []intake.V1Metric{{Metric: "a", Host: "web-2"}}), 1)
+}
+
+func TestCardinalityErrors(t *testing.T) {
+	testcases := []string{
+		`[{"type": "cardinality", "action": "foo"}]`,
+		`[{"type": "cardinality", "max_series": 0}]`,
+		`[{"type": "cardinality", "max_metrics": -1}]`,
+		`[{"type": "cardinality", "match": "("}]`,
+		`[{"type": "cardinality", "action": "aggregate"}]`,
+	}
+	for _, tc := range testcases {
+		v := viper.New()
+		v.Set("processors", tc)
+		_, err := FromConfig(v, "processors")
+		require.Error(t, err, tc)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	global := newProcessor(t, `
+processors:
+  - type: cardinality
+`)
+	plugin, err := FromConfig(readConfig(t, `
+processors:
+  - type: cardinality
+    name: plugin
+  - type: tag_add
+    tags: [env:prod]
+`), "processors")
+	require.Nil(t, err)
+	require.Nil(t, CheckNames(Chain{global}, plugin))
+
+	// unnamed processors share the default name
+	require.EqualError(t, CheckNames(Chain{global}, plugin, Chain{global}),
+		"more than one cardinality processor named 'cardinality', give each of them a different name")
+}
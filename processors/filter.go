@@ -0,0 +1,69 @@
+package processors
+
+import (
+	"errors"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("filter", newFilter)
+}
+
+// Filter drops the metrics not matching include, when set, and the metrics
+// matching exclude. It's configured with two matchers, see ParseMatcher:
+//
+//	processors:
+//	  - type: filter
+//	    include:
+//	      name: ^system\.
+//	      tag: env:prod
+//	      type: gauge
+//	    exclude: [^system\.disk\.]
+type Filter struct {
+	include Matcher
+	exclude Matcher
+}
+
+// NewFilter returns a Filter, a nil matcher is ignored
+func NewFilter(include, exclude Matcher) *Filter {
+	return &Filter{include, exclude}
+}
+
+func newFilter(cfg *viper.Viper) (Processor, error) {
+	include, err := ParseMatcher(cfg.Get("include"))
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := ParseMatcher(cfg.Get("exclude"))
+	if err != nil {
+		return nil, err
+	}
+	if include == nil && exclude == nil {
+		return nil, errors.New("at least one of include and exclude must be set")
+	}
+	return NewFilter(include, exclude), nil
+}
+
+// Process implements Processor
+func (f *Filter) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	if f.include == nil && f.exclude == nil {
+		return metrics
+	}
+
+	ret := make([]intake.V1Metric, 0, len(metrics))
+	for i := range metrics {
+		if f.keep(&metrics[i]) {
+			ret = append(ret, metrics[i])
+		}
+	}
+	return ret
+}
+
+func (f *Filter) keep(m *intake.V1Metric) bool {
+	if f.include != nil && !f.include.Match(m) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.Match(m)
+}
@@ -0,0 +1,47 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: filter
+    include: [^system\.]
+    exclude: [^system\.disk\.]
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user"},
+		{Metric: "system.disk.free"},
+		{Metric: "datadog.agent.running"},
+	})
+	require.Equal(t, []intake.V1Metric{{Metric: "system.cpu.user"}}, got)
+}
+
+func TestFilterMatchers(t *testing.T) {
+	// only env:prod system gauges, without the self metrics
+	p := newProcessor(t, `
+processors:
+  - type: filter
+    include:
+      all:
+        - name: ^system\.
+        - tag: env:prod
+        - type: gauge
+    exclude:
+      name: datadog
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user", Type: "gauge", Tags: []string{"env:prod"}},
+		{Metric: "system.cpu.user", Type: "gauge", Tags: []string{"env:dev"}},
+		{Metric: "system.net.bytes_rcvd", Type: "rate", Tags: []string{"env:prod"}},
+		{Metric: "system.datadog.foo", Type: "gauge", Tags: []string{"env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "system.cpu.user", Type: "gauge", Tags: []string{"env:prod"}},
+	}, got)
+}
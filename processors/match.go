@@ -0,0 +1,229 @@
+package processors
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/cast"
+)
+
+// Matcher selects metrics
+type Matcher interface {
+	Match(*intake.V1Metric) bool
+}
+
+// matchFunc implements Matcher with a function
+type matchFunc func(*intake.V1Metric) bool
+
+func (f matchFunc) Match(m *intake.V1Metric) bool {
+	return f(m)
+}
+
+// allOf matches when every Matcher matches
+type allOf []Matcher
+
+func (a allOf) Match(m *intake.V1Metric) bool {
+	for _, matcher := range a {
+		if !matcher.Match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyOf matches when at least one Matcher matches
+type anyOf []Matcher
+
+func (a anyOf) Match(m *intake.V1Metric) bool {
+	for _, matcher := range a {
+		if matcher.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMatcher builds a Matcher out of its config. A string is a regexp matching
+// the metric name, a list matches when any of its items matches and a map
+// matches when all of its conditions match:
+//
+//	name: ^system\.          # regexp on the metric name
+//	host: ^web-              # regexp on the host
+//	source_type_name: ^Sys   # regexp on the source type
+//	type: gauge              # metric type
+//	tag: env:prod            # tag with the given key and a value matching the regexp,
+//	                         # or just the key to match any value
+//	all: [...]               # every matcher in the list matches
+//	any: [...]               # at least one matcher in the list matches
+//	not: ...                 # the matcher doesn't match
+//
+// Conditions accepting a list of values match when any of the values match.
+// A nil config or an empty list return a nil Matcher.
+func ParseMatcher(raw interface{}) (Matcher, error) {
+	switch v := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return nameMatcher(v)
+	case []interface{}, []string:
+		items, _ := toSlice(v)
+		ms, err := parseMatchers(items)
+		if err != nil || len(ms) == 0 {
+			// an empty list is the same as no matcher
+			return nil, err
+		}
+		return ms, nil
+	}
+
+	conditions, err := cast.ToStringMapE(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher: %v", raw)
+	}
+
+	// sort the conditions so that errors are always reported in the same order
+	keys := make([]string, 0, len(conditions))
+	for k := range conditions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := allOf{}
+	for _, k := range keys {
+		m, err := parseCondition(k, conditions[k])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// parseMatchers parses a list of matchers, returning a Matcher matching
+// when any of them matches
+func parseMatchers(items []interface{}) (anyOf, error) {
+	ret := anyOf{}
+	for _, item := range items {
+		m, err := ParseMatcher(item)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// parseCondition parses a single condition of a matcher
+func parseCondition(key string, value interface{}) (Matcher, error) {
+	switch key {
+	case "all", "any":
+		items, err := toSlice(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher: %s expects a list", key)
+		}
+		ms, err := parseMatchers(items)
+		if err != nil {
+			return nil, err
+		}
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("invalid matcher: %s expects a non empty list", key)
+		}
+		if key == "all" {
+			return allOf(ms), nil
+		}
+		return ms, nil
+	case "not":
+		m, err := ParseMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, fmt.Errorf("invalid matcher: not expects a matcher")
+		}
+		return matchFunc(func(metric *intake.V1Metric) bool { return !m.Match(metric) }), nil
+	}
+
+	values, err := cast.ToStringSliceE(value)
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("invalid matcher: %s expects a string or a list of strings", key)
+	}
+
+	ret := anyOf{}
+	for _, v := range values {
+		var m Matcher
+		switch key {
+		case "name":
+			m, err = nameMatcher(v)
+		case "host":
+			m, err = regexpMatcher(v, func(metric *intake.V1Metric) string { return metric.Host })
+		case "source_type_name":
+			m, err = regexpMatcher(v, func(metric *intake.V1Metric) string { return metric.SourceTypeName })
+		case "type":
+			metricType := v
+			m = matchFunc(func(metric *intake.V1Metric) bool { return metric.Type == metricType })
+		case "tag":
+			m, err = tagMatcher(v)
+		default:
+			return nil, fmt.Errorf("invalid matcher: unknown condition '%s'", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// toSlice converts lists of strings as well, unlike cast.ToSliceE
+func toSlice(value interface{}) ([]interface{}, error) {
+	if v, ok := value.([]string); ok {
+		items := make([]interface{}, len(v))
+		for i := range v {
+			items[i] = v[i]
+		}
+		return items, nil
+	}
+	return cast.ToSliceE(value)
+}
+
+func nameMatcher(expr string) (Matcher, error) {
+	return regexpMatcher(expr, func(metric *intake.V1Metric) string { return metric.Metric })
+}
+
+// regexpMatcher matches when the regexp matches the field returned by get
+func regexpMatcher(expr string, get func(*intake.V1Metric) string) (Matcher, error) {
+	r, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher: %w", err)
+	}
+	return matchFunc(func(metric *intake.V1Metric) bool { return r.MatchString(get(metric)) }), nil
+}
+
+// tagMatcher matches the metrics having a tag with the given key and a
+// value matching the whole regexp, or any value when there's no regexp
+func tagMatcher(expr string) (Matcher, error) {
+	key, valueExpr := splitTag(expr)
+	if !strings.Contains(expr, ":") {
+		return matchFunc(func(metric *intake.V1Metric) bool {
+			_, found := getTag(metric.Tags, key)
+			return found
+		}), nil
+	}
+
+	r, err := regexp.Compile("^(?:" + valueExpr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher: %w", err)
+	}
+	return matchFunc(func(metric *intake.V1Metric) bool {
+		for _, tag := range metric.Tags {
+			if k, v := splitTag(tag); k == key && r.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
@@ -0,0 +1,63 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatcher(t *testing.T) {
+	metrics := []intake.V1Metric{
+		{Metric: "system.cpu.user", Type: "gauge", Host: "web-1", Tags: []string{"env:prod", "role:web"}, SourceTypeName: "System"},
+		{Metric: "system.net.bytes_rcvd", Type: "rate", Host: "web-1", Tags: []string{"env:prod"}},
+		{Metric: "system.cpu.user", Type: "gauge", Host: "db-1", Tags: []string{"env:staging", "ephemeral"}},
+		{Metric: "datadog.agent.running", Type: "gauge", Host: "db-1", Tags: []string{"env:prod"}},
+	}
+
+	testcases := []struct {
+		config   string
+		expected []bool
+	}{
+		{`match: ^system\.`, []bool{true, true, true, false}},
+		{`match: [^datadog\., \.net\.]`, []bool{false, true, false, true}},
+		{`match: {name: ^system\., tag: "env:prod", type: gauge}`, []bool{true, false, false, false}},
+		{`match: {tag: "env:prod|staging"}`, []bool{true, true, true, true}},
+		{`match: {tag: ephemeral}`, []bool{false, false, true, false}},
+		{`match: {tag: [role, ephemeral]}`, []bool{true, false, true, false}},
+		{`match: {host: ^db-}`, []bool{false, false, true, true}},
+		{`match: {source_type_name: System}`, []bool{true, false, false, false}},
+		{`match: {type: [rate, count]}`, []bool{false, true, false, false}},
+		{`match: {all: [{host: ^web-}, {type: gauge}]}`, []bool{true, false, false, false}},
+		{`match: {any: [{host: ^web-}, {tag: ephemeral}]}`, []bool{true, true, true, false}},
+		{`match: {not: {tag: "env:prod"}}`, []bool{false, false, true, false}},
+	}
+
+	for _, tc := range testcases {
+		m, err := ParseMatcher(readConfig(t, tc.config).Get("match"))
+		require.Nil(t, err, tc.config)
+		for i := range metrics {
+			require.Equal(t, tc.expected[i], m.Match(&metrics[i]), "%s: metric %d", tc.config, i)
+		}
+	}
+}
+
+func TestParseMatcherErrors(t *testing.T) {
+	testcases := []string{
+		`match: "("`,
+		`match: {foo: bar}`,
+		`match: {tag: "env:("}`,
+		`match: {all: foo}`,
+		`match: {not: []}`,
+		`match: {name: {foo: bar}}`,
+		`match: 42`,
+	}
+	for _, tc := range testcases {
+		_, err := ParseMatcher(readConfig(t, tc).Get("match"))
+		require.Error(t, err, tc)
+	}
+
+	m, err := ParseMatcher(nil)
+	require.Nil(t, err)
+	require.Nil(t, m)
+}
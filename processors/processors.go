@@ -0,0 +1,127 @@
+// Package processors transforms the metrics received from the Datadog Agent
+// before they reach the outputs.
+//
+// Processors are arranged in chains configured as a list, each item has a
+// `type` and the settings of the processor:
+//
+//	processors:
+//	  - type: filter
+//	    exclude:
+//	      - datadog.*
+//	  - type: tag_add
+//	    tags:
+//	      - env:prod
+//
+// Metrics are shared among plugins so processors must never modify their
+// input, they return a new slice instead.
+package processors
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Processor transforms a batch of metrics
+type Processor interface {
+	// Process returns the transformed metrics, leaving the input untouched
+	Process([]intake.V1Metric) []intake.V1Metric
+}
+
+// Factory creates a processor reading its settings from cfg
+type Factory func(cfg *viper.Viper) (Processor, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a processor type available in the config
+func Register(name string, factory Factory) {
+	if _, found := factories[name]; found {
+		panic("processors: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Types returns the names of the available processors
+func Types() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain applies a list of processors in order
+type Chain []Processor
+
+// Process implements Processor
+func (c Chain) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	for _, p := range c {
+		if len(metrics) == 0 {
+			break
+		}
+		metrics = p.Process(metrics)
+	}
+	return metrics
+}
+
+// FromConfig builds the chain of processors configured under key, the chain is
+// empty when the key is not set. The list can also be passed as JSON, for
+// example with an env var.
+func FromConfig(v *viper.Viper, key string) (Chain, error) {
+	raw := v.Get(key)
+	if s, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	if raw == nil {
+		return Chain{}, nil
+	}
+
+	items, err := cast.ToSliceE(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: expected a list", key)
+	}
+
+	chain := Chain{}
+	for i, item := range items {
+		settings, err := cast.ToStringMapE(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: entry %d is not a map", key, i)
+		}
+		name := cast.ToString(settings["type"])
+		factory, found := factories[name]
+		if !found {
+			return nil, fmt.Errorf("invalid %s: entry %d has unknown type '%s', available types: %s",
+				key, i, name, strings.Join(Types(), ", "))
+		}
+		delete(settings, "type")
+
+		cfg := viper.New()
+		// MergeConfigMap only fails when reading from an io.Reader
+		_ = cfg.MergeConfigMap(settings)
+		p, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s processor: %w", key, name, err)
+		}
+		chain = append(chain, p)
+	}
+
+	return chain, nil
+}
+
+// splitTag returns the key and the value of a Datadog tag, tags without
+// a value have an empty value
+func splitTag(tag string) (key, value string) {
+	toks := strings.SplitN(tag, ":", 2)
+	if len(toks) == 1 {
+		return toks[0], ""
+	}
+	return toks[0], toks[1]
+}
@@ -0,0 +1,89 @@
+package processors
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// newProcessor builds a single processor out of a YAML config
+func newProcessor(t *testing.T, yaml string) Processor {
+	chain, err := FromConfig(readConfig(t, yaml), "processors")
+	require.Nil(t, err)
+	require.Len(t, chain, 1)
+	return chain[0]
+}
+
+func readConfig(t *testing.T, yaml string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.Nil(t, v.ReadConfig(strings.NewReader(yaml)))
+	return v
+}
+
+// process runs the processor and checks the input was left untouched
+func process(t *testing.T, p Processor, metrics []intake.V1Metric) []intake.V1Metric {
+	before, err := json.Marshal(metrics)
+	require.Nil(t, err)
+	ret := p.Process(metrics)
+	after, err := json.Marshal(metrics)
+	require.Nil(t, err)
+	require.JSONEq(t, string(before), string(after), "the input was modified")
+	return ret
+}
+
+func TestFromConfig(t *testing.T) {
+	chain, err := FromConfig(readConfig(t, `
+processors:
+  - type: filter
+    exclude: [^datadog\.]
+  - type: rename
+    match: ^system\.(.*)
+    replacement: host.$1
+  - type: tag_add
+    tags: [env:prod]
+`), "processors")
+	require.Nil(t, err)
+	require.Len(t, chain, 3)
+
+	got := process(t, chain, []intake.V1Metric{
+		{Metric: "datadog.agent.running"},
+		{Metric: "system.cpu.user", Tags: []string{"env:dev"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "host.cpu.user", Tags: []string{"env:prod"}},
+	}, got)
+
+	// not set
+	chain, err = FromConfig(viper.New(), "processors")
+	require.Nil(t, err)
+	require.Empty(t, chain)
+
+	// JSON, as passed with env vars
+	v := viper.New()
+	v.Set("processors", `[{"type": "tag_drop", "tags": ["pod_name"]}]`)
+	chain, err = FromConfig(v, "processors")
+	require.Nil(t, err)
+	require.Len(t, chain, 1)
+}
+
+func TestFromConfigErrors(t *testing.T) {
+	testcases := []string{
+		`[{"type": "foo"}]`,
+		`[{"exclude": ["foo"]}]`,
+		`[{"type": "filter"}]`,
+		`[{"type": "filter", "exclude": ["("]}]`,
+		`{"type": "filter"}`,
+		`["filter"]`,
+	}
+	for _, tc := range testcases {
+		v := viper.New()
+		v.Set("processors", tc)
+		_, err := FromConfig(v, "processors")
+		require.Error(t, err, tc)
+	}
+}
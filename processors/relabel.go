@@ -0,0 +1,266 @@
+package processors
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("relabel", newRelabel)
+}
+
+// Special tag names used to read and write the fields of a metric
+const (
+	nameTag = "__name__"
+	hostTag = "__host__"
+)
+
+// Relabel actions, as in the Prometheus relabel_config
+const (
+	actionReplace   = "replace"
+	actionKeep      = "keep"
+	actionDrop      = "drop"
+	actionHashMod   = "hashmod"
+	actionLabelMap  = "labelmap"
+	actionLabelDrop = "labeldrop"
+	actionLabelKeep = "labelkeep"
+)
+
+// relabel applies Prometheus style relabeling rules to the metrics, using
+// Datadog tags as labels. A single rule can be configured inline or a list
+// of rules can be passed with the rules option:
+//
+//	processors:
+//	  - type: relabel
+//	    source_tags: [service, env]
+//	    regex: (.+);prod
+//	    target_tag: prod_service
+//	  - type: relabel
+//	    rules:
+//	      - action: keep
+//	        source_tags: [__name__]
+//	        regex: system\..*
+//	      - action: labeldrop
+//	        regex: pod_.*
+//
+// The metric name and host can be read and written with the __name__ and
+// __host__ tags.
+type relabel struct {
+	rules []*relabelRule
+}
+
+// relabelRule follows the semantics of the Prometheus relabel_config: the
+// values of source_tags are joined with separator and matched against regex,
+// which must match the whole value.
+type relabelRule struct {
+	action      string
+	sourceTags  []string
+	separator   string
+	regex       *regexp.Regexp
+	targetTag   string
+	replacement string
+	modulus     uint64
+}
+
+func newRelabel(cfg *viper.Viper) (Processor, error) {
+	if !cfg.IsSet("rules") {
+		rule, err := newRelabelRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &relabel{[]*relabelRule{rule}}, nil
+	}
+
+	items, err := cast.ToSliceE(cfg.Get("rules"))
+	if err != nil || len(items) == 0 {
+		return nil, errors.New("rules must be a non empty list")
+	}
+	r := &relabel{}
+	for i, item := range items {
+		settings, err := cast.ToStringMapE(item)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d is not a map", i)
+		}
+		ruleCfg := viper.New()
+		// MergeConfigMap only fails when reading from an io.Reader
+		_ = ruleCfg.MergeConfigMap(settings)
+		rule, err := newRelabelRule(ruleCfg)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func newRelabelRule(cfg *viper.Viper) (*relabelRule, error) {
+	cfg.SetDefault("action", actionReplace)
+	cfg.SetDefault("separator", ";")
+	cfg.SetDefault("regex", "(.*)")
+	cfg.SetDefault("replacement", "$1")
+
+	// the regex must match the whole value as in Prometheus
+	regex, err := regexp.Compile("^(?:" + cfg.GetString("regex") + ")$")
+	if err != nil {
+		return nil, err
+	}
+	r := &relabelRule{
+		action:      strings.ToLower(cfg.GetString("action")),
+		sourceTags:  cfg.GetStringSlice("source_tags"),
+		separator:   cfg.GetString("separator"),
+		regex:       regex,
+		targetTag:   cfg.GetString("target_tag"),
+		replacement: cfg.GetString("replacement"),
+		modulus:     cast.ToUint64(cfg.Get("modulus")),
+	}
+
+	switch r.action {
+	case actionReplace, actionHashMod:
+		if r.targetTag == "" {
+			return nil, fmt.Errorf("target_tag must be set with action %s", r.action)
+		}
+		if r.action == actionHashMod && r.modulus == 0 {
+			return nil, errors.New("modulus must be set with action hashmod")
+		}
+		fallthrough
+	case actionKeep, actionDrop:
+		if len(r.sourceTags) == 0 {
+			return nil, fmt.Errorf("source_tags must be set with action %s", r.action)
+		}
+	case actionLabelMap, actionLabelDrop, actionLabelKeep:
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", r.action)
+	}
+
+	return r, nil
+}
+
+// Process implements Processor
+func (r *relabel) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	ret := make([]intake.V1Metric, 0, len(metrics))
+	for _, m := range metrics {
+		keep := true
+		for _, rule := range r.rules {
+			if keep = rule.apply(&m); !keep {
+				break
+			}
+		}
+		if keep {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// apply applies the rule to a copy of the metric, tags are never modified in
+// place as they're shared with the input. It returns false when the metric
+// must be dropped.
+func (r *relabelRule) apply(m *intake.V1Metric) bool {
+	switch r.action {
+	case actionReplace:
+		source := r.source(m)
+		idx := r.regex.FindStringSubmatchIndex(source)
+		if idx != nil {
+			value := string(r.regex.ExpandString(nil, r.replacement, source, idx))
+			setField(m, r.targetTag, value)
+		}
+	case actionKeep:
+		return r.regex.MatchString(r.source(m))
+	case actionDrop:
+		return !r.regex.MatchString(r.source(m))
+	case actionHashMod:
+		sum := md5.Sum([]byte(r.source(m)))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.modulus
+		setField(m, r.targetTag, strconv.FormatUint(mod, 10))
+	case actionLabelMap:
+		var added []string
+		for _, tag := range m.Tags {
+			key, value := splitTag(tag)
+			if idx := r.regex.FindStringSubmatchIndex(key); idx != nil {
+				newKey := string(r.regex.ExpandString(nil, r.replacement, key, idx))
+				added = append(added, newKey+":"+value)
+			}
+		}
+		for _, tag := range added {
+			key, value := splitTag(tag)
+			m.Tags = setTag(m.Tags, key, value)
+		}
+	case actionLabelDrop:
+		m.Tags = filterTags(m.Tags, func(key, value string) bool { return !r.regex.MatchString(key) })
+	case actionLabelKeep:
+		m.Tags = filterTags(m.Tags, func(key, value string) bool { return r.regex.MatchString(key) })
+	}
+	return true
+}
+
+// source returns the values of the source tags joined by the separator
+func (r *relabelRule) source(m *intake.V1Metric) string {
+	values := make([]string, len(r.sourceTags))
+	for i, key := range r.sourceTags {
+		values[i] = getField(m, key)
+	}
+	return strings.Join(values, r.separator)
+}
+
+// getField returns the value of a tag, or of the metric field for the
+// special tags
+func getField(m *intake.V1Metric, key string) string {
+	switch key {
+	case nameTag:
+		return m.Metric
+	case hostTag:
+		return m.Host
+	}
+	value, _ := getTag(m.Tags, key)
+	return value
+}
+
+// setField sets the value of a tag, or of the metric field for the special
+// tags. Tags with an empty value are removed, while the metric name can't
+// be empty.
+func setField(m *intake.V1Metric, key, value string) {
+	switch key {
+	case nameTag:
+		if value != "" {
+			m.Metric = value
+		}
+	case hostTag:
+		m.Host = value
+	default:
+		m.Tags = setTag(m.Tags, key, value)
+	}
+}
+
+// getTag returns the value of the first tag with the given key
+func getTag(tags []string, key string) (string, bool) {
+	for _, tag := range tags {
+		if k, v := splitTag(tag); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// setTag returns a copy of tags where the tags with the given key are replaced
+// by key:value, or removed when value is empty
+func setTag(tags []string, key, value string) []string {
+	ret := make([]string, 0, len(tags)+1)
+	for _, tag := range tags {
+		if k, _ := splitTag(tag); k != key {
+			ret = append(ret, tag)
+		}
+	}
+	if value != "" {
+		ret = append(ret, key+":"+value)
+	}
+	return ret
+}
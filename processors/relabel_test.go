@@ -0,0 +1,160 @@
+package processors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelabel(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: relabel
+    source_tags: [service, env]
+    regex: (.+);prod
+    target_tag: prod_service
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"service:web", "env:prod"}},
+		{Metric: "b", Tags: []string{"service:web", "env:staging"}},
+		{Metric: "c", Tags: []string{"env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"service:web", "env:prod", "prod_service:web"}},
+		{Metric: "b", Tags: []string{"service:web", "env:staging"}},
+		{Metric: "c", Tags: []string{"env:prod"}},
+	}, got)
+}
+
+func TestRelabelSpecialTags(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: relabel
+    rules:
+      - source_tags: [__name__]
+        regex: system\.(.*)
+        target_tag: __name__
+        replacement: host.$1
+      - source_tags: [__host__]
+        regex: ([^.]+)\..*
+        target_tag: hostname
+      - source_tags: [role]
+        target_tag: __host__
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user", Host: "web-1.example.com", Tags: []string{"role:db"}},
+		{Metric: "app.requests", Host: "localhost"},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "host.cpu.user", Host: "db", Tags: []string{"role:db", "hostname:web-1"}},
+		{Metric: "app.requests", Host: ""},
+	}, got)
+}
+
+func TestRelabelKeepDrop(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: relabel
+    rules:
+      - action: keep
+        source_tags: [__name__]
+        regex: system\..*
+      - action: drop
+        source_tags: [env, __host__]
+        regex: dev;.*|.*;localhost
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user", Host: "web-1", Tags: []string{"env:prod"}},
+		{Metric: "system.cpu.user", Host: "web-2", Tags: []string{"env:dev"}},
+		{Metric: "system.cpu.user", Host: "localhost"},
+		{Metric: "app.requests", Host: "web-1", Tags: []string{"env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "system.cpu.user", Host: "web-1", Tags: []string{"env:prod"}},
+	}, got)
+}
+
+func TestRelabelLabels(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: relabel
+    rules:
+      - action: labelmap
+        regex: kube_(.*)
+      - action: labeldrop
+        regex: kube_.*|pod_name
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"kube_namespace:default", "kube_service:web", "pod_name:web-1", "env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"env:prod", "namespace:default", "service:web"}},
+	}, got)
+
+	p = newProcessor(t, `
+processors:
+  - type: relabel
+    action: labelkeep
+    regex: env|service
+`)
+	got = process(t, p, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"service:web", "pod_name:web-1", "env:prod", "ephemeral"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "a", Tags: []string{"service:web", "env:prod"}},
+	}, got)
+}
+
+func TestRelabelHashMod(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: relabel
+    action: hashmod
+    source_tags: [__host__]
+    modulus: 4
+    target_tag: shard
+`)
+	metrics := []intake.V1Metric{}
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, intake.V1Metric{Metric: "a", Host: fmt.Sprintf("web-%d", i)})
+	}
+	got := process(t, p, metrics)
+	again := process(t, p, metrics)
+	require.Equal(t, got, again, "the shard must only depend on the source")
+
+	shards := map[string]bool{}
+	for _, m := range got {
+		require.Len(t, m.Tags, 1)
+		shard := strings.TrimPrefix(m.Tags[0], "shard:")
+		n, err := strconv.Atoi(shard)
+		require.Nil(t, err)
+		require.True(t, n >= 0 && n < 4, shard)
+		shards[shard] = true
+	}
+	require.Greater(t, len(shards), 1)
+}
+
+func TestRelabelErrors(t *testing.T) {
+	testcases := []string{
+		`[{"type": "relabel", "target_tag": "foo"}]`,
+		`[{"type": "relabel", "source_tags": ["foo"]}]`,
+		`[{"type": "relabel", "source_tags": ["foo"], "target_tag": "bar", "regex": "("}]`,
+		`[{"type": "relabel", "action": "keep"}]`,
+		`[{"type": "relabel", "action": "hashmod", "source_tags": ["foo"], "target_tag": "bar"}]`,
+		`[{"type": "relabel", "action": "foo", "source_tags": ["foo"]}]`,
+		`[{"type": "relabel", "rules": []}]`,
+		`[{"type": "relabel", "rules": ["foo"]}]`,
+		`[{"type": "relabel", "rules": [{"action": "labeldrop"}, {"action": "drop"}]}]`,
+	}
+	for _, tc := range testcases {
+		v := viper.New()
+		v.Set("processors", tc)
+		_, err := FromConfig(v, "processors")
+		require.Error(t, err, tc)
+	}
+}
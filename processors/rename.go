@@ -0,0 +1,48 @@
+package processors
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("rename", newRename)
+}
+
+// rename changes the name of the metrics matching a regexp, the replacement
+// can reference the capturing groups as in regexp.Regexp.Expand:
+//
+//	processors:
+//	  - type: rename
+//	    match: ^system\.(.*)
+//	    replacement: host.$1
+type rename struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+func newRename(cfg *viper.Viper) (Processor, error) {
+	if cfg.GetString("match") == "" {
+		return nil, errors.New("match must be set")
+	}
+	match, err := regexp.Compile(cfg.GetString("match"))
+	if err != nil {
+		return nil, err
+	}
+	return &rename{match, cfg.GetString("replacement")}, nil
+}
+
+// Process implements Processor
+func (r *rename) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	ret := make([]intake.V1Metric, len(metrics))
+	for i, m := range metrics {
+		if r.match.MatchString(m.Metric) {
+			m.Metric = r.match.ReplaceAllString(m.Metric, r.replacement)
+		}
+		ret[i] = m
+	}
+	return ret
+}
@@ -0,0 +1,25 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRename(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: rename
+    match: ^system\.(\w+)\.(.*)
+    replacement: host_${1}_$2
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user"},
+		{Metric: "datadog.agent.running"},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "host_cpu_user"},
+		{Metric: "datadog.agent.running"},
+	}, got)
+}
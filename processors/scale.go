@@ -0,0 +1,68 @@
+package processors
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("scale", newScale)
+}
+
+// scale multiplies the values of the metrics matching a regexp by a factor,
+// optionally changing their unit. It can be used to convert units, for
+// example from bytes to megabytes:
+//
+//	processors:
+//	  - type: scale
+//	    match: ^system\.mem\.
+//	    factor: 0.000001
+//	    unit: megabyte
+type scale struct {
+	match  *regexp.Regexp
+	factor float64
+	unit   string
+}
+
+func newScale(cfg *viper.Viper) (Processor, error) {
+	if !cfg.IsSet("factor") {
+		return nil, errors.New("factor must be set")
+	}
+	s := &scale{
+		factor: cfg.GetFloat64("factor"),
+		unit:   cfg.GetString("unit"),
+	}
+	if expr := cfg.GetString("match"); expr != "" {
+		var err error
+		if s.match, err = regexp.Compile(expr); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Process implements Processor
+func (s *scale) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	ret := make([]intake.V1Metric, len(metrics))
+	for i, m := range metrics {
+		if s.match == nil || s.match.MatchString(m.Metric) {
+			points := make([]intake.Point, len(m.Points))
+			for j, p := range m.Points {
+				if len(p) < 2 {
+					points[j] = p
+					continue
+				}
+				points[j] = intake.Point{p[0], p[1] * s.factor}
+			}
+			m.Points = points
+			if s.unit != "" {
+				m.Unit = s.unit
+			}
+		}
+		ret[i] = m
+	}
+	return ret
+}
@@ -0,0 +1,26 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScale(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: scale
+    match: ^system\.mem\.
+    factor: 0.001
+    unit: kilobyte
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.mem.free", Points: []intake.Point{{1612906502, 2000}}, Unit: "byte"},
+		{Metric: "system.cpu.user", Points: []intake.Point{{1612906502, 2000}}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "system.mem.free", Points: []intake.Point{{1612906502, 2}}, Unit: "kilobyte"},
+		{Metric: "system.cpu.user", Points: []intake.Point{{1612906502, 2000}}},
+	}, got)
+}
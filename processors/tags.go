@@ -0,0 +1,106 @@
+package processors
+
+import (
+	"errors"
+
+	"github.com/masci/threadle/intake"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	Register("tag_add", newTagAdd)
+	Register("tag_drop", newTagDrop)
+}
+
+// tagAdd adds tags to every metric, replacing the tags with the same key:
+//
+//	processors:
+//	  - type: tag_add
+//	    tags: [env:prod, team:infra]
+type tagAdd struct {
+	tags []string
+	keys map[string]bool
+}
+
+func newTagAdd(cfg *viper.Viper) (Processor, error) {
+	t := &tagAdd{
+		tags: cfg.GetStringSlice("tags"),
+		keys: map[string]bool{},
+	}
+	if len(t.tags) == 0 {
+		return nil, errors.New("tags must be set")
+	}
+	for _, tag := range t.tags {
+		key, _ := splitTag(tag)
+		t.keys[key] = true
+	}
+	return t, nil
+}
+
+// Process implements Processor
+func (t *tagAdd) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	ret := make([]intake.V1Metric, len(metrics))
+	for i, m := range metrics {
+		tags := make([]string, 0, len(m.Tags)+len(t.tags))
+		for _, tag := range m.Tags {
+			if key, _ := splitTag(tag); !t.keys[key] {
+				tags = append(tags, tag)
+			}
+		}
+		m.Tags = append(tags, t.tags...)
+		ret[i] = m
+	}
+	return ret
+}
+
+// tagDrop removes the tags with the given keys from every metric:
+//
+//	processors:
+//	  - type: tag_drop
+//	    tags: [pod_name, container_id]
+type tagDrop struct {
+	keys map[string]bool
+}
+
+func newTagDrop(cfg *viper.Viper) (Processor, error) {
+	t := &tagDrop{keys: map[string]bool{}}
+	for _, key := range cfg.GetStringSlice("tags") {
+		t.keys[key] = true
+	}
+	if len(t.keys) == 0 {
+		return nil, errors.New("tags must be set")
+	}
+	return t, nil
+}
+
+// Process implements Processor
+func (t *tagDrop) Process(metrics []intake.V1Metric) []intake.V1Metric {
+	ret := make([]intake.V1Metric, len(metrics))
+	for i, m := range metrics {
+		m.Tags = filterTags(m.Tags, func(key, value string) bool { return !t.keys[key] })
+		ret[i] = m
+	}
+	return ret
+}
+
+// filterTags returns the tags for which keep returns true, the input is
+// returned as is when no tag is dropped
+func filterTags(tags []string, keep func(key, value string) bool) []string {
+	var ret []string
+	for i, tag := range tags {
+		if keep(splitTag(tag)) {
+			if ret != nil {
+				ret = append(ret, tag)
+			}
+			continue
+		}
+		if ret == nil {
+			ret = make([]string, i, len(tags))
+			copy(ret, tags[:i])
+		}
+	}
+	if ret == nil {
+		return tags
+	}
+	return ret
+}
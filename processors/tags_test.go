@@ -0,0 +1,40 @@
+package processors
+
+import (
+	"testing"
+
+	"github.com/masci/threadle/intake"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagAdd(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: tag_add
+    tags: [env:prod, team:infra]
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user", Tags: []string{"env:dev", "role:db"}},
+		{Metric: "system.cpu.system"},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "system.cpu.user", Tags: []string{"role:db", "env:prod", "team:infra"}},
+		{Metric: "system.cpu.system", Tags: []string{"env:prod", "team:infra"}},
+	}, got)
+}
+
+func TestTagDrop(t *testing.T) {
+	p := newProcessor(t, `
+processors:
+  - type: tag_drop
+    tags: [pod_name, ephemeral]
+`)
+	got := process(t, p, []intake.V1Metric{
+		{Metric: "system.cpu.user", Tags: []string{"pod_name:foo", "env:prod", "ephemeral"}},
+		{Metric: "system.cpu.system", Tags: []string{"env:prod"}},
+	})
+	require.Equal(t, []intake.V1Metric{
+		{Metric: "system.cpu.user", Tags: []string{"env:prod"}},
+		{Metric: "system.cpu.system", Tags: []string{"env:prod"}},
+	}, got)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/masci/threadle/intake"
+	"github.com/masci/threadle/output"
+	"github.com/masci/threadle/plugins"
+	"github.com/spf13/viper"
+)
+
+// reloadMu serializes the reloads triggered by signals and file changes,
+// lastSettings holds the settings of the last config applied, nil until the
+// first reload
+var (
+	reloadMu     sync.Mutex
+	lastSettings map[string]interface{}
+)
+
+// watchConfig reloads the config on SIGHUP and, unless disabled with the
+// watch_config option, when the config file changes. It returns when the
+// context is done, after which the changes are ignored.
+func watchConfig(ctx context.Context, manager *plugins.Manager, strict bool) {
+	port := viper.GetString("port")
+	configFile := viper.ConfigFileUsed()
+
+	if viper.GetBool("watch_config") {
+		// the watcher only notifies the changes, every reload reads the
+		// config file from scratch
+		watcher := viper.New()
+		watcher.SetConfigFile(configFile)
+		watcher.OnConfigChange(func(e fsnotify.Event) {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			output.INFO.Println("Config file changed, reloading:", e.Name)
+			reloadConfig(ctx, manager, strict, port, configFile)
+		})
+		watcher.WatchConfig()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			output.INFO.Println("SIGHUP received, reloading the config")
+			reloadConfig(ctx, manager, strict, port, configFile)
+		}
+	}
+}
+
+// reloadConfig reads the config file into a new config and validates it, then
+// replaces the settings used to serve requests and applies the changes to the
+// plugins. When anything in the new config is not valid the current one is
+// kept as a whole. The HTTP listener can't be changed without a restart.
+// Nothing is reloaded once ctx is done, as the plugins are being stopped.
+func reloadConfig(ctx context.Context, manager *plugins.Manager, strict bool, port string, configFile string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	cfg := viper.New()
+	setupConfig(cfg)
+	cfg.SetConfigFile(configFile)
+	if err := cfg.ReadInConfig(); err != nil {
+		output.ERROR.Println("Error reloading the config, keeping the current one:", err)
+		return
+	}
+
+	if p := cfg.GetString("port"); p != port {
+		output.WARN.Printf("Port changed from %s to %s, restart Threadle to apply the change", port, p)
+	}
+
+	settings, err := loadSettings(cfg)
+	if err != nil {
+		output.ERROR.Println("Error reloading the config, keeping the current one:", err)
+		return
+	}
+
+	instances, err := plugins.GetInstances(cfg)
+	if err != nil {
+		output.ERROR.Println("Error reloading the plugins, keeping the current config:", err)
+		return
+	}
+	if !checkPlugins(instances, strict) {
+		output.ERROR.Println("Invalid plugins configuration, keeping the current config")
+		return
+	}
+	if err := checkProcessorNames(cfg, instances); err != nil {
+		output.ERROR.Println("Error reloading the processors, keeping the current config:", err)
+		return
+	}
+
+	before := lastSettings
+	if before == nil {
+		before = viper.AllSettings()
+	}
+	lastSettings = cfg.AllSettings()
+	if changed := changedKeys(before, lastSettings); len(changed) > 0 {
+		// only the names, values can hold secrets like API keys
+		output.INFO.Println("Config reloaded, changed settings:", changed)
+	}
+
+	intake.SetSettings(settings)
+	manager.Apply(instances)
+	if err := manager.Health(); err != nil {
+		// reported as unhealthy by the health endpoint
+		output.ERROR.Println("Config reloaded but", err)
+		return
+	}
+	output.INFO.Println("Config reloaded, running plugins:", manager.Running())
+}
+
+// changedKeys returns the sorted top-level keys added, removed or changed in
+// after compared to before
+func changedKeys(before, after map[string]interface{}) []string {
+	changed := []string{}
+	for k, v := range after {
+		if old, found := before[k]; !found || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, found := after[k]; !found {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}